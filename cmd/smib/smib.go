@@ -1,29 +1,213 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/nlopes/slack"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/config"
+	"github.com/somakeit/slacker-smib/internal/console"
 	"github.com/somakeit/slacker-smib/internal/smib"
+	"github.com/somakeit/slacker-smib/internal/socketmode"
+	"github.com/somakeit/slacker-smib/internal/store"
 )
 
 func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run runs smib until it is stopped, returning why if that wasn't a signal or the end of console
+// input. Store is closed on the way out, so main is the only place which may exit.
+func run() error {
 	var (
-		token      string
-		commandDir string
+		configFile string
+		flags      = config.Default()
+		maxDown    time.Duration
+		grace      time.Duration
+
+		consoleMode    bool
+		consoleUser    string
+		consoleChannel string
 	)
 
-	flag.StringVar(&token, "token", "", "Smib's slack token")
-	flag.StringVar(&commandDir, "commands", "", "Directory containing Smib's commands")
+	flag.StringVar(&configFile, "config", "", "YAML config file, flags override settings in it")
+	flag.StringVar(&flags.Token, "token", "", "Smib's slack token, prefer "+config.TokenEnv+" or -token-file as this is visible to other users")
+	flag.StringVar(&flags.TokenFile, "token-file", "", "File containing Smib's slack token, must be mode 0600")
+	flag.StringVar(&flags.Transport, "transport", flags.Transport, "How to connect to slack, "+config.TransportRTM+" or "+config.TransportSocket)
+	flag.StringVar(&flags.AppTokenFile, "app-token-file", "", "File containing Smib's app-level token for socket mode, must be mode 0600")
+	flag.StringVar(&flags.Commands, "commands", "", "Directory containing Smib's commands")
+	flag.StringVar(&flags.Listen, "listen", "", "Address to serve /metrics and /healthz on, disabled if empty")
+	flag.DurationVar(&maxDown, "health-max-down", time.Duration(flags.HealthMaxDown), "How long Smib may be disconnected from slack before /healthz fails")
+	flag.DurationVar(&grace, "shutdown-grace", time.Duration(flags.ShutdownGrace), "How long running commands may take to finish when Smib is stopped")
+	flag.BoolVar(&consoleMode, "console", false, "Talk to Smib in the terminal instead of slack, to try commands")
+	flag.StringVar(&consoleUser, "console-user", "console", "Name of the user you talk to Smib as with -console")
+	flag.StringVar(&consoleChannel, "console-channel", "general", "Name of the channel you talk to Smib in with -console")
 	flag.Parse()
 
-	client := slack.New(token)
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "token":
+			log.Print("Warning: -token is visible to every user on this machine, use -token-file or ", config.TokenEnv)
+			cfg.Token = flags.Token
+		case "token-file":
+			cfg.TokenFile = flags.TokenFile
+		case "transport":
+			cfg.Transport = flags.Transport
+		case "app-token-file":
+			cfg.AppTokenFile = flags.AppTokenFile
+		case "commands":
+			cfg.Commands = flags.Commands
+		case "listen":
+			cfg.Listen = flags.Listen
+		case "health-max-down":
+			cfg.HealthMaxDown = config.Duration(maxDown)
+		case "shutdown-grace":
+			cfg.ShutdownGrace = config.Duration(grace)
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
+
+	var (
+		transport smib.Transport
+		terminal  *console.Console
+	)
+	if consoleMode {
+		terminal = console.New(os.Stdin, os.Stdout, consoleUser, consoleChannel)
+		transport = terminal
+	} else {
+		token, err := cfg.LoadToken()
+		if err != nil {
+			return err
+		}
+
+		client := slack.New(token)
+
+		transport = smib.RTM(client)
+		if cfg.Transport == config.TransportSocket {
+			appToken, err := cfg.LoadAppToken()
+			if err != nil {
+				return err
+			}
+			transport = socketmode.New(appToken, client)
+		}
+	}
+
+	cmd := command.New(cfg.Commands)
+
+	bot := smib.New(transport, cmd)
+	bot.ShutdownGrace = time.Duration(cfg.ShutdownGrace)
+	bot.Triggers = cfg.Triggers
+	bot.AllowedBots = cfg.AllowedBots
+	bot.EditWindow = time.Duration(cfg.Edits.Window)
+	bot.DeleteReplies = cfg.Edits.DeleteReplies
+	bot.Feedback = cfg.Feedback
+	if cfg.Transport == config.TransportSocket && !consoleMode {
+		log.Print("Socket mode can't show smib typing, the typing feedback style falls back to reactions")
+		bot.Feedback = cfg.Feedback.WithoutTyping()
+		bot.ListWorkspace = true
+	}
+	bot.Output = cfg.Output
+	bot.SendInterval = time.Duration(cfg.Output.SendInterval)
+	bot.SendBurst = cfg.Output.SendBurst
+	bot.Files = cfg.Files
+	bot.CallbackGrace = time.Duration(cfg.Callbacks.Grace)
+
+	if cfg.Store.Path != "" {
+		bot.Store, err = store.Open(cfg.Store.Path)
+		if err != nil {
+			return err
+		}
+		defer bot.Store.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// A listener which fails stops smib, its error is the one run returns
+	failed := make(chan error, 1)
+	serve := func(serve func() error) {
+		go func() {
+			err := serve()
+			select {
+			case failed <- err:
+			default:
+			}
+			stop()
+		}()
+	}
+
+	if cfg.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/healthz", bot.HealthHandler(time.Duration(cfg.HealthMaxDown)))
+		serve(func() error { return http.ListenAndServe(cfg.Listen, mux) })
+	}
+
+	if cfg.Callbacks.Listen != "" {
+		listener, err := net.Listen("tcp", cfg.Callbacks.Listen)
+		if err != nil {
+			return err
+		}
+		bot.CallbackURL = "http://" + listener.Addr().String()
+		mux := http.NewServeMux()
+		mux.Handle("/", bot.CallbackHandler())
+		if cfg.Store.BackupTokenFile != "" {
+			token, err := cfg.LoadBackupToken()
+			if err != nil {
+				return err
+			}
+			mux.Handle("/store/backup", bot.Store.BackupHandler(token))
+		}
+		serve(func() error { return http.Serve(listener, mux) })
+	}
 
-	cmd := command.New(commandDir)
+	if cfg.Slash.Listen != "" && !consoleMode {
+		secret, err := cfg.LoadSigningSecret()
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/slack/commands", bot.SlashCommandHandler(secret, cfg.Slash.InChannel))
+		serve(func() error { return http.ListenAndServe(cfg.Slash.Listen, mux) })
+	}
+	if terminal != nil {
+		// Stop when input ends, once running commands have finished
+		go func() {
+			<-terminal.Done()
+			stop()
+		}()
+	}
 
-	bot := smib.New(client, cmd)
 	log.Print("Starting SMIB")
-	log.Fatal(bot.ListenAndRobot())
+	if err := bot.ListenAndRobot(ctx); err != nil {
+		if errors.Is(err, smib.ErrInvalidAuth) {
+			return fmt.Errorf("slack rejected smib's token, check %s, -token-file or token_file: %s", config.TokenEnv, err)
+		}
+		return err
+	}
+	select {
+	case err := <-failed:
+		return err
+	default:
+		return nil
+	}
 }
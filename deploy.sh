@@ -8,9 +8,14 @@ set -x
 
 ssh -o StrictHostKeyChecking=no -p 6022 root@space.somakeit.org.uk service slacker-smib stop
 scp -o StrictHostKeyChecking=no -P 6022 smib root@space.somakeit.org.uk:/usr/local/bin
-cp init-script slacker-smib
+ssh -o StrictHostKeyChecking=no -p 6022 root@space.somakeit.org.uk install -d -m 755 /etc/slacker-smib
+# Only install the example config the first time, config.yaml is edited on the server
+scp -o StrictHostKeyChecking=no -P 6022 smib.example.yaml root@space.somakeit.org.uk:/etc/slacker-smib/config.example.yaml
+ssh -o StrictHostKeyChecking=no -p 6022 root@space.somakeit.org.uk \
+    "test -e /etc/slacker-smib/config.yaml || cp /etc/slacker-smib/config.example.yaml /etc/slacker-smib/config.yaml"
 set +x
-sed -i "s/<TOKEN>/$SLACK_TOKEN/" slacker-smib
+echo "$SLACK_TOKEN" | ssh -o StrictHostKeyChecking=no -p 6022 root@space.somakeit.org.uk \
+    "umask 077 && cat > /etc/slacker-smib/token && chown smib /etc/slacker-smib/token"
 set -x
-scp -o StrictHostKeyChecking=no -P 6022 slacker-smib root@space.somakeit.org.uk:/etc/init.d
+scp -o StrictHostKeyChecking=no -P 6022 init-script root@space.somakeit.org.uk:/etc/init.d/slacker-smib
 ssh -o StrictHostKeyChecking=no -p 6022 root@space.somakeit.org.uk service slacker-smib start
\ No newline at end of file
@@ -0,0 +1,115 @@
+package command
+
+import (
+	"errors"
+	"strings"
+)
+
+// ArgvEnv is the environment variable holding a command's args as a JSON array, for commands
+// with Argv set in their manifest.
+const ArgvEnv = "SMIB_ARGV"
+
+// Errors returned by SplitArgs
+var (
+	ErrUnbalancedQuote = errors.New("a quote was never closed")
+	ErrTrailingEscape  = errors.New("the args end with a \\")
+)
+
+// smartQuotes maps the quotes mobile keyboards substitute to their plain equivalents
+var smartQuotes = map[rune]rune{
+	'‘': '\'', '’': '\'', '‚': '\'', '‛': '\'',
+	'“': '"', '”': '"', '„': '"', '‟': '"',
+}
+
+// plainQuote returns r with smart quotes replaced by plain ones
+func plainQuote(r rune) rune {
+	if plain, ok := smartQuotes[r]; ok {
+		return plain
+	}
+	return r
+}
+
+// SplitArgs splits args into words like a shell would. Words are separated by whitespace, which
+// can be included in a word by quoting it with single or double quotes or escaping it with \.
+// Within double quotes \ only escapes " and \. Smart quotes are treated as plain quotes.
+func SplitArgs(args string) ([]string, error) {
+	words, _, err := splitArgs(args, true)
+	return words, err
+}
+
+// splitArgs splits args into words, also returning the offset in args at which each word starts.
+// If strict is false the args are free text rather than written for a shell: a quote only
+// starts quoting at the start of a word and if it is closed later, otherwise it is part of the
+// word as in "don't", and \ is an ordinary character. Only strict splitting returns errors.
+func splitArgs(args string, strict bool) ([]string, []int, error) {
+	var (
+		words   []string
+		starts  []int
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	startWord := func(i int) {
+		if !inWord {
+			starts = append(starts, i)
+			inWord = true
+		}
+	}
+	for i, typed := range args {
+		// Strict splitting also replaces smart quotes within words, free text is left as typed
+		r := plainQuote(typed)
+		if strict {
+			typed = r
+		}
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'' && strict:
+			escaped = true
+			startWord(i)
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(typed)
+			}
+		case (r == '\'' || r == '"') && (strict || !inWord && closed(args[i+1:], r)):
+			quote = r
+			startWord(i)
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(typed)
+			startWord(i)
+		}
+	}
+	switch {
+	case quote != 0:
+		return nil, nil, ErrUnbalancedQuote
+	case escaped:
+		return nil, nil, ErrTrailingEscape
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, starts, nil
+}
+
+// closed reports whether rest contains quote, plain or smart, to close a quote
+func closed(rest string, quote rune) bool {
+	for _, r := range rest {
+		if plainQuote(r) == quote {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    string
+		want    []string
+		wantErr error
+	}{
+		{name: "empty", args: "", want: nil},
+		{name: "spaces", args: "   ", want: nil},
+		{name: "words", args: "open the  door", want: []string{"open", "the", "door"}},
+		{name: "tabs and newlines", args: "open\tthe\ndoor", want: []string{"open", "the", "door"}},
+		{name: "double quotes", args: `say "hello world"`, want: []string{"say", "hello world"}},
+		{name: "single quotes", args: `say 'hello world'`, want: []string{"say", "hello world"}},
+		{name: "quotes within a word", args: `front" door"s`, want: []string{"front doors"}},
+		{name: "empty quotes", args: `say "" ''`, want: []string{"say", "", ""}},
+		{name: "nested quotes", args: `"it's" '"quoted"'`, want: []string{"it's", `"quoted"`}},
+		{name: "escaped space", args: `front\ door`, want: []string{"front door"}},
+		{name: "escaped quote", args: `\"door\"`, want: []string{`"door"`}},
+		{name: "escapes in double quotes", args: `"a \"b\" \\ \n"`, want: []string{`a "b" \ \n`}},
+		{name: "no escapes in single quotes", args: `'a \ b'`, want: []string{`a \ b`}},
+		{name: "smart double quotes", args: "say “hello world”", want: []string{"say", "hello world"}},
+		{name: "smart single quotes", args: "say ‘hello world’", want: []string{"say", "hello world"}},
+		{name: "unicode", args: "café ☕", want: []string{"café", "☕"}},
+		{name: "unbalanced double quote", args: `say "hello`, wantErr: ErrUnbalancedQuote},
+		{name: "unbalanced single quote", args: `it's`, wantErr: ErrUnbalancedQuote},
+		{name: "trailing escape", args: `door\`, wantErr: ErrTrailingEscape},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SplitArgs(tt.args)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
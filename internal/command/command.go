@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,8 +10,76 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/somakeit/slacker-smib/internal/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+// ChannelTypeEnv is the environment variable which tells a command what kind of conversation it
+// was run in.
+const ChannelTypeEnv = "SMIB_CHANNEL_TYPE"
+
+// RawArgsEnv is the environment variable holding a command's args exactly as slack sent them,
+// before they were decoded.
+const RawArgsEnv = "SMIB_RAW_ARGS"
+
+// TempDirEnv is the environment variable holding a directory the command may write files to, which
+// is removed after it exits.
+const TempDirEnv = "SMIB_TEMP_DIR"
+
+// FilesEnv is the environment variable describing files shared with a command, as a JSON array of
+// objects with the path, name and mimetype of each file. It is only set if files were shared.
+const FilesEnv = "SMIB_FILES"
+
+// secretEnvPrefix starts the environment variables SMIB's slack credentials are read from, which
+// are removed from commands' environments.
+const secretEnvPrefix = "SMIB_SLACK_"
+
+// CallbackURLEnv and CallbackTokenEnv are the environment variables holding the URL of SMIB's
+// callback API and the token the command authenticates to it with.
+const (
+	CallbackURLEnv   = "SMIB_API_URL"
+	CallbackTokenEnv = "SMIB_API_TOKEN"
+)
+
+// The kinds of conversation a command can be run in
+const (
+	ChannelPublic  = "public_channel"
+	ChannelPrivate = "private_channel"
+	ChannelIM      = "im"
+	ChannelMPIM    = "mpim"
 )
 
+// manifestExt is the extension of command manifests, files with it are never run as commands
+const manifestExt = ".yaml"
+
+// Manifest describes how SMIB should treat a command's output. It is read from a YAML file named
+// after the command, such as door.yaml for door.sh.
+type Manifest struct {
+	// Private sends all the command's output only to the user who ran it
+	Private bool `yaml:"private"`
+	// IRCFormatting converts IRC formatting codes and /me actions in the output to mrkdwn
+	IRCFormatting bool `yaml:"irc_formatting"`
+	// DecodeArgs passes args as the user typed them rather than as slack sent them, with
+	// entities unescaped, links replaced by their URL and mentions by names
+	DecodeArgs bool `yaml:"decode_args"`
+	// Argv splits args into words with shell-like quoting and passes them after the legacy
+	// arguments, and as a JSON array in $SMIB_ARGV
+	Argv bool `yaml:"argv"`
+	// Params declares the command's args, which are checked before it is run and passed in
+	// $SMIB_ARG_<NAME>
+	Params []Param `yaml:"params"`
+}
+
+// Extra is passed to a command as well as its legacy arguments
+type Extra struct {
+	// Env holds extra environment variables, in the form KEY=value
+	Env []string
+	// Args are passed after the legacy arguments
+	Args []string
+}
+
 // Command runs commands for SMIB
 type Command struct {
 	commandDir string
@@ -24,23 +93,31 @@ func New(commandDir string) *Command {
 	return &c
 }
 
-// Run takes a command and if it exists in the command diractory and is valid, runs it and
-// streams the output. The caller must close the output ReadCloser if err was nil.
-// User is the slack syntax for mentioning the user, userDisplay is the user's short display name.
-func (c *Command) Run(command, user, userDisplay, channel, args string) (io.ReadCloser, error) {
+// Resolve returns the name of the command which would be run for command, which may be a unique
+// prefix of the command's name.
+func (c *Command) Resolve(command string) (string, error) {
+	file, err := c.find(command)
+	if err != nil {
+		return "", err
+	}
+	return commandName(file), nil
+}
+
+// find returns the file in the command directory which matches command
+func (c *Command) find(command string) (string, error) {
 	files, err := ioutil.ReadDir(c.commandDir)
 	if err != nil {
-		return nil, fmt.Errorf("error listing command directory '%s': %s", c.commandDir, err)
+		return "", fmt.Errorf("error listing command directory '%s': %s", c.commandDir, err)
 	}
 
 	commands := []string{}
 	var file os.FileInfo
 	for _, file = range files {
-		if file.IsDir() {
+		if file.IsDir() || filepath.Ext(file.Name()) == manifestExt {
 			continue
 		}
 
-		fileCmd := strings.SplitN(file.Name(), ".", 2)[0]
+		fileCmd := commandName(file.Name())
 
 		if fileCmd == command {
 			commands = []string{file.Name()}
@@ -52,53 +129,123 @@ func (c *Command) Run(command, user, userDisplay, channel, args string) (io.Read
 		}
 	}
 	if len(commands) == 0 {
-		return nil, NotFoundError(fmt.Sprintf("command '%s' not found", command))
+		return "", NotFoundError(fmt.Sprintf("command '%s' not found", command))
 	}
 	if len(commands) > 1 {
-		return nil, NotUniqueError{
+		return "", NotUniqueError{
 			text:     fmt.Sprintf("command '%s' was not unique", command),
 			Commands: commands,
 		}
 	}
+	return commands[0], nil
+}
+
+// Manifest returns the manifest of command, which may be a unique prefix of the command's name. A
+// command without a manifest file has the zero Manifest.
+func (c *Command) Manifest(command string) (Manifest, error) {
+	var manifest Manifest
+	file, err := c.find(command)
+	if err != nil {
+		return manifest, err
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(c.commandDir, commandName(file)+manifestExt))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read manifest for '%s': %s", file, err)
+	}
+	if err := yaml.UnmarshalStrict(raw, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to parse manifest for '%s': %s", file, err)
+	}
+	if err := validateParams(manifest.Params); err != nil {
+		return Manifest{}, fmt.Errorf("invalid params in manifest for '%s': %s", file, err)
+	}
+	return manifest, nil
+}
+
+// Run takes a command and if it exists in the command diractory and is valid, runs it and
+// streams the output. The caller must close the output ReadCloser if err was nil, Close returns
+// the command's exit error.
+// User is the slack syntax for mentioning the user, userDisplay is the user's short display name.
+// ChannelType is one of the ChannelType constants, it is passed to the command in $SMIB_CHANNEL_TYPE.
+// Extra.Env is added to the command's environment and Extra.Args are passed after the legacy
+// arguments.
+// If ctx is done before the command exits, the command and any children it started are killed.
+func (c *Command) Run(ctx context.Context, command, user, userDisplay, channel, channelType, args string, extra Extra) (io.ReadCloser, error) {
+	file, err := c.find(command)
+	switch err.(type) {
+	case nil:
+	case NotFoundError:
+		metrics.CommandsRun.WithLabelValues("", metrics.OutcomeNotFound).Inc()
+		return nil, err
+	case NotUniqueError:
+		metrics.CommandsRun.WithLabelValues("", metrics.OutcomeNotUnique).Inc()
+		return nil, err
+	default:
+		return nil, err
+	}
+	name := commandName(file)
 
 	sender := channel
 	if sender == "null" {
 		sender = user
 	}
 
-	log.Print(fmt.Sprintf("Command '%s' run in '%s' by '%s' with args '%s'", commands[0], channel, userDisplay, args))
-	cmd := exec.Command(
-		filepath.Join(c.commandDir, commands[0]),
+	log.Print(fmt.Sprintf("Command '%s' run in '%s' by '%s' with args '%s'", file, channel, userDisplay, args))
+	argv := append([]string{
 		user,
 		channel,
 		sender,
 		args,
 		command,
 		userDisplay,
-	)
+	}, extra.Args...)
+	cmd := exec.Command(filepath.Join(c.commandDir, file), argv...)
 	cmd.Dir = c.commandDir
+	cmd.Env = append(environ(), ChannelTypeEnv+"="+channelType)
+	cmd.Env = append(cmd.Env, extra.Env...)
+	setProcessGroup(cmd)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
+		metrics.CommandsRun.WithLabelValues(name, metrics.OutcomeError).Inc()
 		return nil, err
 	}
 	cmd.Stderr = os.Stderr
 
+	start := time.Now()
 	err = cmd.Start()
 	if err != nil {
-		return nil, fmt.Errorf("failed to start command '%s': %s", commands[0], err)
+		metrics.CommandsRun.WithLabelValues(name, metrics.OutcomeError).Inc()
+		return nil, fmt.Errorf("failed to start command '%s': %s", file, err)
 	}
 
 	done := make(chan struct{})
+	result := make(chan error, 1)
 	go func() {
-		<-done
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Print(fmt.Sprintf("Killing command %s: %s", file, ctx.Err()))
+			if err := killProcessGroup(cmd.Process); err != nil {
+				log.Print(fmt.Sprintf("Failed to kill command %s: %s", file, err))
+			}
+			<-done
+		}
 		err := cmd.Wait()
+		result <- err
+		metrics.CommandDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
 		if err != nil {
-			log.Print(fmt.Sprintf("Command %s failed: %s", commands[0], err))
+			metrics.CommandsRun.WithLabelValues(name, metrics.OutcomeFailed).Inc()
+			log.Print(fmt.Sprintf("Command %s failed: %s", file, err))
+			return
 		}
+		metrics.CommandsRun.WithLabelValues(name, metrics.OutcomeOK).Inc()
 	}()
 
 	return output{
 		done:   done,
+		result: result,
 		reader: stdout,
 	}, nil
 }
@@ -107,15 +254,18 @@ func (c *Command) Run(command, user, userDisplay, channel, args string) (io.Read
 // has finished reading. cmd.Wait() will close the Srdout io.ReadCloser for us.
 type output struct {
 	done   chan struct{}
+	result chan error
 	reader io.Reader
 }
 
 func (o output) Read(b []byte) (int, error) {
 	return o.reader.Read(b)
 }
+
+// Close waits for the command to exit, returning an error if it failed or was killed
 func (o output) Close() error {
 	close(o.done)
-	return nil
+	return <-o.result
 }
 
 type NotFoundError string
@@ -133,7 +283,23 @@ func (n NotUniqueError) Error() string { return n.text }
 func (n NotUniqueError) GetCommands() string {
 	out := ""
 	for _, cmd := range n.Commands {
-		out = out + strings.SplitN(cmd, ".", 2)[0] + " "
+		out = out + commandName(cmd) + " "
 	}
 	return strings.TrimSuffix(out, " ")
 }
+
+// commandName strips the extension from a command's file name
+func commandName(file string) string {
+	return strings.SplitN(file, ".", 2)[0]
+}
+
+// environ returns SMIB's environment without its slack credentials, for running commands
+func environ() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, secretEnvPrefix) {
+			env = append(env, e)
+		}
+	}
+	return env
+}
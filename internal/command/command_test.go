@@ -1,11 +1,13 @@
 package command
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -34,9 +36,12 @@ func TestCommand_Run(t *testing.T) {
 		command           string
 		user, userDisplay string
 		channel           string
+		channelType       string
 		args              string
+		extra             Extra
 		want              []byte
 		wantErr           error
+		wantExitErr       bool
 	}{
 		{
 			name:        "invalid command dir",
@@ -45,6 +50,7 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			want:        []byte{},
 			wantErr:     errors.New("error listing command directory 'notadir':"),
 		},
@@ -55,6 +61,7 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			want:        []byte{},
 			wantErr:     NotFoundError("command 'notacmd' not found"),
 		},
@@ -65,6 +72,7 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			want:        []byte{},
 			wantErr: NotUniqueError{
 				text:     "command 'command' was not unique",
@@ -78,6 +86,7 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			want:        []byte("command one\n"),
 			wantErr:     nil,
 		},
@@ -88,6 +97,7 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			want:        []byte("command two\n"),
 			wantErr:     nil,
 		},
@@ -98,6 +108,7 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			want:        []byte("We all live in a yellow\n"),
 			wantErr:     nil,
 		},
@@ -108,6 +119,7 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			want:        []byte{},
 			wantErr:     fmt.Errorf("failed to start command 'README.md':"),
 		},
@@ -118,8 +130,10 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			want:        []byte("i bad\n"),
 			wantErr:     nil,
+			wantExitErr: true,
 		},
 		{
 			name:        "run a command with args",
@@ -128,8 +142,46 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "general",
+			channelType: ChannelPublic,
 			args:        "some args",
-			want:        []byte("<@Xbob>, User: [<@Xbob>] Channel: [general] Sender: [general] Args: [some args] Command: [debu] DisplayUser: [bob]\n"),
+			want:        []byte("<@Xbob>, User: [<@Xbob>] Channel: [general] Sender: [general] Args: [some args] Command: [debu] DisplayUser: [bob] ChannelType: [public_channel]\n"),
+			wantErr:     nil,
+		},
+		{
+			name:        "run a command from a private channel",
+			commandDir:  mustAbs("fixtures"),
+			command:     "debu",
+			user:        "<@Xbob>",
+			userDisplay: "bob",
+			channel:     "secret",
+			channelType: ChannelPrivate,
+			want:        []byte("<@Xbob>, User: [<@Xbob>] Channel: [secret] Sender: [secret] Args: [] Command: [debu] DisplayUser: [bob] ChannelType: [private_channel]\n"),
+			wantErr:     nil,
+		},
+		{
+			name:        "run a command with raw args",
+			commandDir:  mustAbs("fixtures"),
+			command:     "rawargs",
+			user:        "<@Xbob>",
+			userDisplay: "bob",
+			channel:     "general",
+			channelType: ChannelPublic,
+			args:        "@egon & ray",
+			extra:       Extra{Env: []string{RawArgsEnv + "=<@U024BE7LH> &amp; ray"}},
+			want:        []byte("Args: [@egon & ray] Raw: [<@U024BE7LH> &amp; ray]\n"),
+			wantErr:     nil,
+		},
+		{
+			name:        "run a command with argv",
+			commandDir:  mustAbs("fixtures"),
+			command:     "argv",
+			user:        "<@Xbob>",
+			userDisplay: "bob",
+			channel:     "general",
+			channelType: ChannelPublic,
+			args:        `open "front door"`,
+			extra:       Extra{Env: []string{ArgvEnv + `=["open","front door"]`}, Args: []string{"open", "front door"}},
+			want:        []byte(`[open][front door] JSON: ["open","front door"]` + "\n"),
 			wantErr:     nil,
 		},
 		{
@@ -139,8 +191,9 @@ func TestCommand_Run(t *testing.T) {
 			user:        "<@Xbob>",
 			userDisplay: "bob",
 			channel:     "null",
+			channelType: ChannelIM,
 			args:        "some args",
-			want:        []byte("<@Xbob>, User: [<@Xbob>] Channel: [null] Sender: [<@Xbob>] Args: [some args] Command: [debu] DisplayUser: [bob]\n"),
+			want:        []byte("<@Xbob>, User: [<@Xbob>] Channel: [null] Sender: [<@Xbob>] Args: [some args] Command: [debu] DisplayUser: [bob] ChannelType: [im]\n"),
 			wantErr:     nil,
 		},
 	}
@@ -151,7 +204,7 @@ func TestCommand_Run(t *testing.T) {
 				commandDir: tt.commandDir,
 			}
 
-			r, outErr := c.Run(tt.command, tt.user, tt.userDisplay, tt.channel, tt.args)
+			r, outErr := c.Run(context.Background(), tt.command, tt.user, tt.userDisplay, tt.channel, tt.channelType, tt.args, tt.extra)
 
 			switch wantErr := tt.wantErr.(type) {
 			case nil:
@@ -174,13 +227,31 @@ func TestCommand_Run(t *testing.T) {
 				require.NoError(t, err)
 			}
 			if outErr == nil {
-				r.Close()
+				assert.Equal(t, tt.wantExitErr, r.Close() != nil)
 			}
 			assert.Equal(t, tt.want, output)
 		})
 	}
 }
 
+func TestCommand_Run_cancelled(t *testing.T) {
+	c := Command{
+		commandDir: mustAbs("fixtures"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	r, err := c.Run(ctx, "sleep", "<@Xbob>", "bob", "general", ChannelPublic, "", Extra{})
+	require.NoError(t, err)
+	output, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Error(t, r.Close(), "killed commands fail")
+
+	assert.Equal(t, []byte("zzz\n"), output)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "command should have been killed")
+}
+
 func TestNotUniqueError_GetCommands(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -215,3 +286,130 @@ func TestNotUniqueError_GetCommands(t *testing.T) {
 		})
 	}
 }
+
+func TestCommand_Resolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "exact",
+			command: "sub",
+			want:    "sub",
+		},
+		{
+			name:    "unique prefix",
+			command: "subm",
+			want:    "submarine",
+		},
+		{
+			name:    "manifests are not commands",
+			command: "secret",
+			want:    "secret",
+		},
+		{
+			name:    "not found",
+			command: "notacmd",
+			wantErr: NotFoundError("command 'notacmd' not found"),
+		},
+		{
+			name:    "not unique",
+			command: "command",
+			wantErr: NotUniqueError{
+				text:     "command 'command' was not unique",
+				Commands: []string{"commandone.sh", "commandtwo.sh"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(mustAbs("fixtures"))
+			got, err := c.Resolve(tt.command)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCommand_Manifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    Manifest
+		wantErr string
+	}{
+		{
+			name:    "no manifest",
+			command: "commandone",
+		},
+		{
+			name:    "private",
+			command: "secr",
+			want:    Manifest{Private: true},
+		},
+		{
+			name:    "irc formatting",
+			command: "legacy",
+			want:    Manifest{IRCFormatting: true},
+		},
+		{
+			name:    "params",
+			command: "timer",
+			want: Manifest{Params: []Param{
+				{Name: "who", Type: ParamUser, Required: true},
+				{Name: "minutes", Type: ParamDuration, Default: "5m"},
+			}},
+		},
+		{
+			name:    "invalid params",
+			command: "badparams",
+			wantErr: "invalid params in manifest for 'badparams.sh': param 'count' has unknown type 'number'",
+		},
+		{
+			name:    "invalid manifest",
+			command: "broken",
+			wantErr: "failed to parse manifest for 'broken.sh'",
+		},
+		{
+			name:    "not found",
+			command: "notacmd",
+			wantErr: "command 'notacmd' not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(mustAbs("fixtures"))
+			got, err := c.Manifest(tt.command)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCommand_Run_secrets(t *testing.T) {
+	t.Setenv("SMIB_SLACK_TOKEN", "xoxb-secret")
+	t.Setenv("SMIB_SLACK_APP_TOKEN", "xapp-secret")
+	t.Setenv("SMIB_SLACK_SIGNING_SECRET", "signing-secret")
+	t.Setenv("SMIB_TEST_VISIBLE", "visible")
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "env.sh"), []byte("#!/bin/sh\nenv\n"), 0755))
+
+	r, err := New(dir).Run(context.Background(), "env", "<@Xbob>", "bob", "general", ChannelPublic, "", Extra{})
+	require.NoError(t, err)
+	output, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	assert.Contains(t, string(output), "SMIB_TEST_VISIBLE=visible")
+	assert.NotContains(t, string(output), "xoxb-secret")
+	assert.NotContains(t, string(output), "xapp-secret")
+	assert.NotContains(t, string(output), "signing-secret")
+	assert.NotContains(t, string(output), "SMIB_SLACK_")
+}
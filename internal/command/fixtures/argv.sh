@@ -0,0 +1,4 @@
+#!/bin/sh
+shift 6
+printf '[%s]' "$@"
+echo " JSON: $SMIB_ARGV"
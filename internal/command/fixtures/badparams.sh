@@ -0,0 +1,2 @@
+#!/bin/sh
+echo "You can't run this"
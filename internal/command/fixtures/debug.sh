@@ -1,2 +1,2 @@
 #!/bin/sh
-echo "$1, User: [$1] Channel: [$2] Sender: [$3] Args: [$4] Command: [$5] DisplayUser: [$6]"
+echo "$1, User: [$1] Channel: [$2] Sender: [$3] Args: [$4] Command: [$5] DisplayUser: [$6] ChannelType: [$SMIB_CHANNEL_TYPE]"
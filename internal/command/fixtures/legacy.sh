@@ -0,0 +1,2 @@
+#!/bin/sh
+printf "\002legacy\002 \0034output\003\n"
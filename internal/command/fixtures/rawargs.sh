@@ -0,0 +1,2 @@
+#!/bin/sh
+echo "Args: [$4] Raw: [$SMIB_RAW_ARGS]"
@@ -0,0 +1,2 @@
+#!/bin/sh
+echo "your secret is safe"
@@ -0,0 +1,5 @@
+#!/bin/sh
+
+echo "zzz"
+sleep 10
+echo "awake"
@@ -0,0 +1,2 @@
+#!/bin/sh
+echo "Minutes: [$SMIB_ARG_MINUTES] Who: [$SMIB_ARG_WHO]"
@@ -0,0 +1,223 @@
+package command
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParamEnvPrefix starts the names of the environment variables params are passed in, the param
+// "minutes" is passed in $SMIB_ARG_MINUTES.
+const ParamEnvPrefix = "SMIB_ARG_"
+
+// The types of a Param
+const (
+	// ParamText is any word, or the rest of the args if it is the last param
+	ParamText = "text"
+	// ParamInt is a whole number
+	ParamInt = "int"
+	// ParamDuration is a length of time such as 90s or 1h30m, it is passed as whole seconds
+	ParamDuration = "duration"
+	// ParamUser is a user mention, it is passed as <@ID>
+	ParamUser = "user"
+	// ParamChannel is a channel link, it is passed as <#ID>
+	ParamChannel = "channel"
+	// ParamEnum is one of Values
+	ParamEnum = "enum"
+)
+
+var (
+	paramName      = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	userMention    = regexp.MustCompile(`^<@([UW][A-Z0-9]+)(\|[^>]*)?>$`)
+	channelMention = regexp.MustCompile(`^<#(C[A-Z0-9]+|G[A-Z0-9]+)(\|[^>]*)?>$`)
+)
+
+// Param is a positional argument declared in a command's manifest
+type Param struct {
+	Name string `yaml:"name"`
+	// Type is one of the Param constants, text if unset
+	Type     string `yaml:"type"`
+	Required bool   `yaml:"required"`
+	// Default is used when an optional param isn't given
+	Default string `yaml:"default"`
+	// Values are the allowed values of an enum
+	Values []string `yaml:"values"`
+}
+
+// UsageError is returned when args don't match a command's params
+type UsageError string
+
+func (u UsageError) Error() string {
+	return string(u)
+}
+
+// Env returns the environment variable p is passed in
+func (p Param) Env() string {
+	return ParamEnvPrefix + strings.ToUpper(p.Name)
+}
+
+// isText reports whether p takes any text
+func (p Param) isText() bool {
+	return p.Type == "" || p.Type == ParamText
+}
+
+// normalise checks value is valid for p and returns it in the form it is passed to the command
+func (p Param) normalise(value string) (string, error) {
+	switch p.Type {
+	case ParamInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", UsageError(fmt.Sprintf("%s must be a whole number", p.Name))
+		}
+		return strconv.Itoa(n), nil
+	case ParamDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return "", UsageError(fmt.Sprintf("%s must be a length of time like 90s or 1h30m", p.Name))
+		}
+		return strconv.Itoa(int(d / time.Second)), nil
+	case ParamUser:
+		match := userMention.FindStringSubmatch(value)
+		if match == nil {
+			return "", UsageError(fmt.Sprintf("%s must be an @mention of a user", p.Name))
+		}
+		return "<@" + match[1] + ">", nil
+	case ParamChannel:
+		match := channelMention.FindStringSubmatch(value)
+		if match == nil {
+			return "", UsageError(fmt.Sprintf("%s must be a #channel", p.Name))
+		}
+		return "<#" + match[1] + ">", nil
+	case ParamEnum:
+		for _, v := range p.Values {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+		return "", UsageError(fmt.Sprintf("%s must be one of %s", p.Name, strings.Join(p.Values, ", ")))
+	}
+	return value, nil
+}
+
+// usage describes p for a usage line, <name> if it is required or [name] if it isn't
+func (p Param) usage() string {
+	desc := p.Name
+	switch {
+	case p.isText():
+	case p.Type == ParamEnum:
+		desc += ":" + strings.Join(p.Values, "|")
+	default:
+		desc += ":" + p.Type
+	}
+	if p.Required {
+		return "<" + desc + ">"
+	}
+	return "[" + desc + "]"
+}
+
+// validateParams checks params are declared correctly and fills in their default type
+func validateParams(params []Param) error {
+	seen := map[string]bool{}
+	optional := ""
+	for i := range params {
+		p := &params[i]
+		if !paramName.MatchString(p.Name) {
+			return fmt.Errorf("param name '%s' must be letters, numbers and _", p.Name)
+		}
+		if seen[strings.ToUpper(p.Name)] {
+			return fmt.Errorf("param '%s' is declared twice", p.Name)
+		}
+		seen[strings.ToUpper(p.Name)] = true
+
+		switch p.Type {
+		case "":
+			p.Type = ParamText
+		case ParamText, ParamInt, ParamDuration, ParamUser, ParamChannel:
+		case ParamEnum:
+			if len(p.Values) == 0 {
+				return fmt.Errorf("enum param '%s' has no values", p.Name)
+			}
+		default:
+			return fmt.Errorf("param '%s' has unknown type '%s'", p.Name, p.Type)
+		}
+		if p.Type != ParamEnum && len(p.Values) > 0 {
+			return fmt.Errorf("param '%s' has values but isn't an enum", p.Name)
+		}
+
+		if p.Required {
+			if p.Default != "" {
+				return fmt.Errorf("required param '%s' can't have a default", p.Name)
+			}
+			if optional != "" {
+				return fmt.Errorf("required param '%s' follows optional param '%s'", p.Name, optional)
+			}
+			continue
+		}
+		optional = p.Name
+		if p.Default != "" {
+			if _, err := p.normalise(p.Default); err != nil {
+				return fmt.Errorf("param '%s' has an invalid default: %s", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Usage returns a usage line for command, such as: door <action:open|close> [minutes:int]
+func (m Manifest) Usage(command string) string {
+	usage := []string{command}
+	for _, p := range m.Params {
+		usage = append(usage, p.usage())
+	}
+	return strings.Join(usage, " ")
+}
+
+// ParseParams splits args into words, checks them against the manifest's params and returns the
+// environment to pass them to the command in, with each value normalised. Args are split like
+// SplitArgs if the manifest sets Argv, otherwise they are free text in which an unclosed quote,
+// as in "don't", is just part of a word. Optional params which weren't given get their default,
+// or are empty. If the last param is text it gets the rest of the args as they were typed, unless
+// that is a single quoted word. Args are checked as slack sent them, so users and channels can
+// be recognised, and text and enum values are then passed through decode if it isn't nil. A
+// UsageError is returned if the args don't match the params, or another error if they can't be
+// split.
+func (m Manifest) ParseParams(args string, decode func(string) string) ([]string, error) {
+	words, starts, err := splitArgs(args, m.Argv)
+	if err != nil {
+		return nil, err
+	}
+	env := make([]string, 0, len(m.Params))
+	for i, p := range m.Params {
+		if i >= len(words) {
+			if p.Required {
+				return nil, UsageError(fmt.Sprintf("%s is missing", p.Name))
+			}
+			value := p.Default
+			if value != "" {
+				// Defaults are validated when the manifest is read
+				value, _ = p.normalise(value)
+			}
+			env = append(env, p.Env()+"="+value)
+			continue
+		}
+
+		word := words[i]
+		if i == len(m.Params)-1 && p.isText() && i < len(words)-1 {
+			word = args[starts[i]:]
+		}
+		if decode != nil && (p.isText() || p.Type == ParamEnum) {
+			word = decode(word)
+		}
+		value, err := p.normalise(word)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, p.Env()+"="+value)
+	}
+	if len(words) > len(m.Params) && (len(m.Params) == 0 || !m.Params[len(m.Params)-1].isText()) {
+		return nil, UsageError("there are too many args")
+	}
+	return env, nil
+}
@@ -0,0 +1,248 @@
+package command
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  []Param
+		want    []Param
+		wantErr string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:   "text by default",
+			params: []Param{{Name: "message"}},
+			want:   []Param{{Name: "message", Type: ParamText}},
+		},
+		{
+			name: "valid",
+			params: []Param{
+				{Name: "action", Type: ParamEnum, Required: true, Values: []string{"open", "close"}},
+				{Name: "for_mins", Type: ParamInt, Default: "10"},
+			},
+			want: []Param{
+				{Name: "action", Type: ParamEnum, Required: true, Values: []string{"open", "close"}},
+				{Name: "for_mins", Type: ParamInt, Default: "10"},
+			},
+		},
+		{
+			name:    "bad name",
+			params:  []Param{{Name: "two words"}},
+			wantErr: "param name 'two words' must be letters, numbers and _",
+		},
+		{
+			name:    "no name",
+			params:  []Param{{Type: ParamInt}},
+			wantErr: "param name '' must be letters, numbers and _",
+		},
+		{
+			name:    "duplicate",
+			params:  []Param{{Name: "who"}, {Name: "WHO"}},
+			wantErr: "param 'WHO' is declared twice",
+		},
+		{
+			name:    "unknown type",
+			params:  []Param{{Name: "n", Type: "float"}},
+			wantErr: "param 'n' has unknown type 'float'",
+		},
+		{
+			name:    "enum without values",
+			params:  []Param{{Name: "action", Type: ParamEnum}},
+			wantErr: "enum param 'action' has no values",
+		},
+		{
+			name:    "values without enum",
+			params:  []Param{{Name: "action", Values: []string{"open"}}},
+			wantErr: "param 'action' has values but isn't an enum",
+		},
+		{
+			name:    "required default",
+			params:  []Param{{Name: "n", Type: ParamInt, Required: true, Default: "1"}},
+			wantErr: "required param 'n' can't have a default",
+		},
+		{
+			name:    "required after optional",
+			params:  []Param{{Name: "a"}, {Name: "b", Required: true}},
+			wantErr: "required param 'b' follows optional param 'a'",
+		},
+		{
+			name:    "invalid default",
+			params:  []Param{{Name: "n", Type: ParamInt, Default: "lots"}},
+			wantErr: "param 'n' has an invalid default: n must be a whole number",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateParams(tt.params)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tt.params)
+		})
+	}
+}
+
+func TestManifest_Usage(t *testing.T) {
+	manifest := Manifest{Params: []Param{
+		{Name: "action", Type: ParamEnum, Required: true, Values: []string{"open", "close"}},
+		{Name: "who", Type: ParamUser, Required: true},
+		{Name: "minutes", Type: ParamInt},
+		{Name: "reason", Type: ParamText},
+	}}
+	assert.Equal(t, "door <action:open|close> <who:user> [minutes:int] [reason]", manifest.Usage("door"))
+	assert.Equal(t, "door", Manifest{}.Usage("door"))
+}
+
+func TestManifest_ParseParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  []Param
+		argv    bool
+		args    string
+		decode  func(string) string
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "no params",
+			want: []string{},
+		},
+		{
+			name:    "no params with args",
+			args:    "hello",
+			wantErr: UsageError("there are too many args"),
+		},
+		{
+			name:   "int",
+			params: []Param{{Name: "n", Type: ParamInt}},
+			args:   "+042",
+			want:   []string{"SMIB_ARG_N=42"},
+		},
+		{
+			name:    "not an int",
+			params:  []Param{{Name: "n", Type: ParamInt}},
+			args:    "4.2",
+			wantErr: UsageError("n must be a whole number"),
+		},
+		{
+			name:   "duration",
+			params: []Param{{Name: "for", Type: ParamDuration}},
+			args:   "1h30m",
+			want:   []string{"SMIB_ARG_FOR=5400"},
+		},
+		{
+			name:    "negative duration",
+			params:  []Param{{Name: "for", Type: ParamDuration}},
+			args:    "-5m",
+			wantErr: UsageError("for must be a length of time like 90s or 1h30m"),
+		},
+		{
+			name:   "user",
+			params: []Param{{Name: "who", Type: ParamUser}},
+			args:   "<@U024BE7LH|spengler>",
+			want:   []string{"SMIB_ARG_WHO=<@U024BE7LH>"},
+		},
+		{
+			name:    "not a user",
+			params:  []Param{{Name: "who", Type: ParamUser}},
+			args:    "@spengler",
+			wantErr: UsageError("who must be an @mention of a user"),
+		},
+		{
+			name:   "channel",
+			params: []Param{{Name: "where", Type: ParamChannel}},
+			args:   "<#C024BE7LR|general>",
+			want:   []string{"SMIB_ARG_WHERE=<#C024BE7LR>"},
+		},
+		{
+			name:    "not a channel",
+			params:  []Param{{Name: "where", Type: ParamChannel}},
+			args:    "<@U024BE7LH>",
+			wantErr: UsageError("where must be a #channel"),
+		},
+		{
+			name:   "enum",
+			params: []Param{{Name: "action", Type: ParamEnum, Values: []string{"open", "close"}}},
+			args:   "OPEN",
+			want:   []string{"SMIB_ARG_ACTION=open"},
+		},
+		{
+			name:    "not in enum",
+			params:  []Param{{Name: "action", Type: ParamEnum, Values: []string{"open", "close"}}},
+			args:    "lock",
+			wantErr: UsageError("action must be one of open, close"),
+		},
+		{
+			name:   "last text gets the rest",
+			params: []Param{{Name: "who", Type: ParamUser}, {Name: "message", Type: ParamText}},
+			args:   "<@U024BE7LH> the  door \"is open\"",
+			want:   []string{"SMIB_ARG_WHO=<@U024BE7LH>", "SMIB_ARG_MESSAGE=the  door \"is open\""},
+		},
+		{
+			name:   "last text quoted",
+			params: []Param{{Name: "who", Type: ParamUser}, {Name: "message", Type: ParamText}},
+			args:   `<@U024BE7LH> "the door is open"`,
+			want:   []string{"SMIB_ARG_WHO=<@U024BE7LH>", "SMIB_ARG_MESSAGE=the door is open"},
+		},
+		{
+			name:   "apostrophes in free text",
+			params: []Param{{Name: "who", Type: ParamUser}, {Name: "what", Type: ParamEnum, Values: []string{"don't", "do"}}, {Name: "message", Type: ParamText}},
+			args:   "<@U024BE7LH> don't forget it’s bin day",
+			want:   []string{"SMIB_ARG_WHO=<@U024BE7LH>", "SMIB_ARG_WHAT=don't", "SMIB_ARG_MESSAGE=forget it’s bin day"},
+		},
+		{
+			name:   "quoted words in free text",
+			params: []Param{{Name: "where", Type: ParamText}, {Name: "n", Type: ParamInt}},
+			args:   `'front door' 2`,
+			want:   []string{"SMIB_ARG_WHERE=front door", "SMIB_ARG_N=2"},
+		},
+		{
+			name:    "unclosed quote with argv",
+			argv:    true,
+			params:  []Param{{Name: "message", Type: ParamText}},
+			args:    "don't",
+			wantErr: ErrUnbalancedQuote,
+		},
+		{
+			name:    "too many",
+			params:  []Param{{Name: "message", Type: ParamText}, {Name: "n", Type: ParamInt}},
+			args:    "hello 1 2",
+			wantErr: UsageError("there are too many args"),
+		},
+		{
+			name:    "missing",
+			params:  []Param{{Name: "who", Type: ParamUser, Required: true}},
+			wantErr: UsageError("who is missing"),
+		},
+		{
+			name:   "defaults",
+			params: []Param{{Name: "for", Type: ParamDuration, Default: "2m"}, {Name: "reason"}},
+			want:   []string{"SMIB_ARG_FOR=120", "SMIB_ARG_REASON="},
+		},
+		{
+			name:   "decoded",
+			params: []Param{{Name: "who", Type: ParamUser}, {Name: "action", Type: ParamEnum, Values: []string{"OPEN"}}, {Name: "message"}},
+			args:   "<@U024BE7LH> open fish  &amp; chips",
+			decode: strings.ToUpper,
+			want:   []string{"SMIB_ARG_WHO=<@U024BE7LH>", "SMIB_ARG_ACTION=OPEN", "SMIB_ARG_MESSAGE=FISH  &AMP; CHIPS"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Manifest{Params: tt.params, Argv: tt.argv}.ParseParams(tt.args, tt.decode)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
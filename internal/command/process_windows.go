@@ -0,0 +1,14 @@
+package command
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills only the process on windows
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,388 @@
+// Package config loads SMIB's configuration file and slack token.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// TokenEnv is the environment variable the slack token is read from
+	TokenEnv = "SMIB_SLACK_TOKEN"
+	// AppTokenEnv is the environment variable the slack app-level token is read from
+	AppTokenEnv = "SMIB_SLACK_APP_TOKEN"
+	// SigningSecretEnv is the environment variable the slack signing secret is read from
+	SigningSecretEnv = "SMIB_SLACK_SIGNING_SECRET"
+)
+
+// Transports smib can connect to slack with
+const (
+	TransportRTM    = "rtm"
+	TransportSocket = "socket"
+)
+
+// Feedback styles, how smib shows a command is running
+const (
+	// FeedbackTyping shows smib typing until the command finishes
+	FeedbackTyping = "typing"
+	// FeedbackReactions reacts to the command with :hourglass: while it runs, then
+	// :white_check_mark: or :x:
+	FeedbackReactions = "reactions"
+	// FeedbackNone shows nothing
+	FeedbackNone = "none"
+)
+
+// Config holds every SMIB setting
+type Config struct {
+	// Commands is the directory containing smib's commands
+	Commands string `yaml:"commands"`
+	// TokenFile is a file containing the slack token, it must not be readable by group or other
+	TokenFile string `yaml:"token_file"`
+	// Transport is how smib connects to slack, "rtm" or "socket"
+	Transport string `yaml:"transport"`
+	// AppTokenFile is a file containing the app-level token used by socket mode, it must not be
+	// readable by group or other
+	AppTokenFile string `yaml:"app_token_file"`
+	// Listen is the address to serve /metrics and /healthz on, disabled if empty
+	Listen string `yaml:"listen"`
+	// HealthMaxDown is how long smib may be disconnected from slack before /healthz fails
+	HealthMaxDown Duration `yaml:"health_max_down"`
+	// ShutdownGrace is how long running commands may take to finish when smib is stopped
+	ShutdownGrace Duration `yaml:"shutdown_grace"`
+	// Triggers configures which messages are treated as commands
+	Triggers Triggers `yaml:"triggers"`
+	// AllowedBots lists the bot or user IDs of other bots which may run commands, all other bots
+	// are ignored
+	AllowedBots []string `yaml:"allowed_bots"`
+	// Slash configures slash commands
+	Slash Slash `yaml:"slash"`
+	// Edits configures what happens when a command is edited or deleted
+	Edits Edits `yaml:"edits"`
+	// Feedback configures how smib shows a command is running
+	Feedback Feedback `yaml:"feedback"`
+	// Output configures how command output is changed before it is sent
+	Output Output `yaml:"output"`
+	// Files configures files sent by commands
+	Files Files `yaml:"files"`
+	// Callbacks configures the API commands can use to act on slack while they run and after
+	Callbacks Callbacks `yaml:"callbacks"`
+	// Store configures the key-value store commands can use through the callback API
+	Store Store `yaml:"store"`
+
+	// Token is only set from the command line, it is deliberately not loadable from the config file
+	Token string `yaml:"-"`
+}
+
+// Triggers configures which messages are treated as commands
+type Triggers struct {
+	// Prefixes start a command, such as "?" in "?door". Full-width forms typed by mobile keyboards
+	// also match.
+	Prefixes []string `yaml:"prefixes"`
+	// Mention treats messages starting with a mention of smib, such as "@smib door", as commands
+	Mention bool `yaml:"mention"`
+	// DMWithoutPrefix treats every direct message to smib as a command, with or without a prefix
+	DMWithoutPrefix bool `yaml:"dm_without_prefix"`
+}
+
+// Slash configures slash commands, which slack sends over HTTP
+type Slash struct {
+	// Listen is the address to receive slash commands on, disabled if empty
+	Listen string `yaml:"listen"`
+	// SigningSecretFile is a file containing the app's signing secret, it must not be readable by
+	// group or other
+	SigningSecretFile string `yaml:"signing_secret_file"`
+	// InChannel lists commands whose output is shown to the whole channel, other commands only
+	// reply to the invoking user
+	InChannel []string `yaml:"in_channel"`
+}
+
+// Edits configures what happens when a command is edited or deleted
+type Edits struct {
+	// Window is how long after a command is sent that editing it reruns the command, replacing
+	// smib's previous replies, edits are ignored if it is 0
+	Window Duration `yaml:"window"`
+	// DeleteReplies deletes smib's replies when the command is deleted within Window
+	DeleteReplies bool `yaml:"delete_replies"`
+}
+
+// Feedback configures how smib shows a command is running
+type Feedback struct {
+	// Style is one of the Feedback constants, used in channels not in Channels
+	Style string `yaml:"style"`
+	// Channels overrides Style by channel name or ID
+	Channels map[string]string `yaml:"channels"`
+}
+
+// WithoutTyping returns f with the typing style, which is also the default, replaced by reactions,
+// for transports which cannot send typing indicators.
+func (f Feedback) WithoutTyping() Feedback {
+	replace := func(style string) string {
+		if style == "" || style == FeedbackTyping {
+			return FeedbackReactions
+		}
+		return style
+	}
+	without := Feedback{Style: replace(f.Style)}
+	if f.Channels != nil {
+		without.Channels = make(map[string]string, len(f.Channels))
+		for channel, style := range f.Channels {
+			without.Channels[channel] = replace(style)
+		}
+	}
+	return without
+}
+
+// Output configures how command output is changed before it is sent
+type Output struct {
+	// IRCFormatting converts IRC formatting codes and /me actions in every command's output to
+	// mrkdwn, commands written for the IRC smib can also enable it in their manifest
+	IRCFormatting bool `yaml:"irc_formatting"`
+	// AllowMentions lists the commands whose output may mention @channel, @here, @everyone or
+	// user groups, these mentions are escaped in the output of every other command
+	AllowMentions []string `yaml:"allow_mentions"`
+	// BlockUsergroups also escapes user group mentions, which are otherwise allowed
+	BlockUsergroups bool `yaml:"block_usergroups"`
+	// SnippetLines uploads output longer than this many lines as a text snippet instead of
+	// sending it as messages, output is always sent as messages if it is 0. When it is set output
+	// is held back until the command exits.
+	SnippetLines int `yaml:"snippet_lines"`
+	// SendInterval and SendBurst pace everything smib sends to slack, up to SendBurst messages
+	// may be sent at once and then one per SendInterval. Nothing is paced if SendInterval is 0.
+	SendInterval Duration `yaml:"send_interval"`
+	SendBurst    int      `yaml:"send_burst"`
+}
+
+// Files configures files sent by commands
+type Files struct {
+	// MaxUploadBytes is the largest file a command may upload, larger files aren't sent
+	MaxUploadBytes int64 `yaml:"max_upload_bytes"`
+	// MaxDownloadBytes is the largest file shared with a command which is downloaded for it,
+	// commands aren't run with larger files
+	MaxDownloadBytes int64 `yaml:"max_download_bytes"`
+}
+
+// Callbacks configures the API commands can use to act on slack while they run and after
+type Callbacks struct {
+	// Listen is the address to serve the API on, which must be a loopback address, disabled if
+	// empty. Port 0 picks a free port.
+	Listen string `yaml:"listen"`
+	// Grace is how long after a command exits that it, or anything it started, may still use the API
+	Grace Duration `yaml:"grace"`
+}
+
+// Store configures the key-value store commands can use through the callback API
+type Store struct {
+	// Path is the database file, which is created if it doesn't exist. The store is disabled if
+	// it is empty.
+	Path string `yaml:"path"`
+	// BackupTokenFile holds the token backups are authorised with, they are served on the
+	// callback listener if it is set.
+	BackupTokenFile string `yaml:"backup_token_file"`
+}
+
+// Duration is a time.Duration which unmarshals from strings such as "5s"
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the default config
+func Default() *Config {
+	return &Config{
+		Transport:     TransportRTM,
+		Triggers:      Triggers{Prefixes: []string{"?"}},
+		HealthMaxDown: Duration(2 * time.Minute),
+		ShutdownGrace: Duration(5 * time.Second),
+		Edits:         Edits{Window: Duration(10 * time.Minute)},
+		Feedback:      Feedback{Style: FeedbackTyping},
+		Output:        Output{SendInterval: Duration(time.Second), SendBurst: 5},
+		Files:         Files{MaxUploadBytes: 10 << 20, MaxDownloadBytes: 10 << 20},
+		Callbacks:     Callbacks{Grace: Duration(10 * time.Minute)},
+	}
+}
+
+// Load returns the default config overridden by the YAML file at path, if path is empty the
+// default config is returned.
+func Load(path string) (*Config, error) {
+	c := Default()
+	if path == "" {
+		return c, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %s", err)
+	}
+	if err := yaml.UnmarshalStrict(raw, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config file '%s': %s", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks the config is usable
+func (c *Config) Validate() error {
+	if c.Commands == "" {
+		return errors.New("no commands directory configured")
+	}
+	info, err := os.Stat(c.Commands)
+	if err != nil {
+		return fmt.Errorf("commands directory: %s", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("commands directory '%s' is not a directory", c.Commands)
+	}
+	if c.Transport != TransportRTM && c.Transport != TransportSocket {
+		return fmt.Errorf("unknown transport '%s', must be %s or %s", c.Transport, TransportRTM, TransportSocket)
+	}
+	if len(c.Triggers.Prefixes) == 0 && !c.Triggers.Mention && !c.Triggers.DMWithoutPrefix {
+		return errors.New("no triggers configured, smib would never run a command")
+	}
+	for _, prefix := range c.Triggers.Prefixes {
+		if strings.TrimSpace(prefix) == "" {
+			return errors.New("trigger prefixes must not be blank")
+		}
+	}
+	if err := validFeedback(c.Feedback.Style); err != nil {
+		return err
+	}
+	for channel, style := range c.Feedback.Channels {
+		if err := validFeedback(style); err != nil {
+			return fmt.Errorf("channel '%s': %s", channel, err)
+		}
+	}
+	if c.Callbacks.Listen != "" {
+		if err := loopback(c.Callbacks.Listen); err != nil {
+			return fmt.Errorf("callbacks.listen: %s", err)
+		}
+	}
+	if c.Store.BackupTokenFile != "" && (c.Store.Path == "" || c.Callbacks.Listen == "") {
+		return errors.New("store.backup_token_file needs store.path and callbacks.listen")
+	}
+	if c.HealthMaxDown < 0 || c.ShutdownGrace < 0 || c.Edits.Window < 0 || c.Callbacks.Grace < 0 || c.Output.SendInterval < 0 {
+		return errors.New("durations must not be negative")
+	}
+	if c.Output.SnippetLines < 0 {
+		return errors.New("output.snippet_lines must not be negative")
+	}
+	if c.Output.SendBurst < 1 {
+		return errors.New("output.send_burst must be at least 1")
+	}
+	if c.Files.MaxUploadBytes <= 0 || c.Files.MaxDownloadBytes <= 0 {
+		return errors.New("files.max_upload_bytes and files.max_download_bytes must be positive")
+	}
+	return nil
+}
+
+// loopback checks addr is a host:port on a loopback interface, so only this machine can connect
+func loopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("'%s' is not a loopback address such as 127.0.0.1", host)
+	}
+	return nil
+}
+
+// validFeedback checks style is one of the Feedback constants
+func validFeedback(style string) error {
+	switch style {
+	case FeedbackTyping, FeedbackReactions, FeedbackNone:
+		return nil
+	}
+	return fmt.Errorf("unknown feedback style '%s', must be %s, %s or %s", style, FeedbackTyping, FeedbackReactions, FeedbackNone)
+}
+
+// LoadToken returns the slack token, taken from the first of: the Token field, the SMIB_SLACK_TOKEN
+// environment variable or TokenFile.
+func (c *Config) LoadToken() (string, error) {
+	return loadToken("slack token", c.Token, TokenEnv, c.TokenFile, "token_file", "xox")
+}
+
+// LoadAppToken returns the app-level token used by socket mode, taken from the
+// SMIB_SLACK_APP_TOKEN environment variable or AppTokenFile.
+func (c *Config) LoadAppToken() (string, error) {
+	return loadToken("slack app token", "", AppTokenEnv, c.AppTokenFile, "app_token_file", "xapp-")
+}
+
+// LoadSigningSecret returns the secret slash commands are signed with, taken from the
+// SMIB_SLACK_SIGNING_SECRET environment variable or Slash.SigningSecretFile.
+func (c *Config) LoadSigningSecret() (string, error) {
+	return loadToken("slack signing secret", "", SigningSecretEnv, c.Slash.SigningSecretFile, "slash.signing_secret_file", "")
+}
+
+// LoadBackupToken returns the token store backups are authorised with, read from
+// Store.BackupTokenFile.
+func (c *Config) LoadBackupToken() (string, error) {
+	token, err := readTokenFile(c.Store.BackupTokenFile)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", fmt.Errorf("store backup token file '%s' is empty", c.Store.BackupTokenFile)
+	}
+	return token, nil
+}
+
+// loadToken returns the first of token, the env environment variable or the contents of file,
+// checking it has the expected prefix.
+func loadToken(name, token, env, file, fileSetting, prefix string) (string, error) {
+	source := "the command line"
+	if token == "" {
+		token = os.Getenv(env)
+		source = env
+	}
+	if token == "" && file != "" {
+		var err error
+		token, err = readTokenFile(file)
+		if err != nil {
+			return "", err
+		}
+		source = file
+	}
+	if token == "" {
+		return "", fmt.Errorf("no %s, set %s or %s", name, env, fileSetting)
+	}
+	if !strings.HasPrefix(token, prefix) {
+		return "", fmt.Errorf("%s from %s does not look like a %s, it should start %s", name, source, name, prefix)
+	}
+	return token, nil
+}
+
+// readTokenFile reads a token from path, refusing files other users could read
+func readTokenFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("token file: %s", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("token file '%s' has mode %s, it must not be accessible by group or other (chmod 600)", path, info.Mode().Perm())
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("token file: %s", err)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
@@ -0,0 +1,467 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, dir, name, content string, mode os.FileMode) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), mode))
+	require.NoError(t, os.Chmod(path, mode))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		path    string
+		want    *Config
+		wantErr string
+	}{
+		{
+			name: "no config file",
+			want: Default(),
+		},
+		{
+			name: "full config file",
+			path: writeFile(t, dir, "full.yaml", `
+commands: /home/smib/smib-commands
+token_file: /etc/slacker-smib/token
+transport: socket
+app_token_file: /etc/slacker-smib/app-token
+listen: localhost:9090
+health_max_down: 30s
+shutdown_grace: 1m
+triggers:
+  prefixes: ["?", "smib:"]
+  mention: true
+slash:
+  listen: :8080
+  signing_secret_file: /etc/slacker-smib/signing-secret
+  in_channel: [door, status]
+edits:
+  window: 2m
+  delete_replies: true
+feedback:
+  style: reactions
+  channels:
+    general: typing
+    C0123: none
+output:
+  irc_formatting: true
+  allow_mentions: [doorbell]
+  block_usergroups: true
+  snippet_lines: 20
+  send_interval: 500ms
+  send_burst: 10
+files:
+  max_upload_bytes: 1048576
+  max_download_bytes: 2097152
+callbacks:
+  listen: 127.0.0.1:0
+  grace: 1h
+store:
+  path: /var/lib/slacker-smib/smib.db
+`, 0644),
+			want: &Config{
+				Commands:      "/home/smib/smib-commands",
+				TokenFile:     "/etc/slacker-smib/token",
+				Transport:     TransportSocket,
+				AppTokenFile:  "/etc/slacker-smib/app-token",
+				Listen:        "localhost:9090",
+				HealthMaxDown: Duration(30 * time.Second),
+				ShutdownGrace: Duration(time.Minute),
+				Triggers: Triggers{
+					Prefixes: []string{"?", "smib:"},
+					Mention:  true,
+				},
+				Slash: Slash{
+					Listen:            ":8080",
+					SigningSecretFile: "/etc/slacker-smib/signing-secret",
+					InChannel:         []string{"door", "status"},
+				},
+				Edits: Edits{Window: Duration(2 * time.Minute), DeleteReplies: true},
+				Feedback: Feedback{
+					Style:    FeedbackReactions,
+					Channels: map[string]string{"general": FeedbackTyping, "C0123": FeedbackNone},
+				},
+				Output: Output{
+					IRCFormatting:   true,
+					AllowMentions:   []string{"doorbell"},
+					BlockUsergroups: true,
+					SnippetLines:    20,
+					SendInterval:    Duration(500 * time.Millisecond),
+					SendBurst:       10,
+				},
+				Files:     Files{MaxUploadBytes: 1 << 20, MaxDownloadBytes: 2 << 20},
+				Callbacks: Callbacks{Listen: "127.0.0.1:0", Grace: Duration(time.Hour)},
+				Store:     Store{Path: "/var/lib/slacker-smib/smib.db"},
+			},
+		},
+		{
+			name: "partial config file keeps defaults",
+			path: writeFile(t, dir, "partial.yaml", "commands: /cmds\n", 0644),
+			want: &Config{
+				Commands:      "/cmds",
+				Transport:     TransportRTM,
+				Triggers:      Triggers{Prefixes: []string{"?"}},
+				HealthMaxDown: Duration(2 * time.Minute),
+				ShutdownGrace: Duration(5 * time.Second),
+				Edits:         Edits{Window: Duration(10 * time.Minute)},
+				Feedback:      Feedback{Style: FeedbackTyping},
+				Output:        Output{SendInterval: Duration(time.Second), SendBurst: 5},
+				Files:         Files{MaxUploadBytes: 10 << 20, MaxDownloadBytes: 10 << 20},
+				Callbacks:     Callbacks{Grace: Duration(10 * time.Minute)},
+			},
+		},
+		{
+			name:    "missing config file",
+			path:    filepath.Join(dir, "nothere.yaml"),
+			wantErr: "failed to read config file",
+		},
+		{
+			name:    "unknown setting",
+			path:    writeFile(t, dir, "unknown.yaml", "comands: /cmds\n", 0644),
+			wantErr: "field comands not found",
+		},
+		{
+			name:    "token in config file",
+			path:    writeFile(t, dir, "token.yaml", "token: xoxb-nope\n", 0644),
+			wantErr: "field token not found",
+		},
+		{
+			name:    "bad duration",
+			path:    writeFile(t, dir, "duration.yaml", "shutdown_grace: forever\n", 0644),
+			wantErr: "invalid duration",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Load(tt.path)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFile(t, dir, "file", "", 0644)
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			modify: func(*Config) {},
+		},
+		{
+			name:   "valid socket mode",
+			modify: func(c *Config) { c.Transport = TransportSocket },
+		},
+		{
+			name:    "unknown transport",
+			modify:  func(c *Config) { c.Transport = "carrier pigeon" },
+			wantErr: "unknown transport 'carrier pigeon'",
+		},
+		{
+			name:    "no commands",
+			modify:  func(c *Config) { c.Commands = "" },
+			wantErr: "no commands directory configured",
+		},
+		{
+			name:    "commands missing",
+			modify:  func(c *Config) { c.Commands = filepath.Join(dir, "nothere") },
+			wantErr: "no such file or directory",
+		},
+		{
+			name:    "commands not a directory",
+			modify:  func(c *Config) { c.Commands = file },
+			wantErr: "is not a directory",
+		},
+		{
+			name:    "negative duration",
+			modify:  func(c *Config) { c.ShutdownGrace = -1 },
+			wantErr: "must not be negative",
+		},
+		{
+			name:    "negative edit window",
+			modify:  func(c *Config) { c.Edits.Window = -1 },
+			wantErr: "must not be negative",
+		},
+		{
+			name:   "edits disabled",
+			modify: func(c *Config) { c.Edits.Window = 0 },
+		},
+		{
+			name:   "reaction feedback in one channel",
+			modify: func(c *Config) { c.Feedback.Channels = map[string]string{"general": FeedbackReactions} },
+		},
+		{
+			name:    "unknown feedback style",
+			modify:  func(c *Config) { c.Feedback.Style = "smoke signals" },
+			wantErr: "unknown feedback style 'smoke signals'",
+		},
+		{
+			name:    "unknown channel feedback style",
+			modify:  func(c *Config) { c.Feedback.Channels = map[string]string{"general": "emoji"} },
+			wantErr: "channel 'general': unknown feedback style 'emoji'",
+		},
+		{
+			name:    "negative snippet lines",
+			modify:  func(c *Config) { c.Output.SnippetLines = -1 },
+			wantErr: "output.snippet_lines must not be negative",
+		},
+		{
+			name:    "negative send interval",
+			modify:  func(c *Config) { c.Output.SendInterval = -1 },
+			wantErr: "durations must not be negative",
+		},
+		{
+			name:    "no send burst",
+			modify:  func(c *Config) { c.Output.SendBurst = 0 },
+			wantErr: "output.send_burst must be at least 1",
+		},
+		{
+			name:    "no upload size",
+			modify:  func(c *Config) { c.Files.MaxUploadBytes = 0 },
+			wantErr: "files.max_upload_bytes and files.max_download_bytes must be positive",
+		},
+		{
+			name:    "negative download size",
+			modify:  func(c *Config) { c.Files.MaxDownloadBytes = -1 },
+			wantErr: "files.max_upload_bytes and files.max_download_bytes must be positive",
+		},
+		{
+			name: "store backups",
+			modify: func(c *Config) {
+				c.Store = Store{Path: "/var/lib/slacker-smib/smib.db", BackupTokenFile: "/etc/slacker-smib/backup-token"}
+				c.Callbacks.Listen = "127.0.0.1:8081"
+			},
+		},
+		{
+			name: "store backups without callbacks",
+			modify: func(c *Config) {
+				c.Store = Store{Path: "/var/lib/slacker-smib/smib.db", BackupTokenFile: "/etc/slacker-smib/backup-token"}
+			},
+			wantErr: "store.backup_token_file needs store.path and callbacks.listen",
+		},
+		{
+			name:   "callbacks on localhost",
+			modify: func(c *Config) { c.Callbacks.Listen = "localhost:8081" },
+		},
+		{
+			name:   "callbacks on ipv6 loopback",
+			modify: func(c *Config) { c.Callbacks.Listen = "[::1]:0" },
+		},
+		{
+			name:    "callbacks on every interface",
+			modify:  func(c *Config) { c.Callbacks.Listen = ":8081" },
+			wantErr: "callbacks.listen: '' is not a loopback address such as 127.0.0.1",
+		},
+		{
+			name:    "callbacks without a port",
+			modify:  func(c *Config) { c.Callbacks.Listen = "127.0.0.1" },
+			wantErr: "callbacks.listen: address 127.0.0.1: missing port in address",
+		},
+		{
+			name:    "negative callback grace",
+			modify:  func(c *Config) { c.Callbacks.Grace = -1 },
+			wantErr: "must not be negative",
+		},
+		{
+			name:   "mention only",
+			modify: func(c *Config) { c.Triggers = Triggers{Mention: true} },
+		},
+		{
+			name:    "no triggers",
+			modify:  func(c *Config) { c.Triggers = Triggers{} },
+			wantErr: "no triggers configured",
+		},
+		{
+			name:    "blank prefix",
+			modify:  func(c *Config) { c.Triggers.Prefixes = []string{"?", " "} },
+			wantErr: "trigger prefixes must not be blank",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.Commands = dir
+			tt.modify(c)
+
+			err := c.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestConfig_LoadToken(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		config  Config
+		env     string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "from flag",
+			config: Config{Token: "xoxb-flag"},
+			env:    "xoxb-env",
+			want:   "xoxb-flag",
+		},
+		{
+			name:   "from env",
+			config: Config{TokenFile: writeFile(t, dir, "envtoken", "xoxb-file", 0600)},
+			env:    "xoxb-env",
+			want:   "xoxb-env",
+		},
+		{
+			name:   "from file",
+			config: Config{TokenFile: writeFile(t, dir, "token", "xoxb-file\n", 0600)},
+			want:   "xoxb-file",
+		},
+		{
+			name:    "file readable by others",
+			config:  Config{TokenFile: writeFile(t, dir, "open", "xoxb-file\n", 0644)},
+			wantErr: "must not be accessible by group or other",
+		},
+		{
+			name:    "missing file",
+			config:  Config{TokenFile: filepath.Join(dir, "nothere")},
+			wantErr: "token file:",
+		},
+		{
+			name:    "no token",
+			wantErr: "no slack token",
+		},
+		{
+			name:    "not a token",
+			env:     "hunter2",
+			wantErr: "SMIB_SLACK_TOKEN does not look like a slack token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(TokenEnv, tt.env)
+			defer os.Unsetenv(TokenEnv)
+
+			got, err := tt.config.LoadToken()
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConfig_LoadAppToken(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		config  Config
+		env     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "from env",
+			env:  "xapp-env",
+			want: "xapp-env",
+		},
+		{
+			name:   "from file",
+			config: Config{AppTokenFile: writeFile(t, dir, "token", "xapp-file\n", 0600)},
+			want:   "xapp-file",
+		},
+		{
+			name:    "no token",
+			wantErr: "no slack app token, set SMIB_SLACK_APP_TOKEN or app_token_file",
+		},
+		{
+			name:    "bot token",
+			env:     "xoxb-bot",
+			wantErr: "slack app token from SMIB_SLACK_APP_TOKEN does not look like a slack app token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(AppTokenEnv, tt.env)
+			defer os.Unsetenv(AppTokenEnv)
+
+			got, err := tt.config.LoadAppToken()
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConfig_LoadSigningSecret(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{Slash: Slash{SigningSecretFile: writeFile(t, dir, "secret", "8f742231b10e8888abcd99yyyzzz85a5\n", 0600)}}
+	got, err := c.LoadSigningSecret()
+	require.NoError(t, err)
+	assert.Equal(t, "8f742231b10e8888abcd99yyyzzz85a5", got)
+
+	_, err = (&Config{}).LoadSigningSecret()
+	assert.EqualError(t, err, "no slack signing secret, set SMIB_SLACK_SIGNING_SECRET or slash.signing_secret_file")
+}
+
+func TestConfig_LoadBackupToken(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{Store: Store{BackupTokenFile: writeFile(t, dir, "backup-token", "hunter2\n", 0600)}}
+	got, err := c.LoadBackupToken()
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", got)
+
+	c.Store.BackupTokenFile = writeFile(t, dir, "empty", "\n", 0600)
+	_, err = c.LoadBackupToken()
+	assert.EqualError(t, err, "store backup token file '"+c.Store.BackupTokenFile+"' is empty")
+
+	c.Store.BackupTokenFile = writeFile(t, dir, "open", "hunter2\n", 0644)
+	_, err = c.LoadBackupToken()
+	assert.Error(t, err)
+}
+
+func TestFeedback_WithoutTyping(t *testing.T) {
+	f := Feedback{
+		Style:    FeedbackTyping,
+		Channels: map[string]string{"general": FeedbackNone, "C0DOOR": FeedbackTyping, "random": FeedbackReactions},
+	}
+	assert.Equal(t, Feedback{
+		Style:    FeedbackReactions,
+		Channels: map[string]string{"general": FeedbackNone, "C0DOOR": FeedbackReactions, "random": FeedbackReactions},
+	}, f.WithoutTyping())
+	assert.Equal(t, FeedbackTyping, f.Channels["C0DOOR"], "the original is unchanged")
+
+	assert.Equal(t, Feedback{Style: FeedbackReactions}, Feedback{}.WithoutTyping())
+	assert.Equal(t, Feedback{Style: FeedbackNone}, Feedback{Style: FeedbackNone}.WithoutTyping())
+}
@@ -0,0 +1,594 @@
+// Package console is a stand-in for slack in a terminal, so commands can be tried without a
+// workspace. Lines typed are delivered as messages from a fake user in a fake channel, in the same
+// form as slack.RTM events, and everything the bot would post is printed.
+package console
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// IDs of the fake users and conversations
+const (
+	BotID     = "U0SMIB"
+	UserID    = "U0CONSOLE"
+	ChannelID = "C0CONSOLE"
+	DMID      = "D0CONSOLE"
+)
+
+// botName is the bot's name in the console
+const botName = "smib"
+
+const help = `Type a message to send it to #%[1]s as @%[2]s, or:
+  :thread [ts] text  reply in the thread of message ts, or of your last message
+  :dm text           send smib a direct message
+  :edit ts text      edit your message ts
+  :delete ts         delete your message ts
+  :share path [text] share a local file with an optional message
+  :help              show this help
+Ctrl-D quits.
+`
+
+// message is a message typed in the console, kept so it can be edited, deleted or replied to
+type message struct {
+	channel, threadTS, text string
+}
+
+// Console reads messages from in and writes what the bot posts to out
+type Console struct {
+	// IncomingEvents receives the same events as slack.RTM's IncomingEvents
+	IncomingEvents chan slack.RTMEvent
+
+	in            io.Reader
+	out           io.Writer
+	user, channel string
+	idGen         slack.IDGenerator
+	done          chan struct{}
+
+	mu       sync.Mutex
+	lastTS   int64
+	last     string
+	messages map[string]message
+	kill     chan struct{}
+	killOnce sync.Once
+}
+
+// New returns a Console where the bot talks to a user called user in a channel called channel
+func New(in io.Reader, out io.Writer, user, channel string) *Console {
+	return &Console{
+		IncomingEvents: make(chan slack.RTMEvent, 50),
+		in:             in,
+		out:            out,
+		user:           user,
+		channel:        channel,
+		idGen:          slack.NewSafeID(1),
+		done:           make(chan struct{}),
+		messages:       map[string]message{},
+		kill:           make(chan struct{}),
+	}
+}
+
+// Done is closed when there is no more input
+func (c *Console) Done() <-chan struct{} {
+	return c.done
+}
+
+// ManageConnection "connects" the bot then delivers lines read from in as messages until in ends
+// or Disconnect is called.
+func (c *Console) ManageConnection() {
+	defer close(c.done)
+	if !c.emit("connected", &slack.ConnectedEvent{Info: &slack.Info{
+		User: &slack.UserDetails{ID: BotID, Name: botName},
+		Team: &slack.Team{Name: "console"},
+	}}) {
+		return
+	}
+	c.printf(help, c.channel, c.user)
+
+	scanner := bufio.NewScanner(c.in)
+	for scanner.Scan() {
+		if err := c.handleLine(strings.TrimSpace(scanner.Text())); err != nil {
+			c.printf("%s\n", err)
+		}
+		select {
+		case <-c.kill:
+			return
+		default:
+		}
+	}
+}
+
+// Disconnect stops ManageConnection
+func (c *Console) Disconnect() error {
+	already := true
+	c.killOnce.Do(func() {
+		already = false
+		close(c.kill)
+	})
+	if already {
+		return slack.ErrAlreadyDisconnected
+	}
+	return nil
+}
+
+// Events returns IncomingEvents
+func (c *Console) Events() <-chan slack.RTMEvent {
+	return c.IncomingEvents
+}
+
+// handleLine delivers a typed line as a message event
+func (c *Console) handleLine(line string) error {
+	if !strings.HasPrefix(line, ":") {
+		if line == "" {
+			return nil
+		}
+		c.send(message{channel: ChannelID, text: line}, nil)
+		return nil
+	}
+
+	command, rest := cut(line[1:])
+	switch command {
+	case "thread":
+		ts, text := cut(rest)
+		if _, ok := c.message(ts); !ok {
+			ts, text = c.lastMessage(), rest
+		}
+		if ts == "" {
+			return errors.New("there is no message to reply to yet")
+		}
+		parent, _ := c.message(ts)
+		if parent.threadTS != "" {
+			ts = parent.threadTS
+		}
+		if text == "" {
+			return errors.New("usage: :thread [ts] text")
+		}
+		c.send(message{channel: parent.channel, threadTS: ts, text: text}, nil)
+	case "dm":
+		if rest == "" {
+			return errors.New("usage: :dm text")
+		}
+		c.send(message{channel: DMID, text: rest}, nil)
+	case "edit":
+		ts, text := cut(rest)
+		old, ok := c.message(ts)
+		if !ok || text == "" {
+			return errors.New("usage: :edit ts text, where ts is one of your messages")
+		}
+		c.edit(ts, old, text)
+	case "delete":
+		old, ok := c.message(rest)
+		if !ok {
+			return errors.New("usage: :delete ts, where ts is one of your messages")
+		}
+		c.delete(rest, old)
+	case "share":
+		path, text := cut(rest)
+		file, err := shareFile(path)
+		if err != nil {
+			return err
+		}
+		c.send(message{channel: ChannelID, text: text}, []slack.File{file})
+	case "help":
+		c.printf(help, c.channel, c.user)
+	default:
+		return fmt.Errorf("unknown console command :%s, try :help", command)
+	}
+	return nil
+}
+
+// send delivers a new message from the user
+func (c *Console) send(msg message, files []slack.File) {
+	ts := c.nextTS()
+	c.mu.Lock()
+	c.messages[ts] = msg
+	if msg.threadTS == "" {
+		c.last = ts
+	}
+	c.mu.Unlock()
+
+	c.show(ts, msg.channel, msg.threadTS, "@"+c.user, msg.text)
+	for i := range files {
+		files[i].ID = fmt.Sprintf("F%s%d", strings.Replace(ts, ".", "", 1), i)
+		c.printf("    shared %s\n", files[i].Name)
+	}
+
+	event := &slack.MessageEvent{Msg: slack.Msg{
+		Type:            "message",
+		Channel:         msg.channel,
+		User:            UserID,
+		Text:            encode(msg.text),
+		Timestamp:       ts,
+		ThreadTimestamp: msg.threadTS,
+		Files:           files,
+	}}
+	if len(files) > 0 {
+		event.SubType = "file_share"
+	}
+	c.emit("message", event)
+}
+
+// edit delivers the user changing their message ts from old to text
+func (c *Console) edit(ts string, old message, text string) {
+	c.mu.Lock()
+	c.messages[ts] = message{channel: old.channel, threadTS: old.threadTS, text: text}
+	c.mu.Unlock()
+
+	c.show(ts, old.channel, old.threadTS, "@"+c.user+" (edited)", text)
+	c.emit("message", &slack.MessageEvent{Msg: slack.Msg{
+		Type:    "message",
+		SubType: "message_changed",
+		Channel: old.channel,
+		Hidden:  true,
+	}, SubMessage: &slack.Msg{
+		Type:            "message",
+		User:            UserID,
+		Text:            encode(text),
+		Timestamp:       ts,
+		ThreadTimestamp: old.threadTS,
+	}, PreviousMessage: &slack.Msg{
+		Type:      "message",
+		User:      UserID,
+		Text:      encode(old.text),
+		Timestamp: ts,
+	}})
+}
+
+// delete delivers the user deleting their message ts
+func (c *Console) delete(ts string, old message) {
+	c.mu.Lock()
+	delete(c.messages, ts)
+	c.mu.Unlock()
+
+	c.printf("[%s] %s @%s deleted their message\n", ts, c.where(old.channel, old.threadTS), c.user)
+	c.emit("message", &slack.MessageEvent{Msg: slack.Msg{
+		Type:             "message",
+		SubType:          "message_deleted",
+		Channel:          old.channel,
+		Hidden:           true,
+		DeletedTimestamp: ts,
+	}})
+}
+
+// message returns the user's message ts
+func (c *Console) message(ts string) (message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msg, ok := c.messages[ts]
+	return msg, ok
+}
+
+// lastMessage returns the timestamp of the user's last message outside a thread
+func (c *Console) lastMessage() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// shareFile describes the local file at path as a file shared in slack, GetFile reads it from
+// URLPrivateDownload. send gives it an ID.
+func shareFile(path string) (slack.File, error) {
+	if path == "" {
+		return slack.File{}, errors.New("usage: :share path [text]")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return slack.File{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return slack.File{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return slack.File{}, fmt.Errorf("%s is not a file", path)
+	}
+	mimetype := mime.TypeByExtension(filepath.Ext(path))
+	if mimetype == "" {
+		mimetype = "application/octet-stream"
+	}
+	return slack.File{
+		Name:               info.Name(),
+		Size:               int(info.Size()),
+		Mimetype:           mimetype,
+		URLPrivateDownload: path,
+	}, nil
+}
+
+// NewOutgoingMessage prepares a message for SendMessage, see slack.RTM.NewOutgoingMessage.
+func (c *Console) NewOutgoingMessage(text string, channelID string, options ...slack.RTMsgOption) *slack.OutgoingMessage {
+	msg := slack.OutgoingMessage{
+		ID:      c.idGen.Next(),
+		Type:    "message",
+		Channel: channelID,
+		Text:    text,
+	}
+	for _, option := range options {
+		option(&msg)
+	}
+	return &msg
+}
+
+// NewTypingMessage prepares a typing indicator, SendMessage doesn't print these as nothing is
+// posted.
+func (c *Console) NewTypingMessage(channelID string) *slack.OutgoingMessage {
+	return &slack.OutgoingMessage{
+		ID:      c.idGen.Next(),
+		Type:    "typing",
+		Channel: channelID,
+	}
+}
+
+// SendMessage prints msg and acknowledges it like the RTM API
+func (c *Console) SendMessage(msg *slack.OutgoingMessage) {
+	if msg == nil || msg.Type != "message" {
+		return
+	}
+	ts := c.nextTS()
+	c.show(ts, msg.Channel, msg.ThreadTimestamp, botName, msg.Text)
+	c.emit("ack", &slack.AckMessage{
+		ReplyTo:     msg.ID,
+		Timestamp:   ts,
+		Text:        msg.Text,
+		RTMResponse: slack.RTMResponse{Ok: true},
+	})
+}
+
+// PostMessage prints a message
+func (c *Console) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	_, values, err := slack.UnsafeApplyMsgOptions("", channelID, "", options...)
+	if err != nil {
+		return "", "", err
+	}
+	if err := c.conversation(channelID); err != nil {
+		return "", "", err
+	}
+	ts := c.nextTS()
+	from := botName
+	if values.Get("reply_broadcast") == "true" {
+		from += " (also sent to the channel)"
+	}
+	c.show(ts, channelID, values.Get("thread_ts"), from, values.Get("text"))
+	return channelID, ts, nil
+}
+
+// PostEphemeral prints a message only userID would see
+func (c *Console) PostEphemeral(channelID, userID string, options ...slack.MsgOption) (string, error) {
+	_, values, err := slack.UnsafeApplyMsgOptions("", channelID, "", options...)
+	if err != nil {
+		return "", err
+	}
+	if err := c.conversation(channelID); err != nil {
+		return "", err
+	}
+	ts := c.nextTS()
+	c.show(ts, channelID, values.Get("thread_ts"), fmt.Sprintf("%s (only visible to %s)", botName, c.mention(userID)), values.Get("text"))
+	return ts, nil
+}
+
+// UpdateMessage prints an edit to one of the bot's messages
+func (c *Console) UpdateMessage(channelID, timestamp string, options ...slack.MsgOption) (string, string, string, error) {
+	_, values, err := slack.UnsafeApplyMsgOptions("", channelID, "", options...)
+	if err != nil {
+		return "", "", "", err
+	}
+	c.show(timestamp, channelID, "", botName+" (edited)", values.Get("text"))
+	return channelID, timestamp, values.Get("text"), nil
+}
+
+// DeleteMessage prints the bot deleting one of its messages
+func (c *Console) DeleteMessage(channelID, timestamp string) (string, string, error) {
+	c.printf("[%s] %s %s deleted its message\n", timestamp, c.where(channelID, ""), botName)
+	return channelID, timestamp, nil
+}
+
+// AddReaction prints the bot reacting to a message
+func (c *Console) AddReaction(name string, item slack.ItemRef) error {
+	c.printf("[%s] %s %s reacted :%s:\n", item.Timestamp, c.where(item.Channel, ""), botName, name)
+	return nil
+}
+
+// RemoveReaction prints the bot removing a reaction
+func (c *Console) RemoveReaction(name string, item slack.ItemRef) error {
+	c.printf("[%s] %s %s removed its :%s: reaction\n", item.Timestamp, c.where(item.Channel, ""), botName, name)
+	return nil
+}
+
+// UploadFile prints a file the bot uploads, and its content if it is a snippet
+func (c *Console) UploadFile(params slack.FileUploadParameters) (*slack.File, error) {
+	channel := ""
+	if len(params.Channels) > 0 {
+		channel = params.Channels[0]
+	}
+	size := len(params.Content)
+	if params.Reader != nil {
+		content, err := ioutil.ReadAll(params.Reader)
+		if err != nil {
+			return nil, err
+		}
+		size = len(content)
+	}
+
+	ts := c.nextTS()
+	text := fmt.Sprintf("uploaded %s (%d bytes)", params.Filename, size)
+	if params.Title != "" {
+		text += fmt.Sprintf(" titled %q", params.Title)
+	}
+	if params.InitialComment != "" {
+		text += "\n" + params.InitialComment
+	}
+	if params.Content != "" {
+		text += "\n```\n" + strings.TrimSuffix(params.Content, "\n") + "\n```"
+	}
+	c.show(ts, channel, params.ThreadTimestamp, botName, text)
+	return &slack.File{ID: "F" + strings.Replace(ts, ".", "", 1), Name: params.Filename, Size: size}, nil
+}
+
+// GetFile copies a file shared with :share to writer
+func (c *Console) GetFile(downloadURL string, writer io.Writer) error {
+	f, err := os.Open(downloadURL)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(writer, f)
+	return err
+}
+
+// GetUserInfo returns the console user or the bot
+func (c *Console) GetUserInfo(user string) (*slack.User, error) {
+	for _, u := range c.users() {
+		if u.ID == user {
+			return &u, nil
+		}
+	}
+	return nil, errors.New("user_not_found")
+}
+
+// GetUsers returns the console user and the bot
+func (c *Console) GetUsers() ([]slack.User, error) {
+	return c.users(), nil
+}
+
+// GetConversationInfo returns the console channel or the user's DM with the bot
+func (c *Console) GetConversationInfo(channelID string, includeLocale bool) (*slack.Channel, error) {
+	for _, channel := range c.conversations() {
+		if channel.ID == channelID {
+			return &channel, nil
+		}
+	}
+	return nil, errors.New("channel_not_found")
+}
+
+// GetConversations returns the console channel and the user's DM with the bot
+func (c *Console) GetConversations(params *slack.GetConversationsParameters) ([]slack.Channel, string, error) {
+	return c.conversations(), "", nil
+}
+
+// OpenConversation returns the user's DM with the bot
+func (c *Console) OpenConversation(params *slack.OpenConversationParameters) (*slack.Channel, bool, bool, error) {
+	if len(params.Users) != 1 || params.Users[0] != UserID {
+		return nil, false, false, errors.New("user_not_found")
+	}
+	dm := c.conversations()[1]
+	return &dm, false, true, nil
+}
+
+func (c *Console) users() []slack.User {
+	return []slack.User{
+		{ID: UserID, Name: c.user, RealName: c.user, Profile: slack.UserProfile{DisplayName: c.user, RealName: c.user}},
+		{ID: BotID, Name: botName, IsBot: true, Profile: slack.UserProfile{DisplayName: botName}},
+	}
+}
+
+func (c *Console) conversations() []slack.Channel {
+	var channel, dm slack.Channel
+	channel.ID, channel.Name, channel.IsChannel, channel.IsMember = ChannelID, c.channel, true, true
+	dm.ID, dm.IsIM, dm.User = DMID, true, UserID
+	return []slack.Channel{channel, dm}
+}
+
+// conversation checks the bot can post in channelID
+func (c *Console) conversation(channelID string) error {
+	if channelID != ChannelID && channelID != DMID {
+		return errors.New("channel_not_found")
+	}
+	return nil
+}
+
+// nextTS returns a new message timestamp, later than every previous one
+func (c *Console) nextTS() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	micros := time.Now().UnixNano() / int64(time.Microsecond)
+	if micros <= c.lastTS {
+		micros = c.lastTS + 1
+	}
+	c.lastTS = micros
+	return fmt.Sprintf("%d.%06d", micros/1e6, micros%1e6)
+}
+
+// show prints a message as it would appear in slack, indenting every line after the first.
+// Trailing newlines are dropped as slack doesn't show them.
+func (c *Console) show(ts, channelID, threadTS, from, text string) {
+	text = strings.ReplaceAll(strings.TrimRight(text, "\n"), "\n", "\n    ")
+	c.printf("[%s] %s %s: %s\n", ts, c.where(channelID, threadTS), from, text)
+}
+
+// where describes a conversation and thread
+func (c *Console) where(channelID, threadTS string) string {
+	var where string
+	switch channelID {
+	case ChannelID:
+		where = "#" + c.channel
+	case DMID:
+		where = "DM"
+	default:
+		where = channelID
+	}
+	if threadTS != "" {
+		where += " thread " + threadTS
+	}
+	return where
+}
+
+// mention returns the name of user
+func (c *Console) mention(user string) string {
+	if user == UserID {
+		return "@" + c.user
+	}
+	return user
+}
+
+func (c *Console) printf(format string, a ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.out, format, a...)
+}
+
+// emit delivers an event, giving up if the console is disconnected
+func (c *Console) emit(eventType string, data interface{}) bool {
+	select {
+	case c.IncomingEvents <- slack.RTMEvent{Type: eventType, Data: data}:
+		return true
+	case <-c.kill:
+		return false
+	}
+}
+
+// cut splits s at its first space
+func cut(s string) (string, string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+// special matches user, channel and special mentions, which slack sends as they are
+var special = regexp.MustCompile(`<[@#!][^<>]*>`)
+
+// encode escapes text like slack does in messages it delivers, except for mentions such as
+// <@U0CONSOLE> which are passed through so commands taking users and channels can be tried.
+func encode(text string) string {
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+	var b strings.Builder
+	last := 0
+	for _, loc := range special.FindAllStringIndex(text, -1) {
+		b.WriteString(escape(text[last:loc[0]]))
+		b.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(escape(text[last:]))
+	return b.String()
+}
@@ -0,0 +1,258 @@
+package console
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer which is safe to read while the console writes to it
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+var timestamps = regexp.MustCompile(`\d{10}\.\d{6}`)
+
+// run types input into a console and returns the messages delivered and what was printed, with
+// timestamps replaced by TS
+func run(t *testing.T, input string) ([]*slack.MessageEvent, string, *Console) {
+	out := &syncBuffer{}
+	c := New(strings.NewReader(input), out, "egon", "general")
+	go c.ManageConnection()
+
+	event := <-c.Events()
+	connected, ok := event.Data.(*slack.ConnectedEvent)
+	require.True(t, ok)
+	assert.Equal(t, BotID, connected.Info.User.ID)
+
+	var messages []*slack.MessageEvent
+	for {
+		select {
+		case event := <-c.Events():
+			messages = append(messages, event.Data.(*slack.MessageEvent))
+		case <-c.Done():
+			for len(c.Events()) > 0 {
+				messages = append(messages, (<-c.Events()).Data.(*slack.MessageEvent))
+			}
+			return messages, timestamps.ReplaceAllString(out.String(), "TS"), c
+		case <-time.After(time.Second):
+			t.Fatal("console didn't finish reading input")
+		}
+	}
+}
+
+func TestConsole_messages(t *testing.T) {
+	messages, out, _ := run(t, "?door open\n\n:thread ?door close\n:dm ?karma <@U0CONSOLE> & <b>\n")
+	require.Len(t, messages, 3)
+
+	assert.Equal(t, ChannelID, messages[0].Channel)
+	assert.Equal(t, UserID, messages[0].User)
+	assert.Equal(t, "?door open", messages[0].Text)
+	assert.Empty(t, messages[0].ThreadTimestamp)
+
+	assert.Equal(t, ChannelID, messages[1].Channel)
+	assert.Equal(t, messages[0].Timestamp, messages[1].ThreadTimestamp)
+	assert.Equal(t, "?door close", messages[1].Text)
+
+	assert.Equal(t, DMID, messages[2].Channel)
+	assert.Equal(t, "?karma <@U0CONSOLE> &amp; &lt;b&gt;", messages[2].Text)
+
+	assert.True(t, messages[0].Timestamp < messages[1].Timestamp)
+	assert.True(t, strings.HasPrefix(out, "Type a message to send it to #general as @egon, or:\n"))
+	assert.Contains(t, out, "[TS] #general @egon: ?door open\n"+
+		"[TS] #general thread TS @egon: ?door close\n"+
+		"[TS] DM @egon: ?karma <@U0CONSOLE> & <b>\n")
+}
+
+func TestConsole_threadReply(t *testing.T) {
+	c := New(strings.NewReader(""), ioutil.Discard, "egon", "general")
+	go func() {
+		for range c.Events() {
+		}
+	}()
+
+	assert.EqualError(t, c.handleLine(":thread ?door"), "there is no message to reply to yet")
+	require.NoError(t, c.handleLine("?door"))
+	parent := c.lastMessage()
+	require.NoError(t, c.handleLine(":thread ?door open"))
+	var reply string
+	for ts, msg := range c.messages {
+		if msg.threadTS != "" {
+			reply = ts
+		}
+	}
+	require.NotEmpty(t, reply)
+
+	require.NoError(t, c.handleLine(":thread "+reply+" ?door close"))
+	threaded := 0
+	for _, msg := range c.messages {
+		if msg.threadTS == parent {
+			threaded++
+		}
+	}
+	assert.Equal(t, 2, threaded, "replying to a reply stays in the thread")
+}
+
+func TestConsole_editDelete(t *testing.T) {
+	out := &syncBuffer{}
+	c := New(strings.NewReader(""), out, "egon", "general")
+	require.NoError(t, c.handleLine("?door open"))
+	sent := (<-c.Events()).Data.(*slack.MessageEvent)
+
+	require.NoError(t, c.handleLine(":edit "+sent.Timestamp+" ?door close"))
+	edited := (<-c.Events()).Data.(*slack.MessageEvent)
+	assert.Equal(t, "message_changed", edited.SubType)
+	assert.Equal(t, ChannelID, edited.Channel)
+	require.NotNil(t, edited.SubMessage)
+	assert.Equal(t, "?door close", edited.SubMessage.Text)
+	assert.Equal(t, sent.Timestamp, edited.SubMessage.Timestamp)
+	assert.Equal(t, UserID, edited.SubMessage.User)
+	require.NotNil(t, edited.PreviousMessage)
+	assert.Equal(t, "?door open", edited.PreviousMessage.Text)
+
+	require.NoError(t, c.handleLine(":delete "+sent.Timestamp))
+	deleted := (<-c.Events()).Data.(*slack.MessageEvent)
+	assert.Equal(t, "message_deleted", deleted.SubType)
+	assert.Equal(t, sent.Timestamp, deleted.DeletedTimestamp)
+
+	assert.Error(t, c.handleLine(":edit "+sent.Timestamp+" ?door"), "deleted")
+	assert.Error(t, c.handleLine(":delete 1.1"))
+	assert.EqualError(t, c.handleLine(":open"), "unknown console command :open, try :help")
+	assert.Equal(t, "[TS] #general @egon: ?door open\n"+
+		"[TS] #general @egon (edited): ?door close\n"+
+		"[TS] #general @egon deleted their message\n", timestamps.ReplaceAllString(out.String(), "TS"))
+}
+
+func TestConsole_share(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "photo.png")
+	require.NoError(t, ioutil.WriteFile(path, []byte("not really a png"), 0600))
+	c := New(strings.NewReader(""), ioutil.Discard, "egon", "general")
+
+	require.NoError(t, c.handleLine(":share "+path+" ?print"))
+	shared := (<-c.Events()).Data.(*slack.MessageEvent)
+	assert.Equal(t, "file_share", shared.SubType)
+	assert.Equal(t, "?print", shared.Text)
+	require.Len(t, shared.Files, 1)
+	file := shared.Files[0]
+	assert.NotEmpty(t, file.ID)
+	assert.Equal(t, "photo.png", file.Name)
+	assert.Equal(t, "image/png", file.Mimetype)
+	assert.Equal(t, 16, file.Size)
+
+	var b bytes.Buffer
+	require.NoError(t, c.GetFile(file.URLPrivateDownload, &b))
+	assert.Equal(t, "not really a png", b.String())
+
+	assert.Error(t, c.handleLine(":share "+filepath.Join(t.TempDir(), "nothere")))
+	assert.Error(t, c.handleLine(":share"))
+}
+
+func TestConsole_posting(t *testing.T) {
+	out := &syncBuffer{}
+	c := New(strings.NewReader(""), out, "egon", "general")
+
+	msg := c.NewOutgoingMessage("Door is open\nby egon\n", ChannelID, slack.RTMsgOptionTS("1630000001.000100"))
+	c.SendMessage(msg)
+	c.SendMessage(c.NewTypingMessage(ChannelID))
+	ack := (<-c.Events()).Data.(*slack.AckMessage)
+	assert.Equal(t, msg.ID, ack.ReplyTo)
+	assert.NotEmpty(t, ack.Timestamp)
+	assert.Empty(t, c.Events(), "typing isn't acknowledged")
+
+	channel, ts, err := c.PostMessage(ChannelID, slack.MsgOptionText("posted", false))
+	require.NoError(t, err)
+	assert.Equal(t, ChannelID, channel)
+	_, err = c.PostEphemeral(ChannelID, UserID, slack.MsgOptionText("secret", false), slack.MsgOptionTS("1630000001.000100"))
+	require.NoError(t, err)
+	_, _, _, err = c.UpdateMessage(ChannelID, ts, slack.MsgOptionText("updated", false))
+	require.NoError(t, err)
+	_, _, err = c.DeleteMessage(ChannelID, ts)
+	require.NoError(t, err)
+	require.NoError(t, c.AddReaction("eyes", slack.NewRefToMessage(ChannelID, "1630000001.000100")))
+	require.NoError(t, c.RemoveReaction("eyes", slack.NewRefToMessage(ChannelID, "1630000001.000100")))
+	_, err = c.UploadFile(slack.FileUploadParameters{
+		Filename: "door.txt", Title: "Door log", Content: "opened\nclosed\n", Channels: []string{DMID},
+	})
+	require.NoError(t, err)
+	_, _, err = c.PostMessage("C0ELSEWHERE", slack.MsgOptionText("posted", false))
+	assert.EqualError(t, err, "channel_not_found")
+
+	assert.Equal(t, "[TS] #general thread TS smib: Door is open\n    by egon\n"+
+		"[TS] #general smib: posted\n"+
+		"[TS] #general thread TS smib (only visible to @egon): secret\n"+
+		"[TS] #general smib (edited): updated\n"+
+		"[TS] #general smib deleted its message\n"+
+		"[TS] #general smib reacted :eyes:\n"+
+		"[TS] #general smib removed its :eyes: reaction\n"+
+		"[TS] DM smib: uploaded door.txt (14 bytes) titled \"Door log\"\n    ```\n    opened\n    closed\n    ```\n",
+		timestamps.ReplaceAllString(out.String(), "TS"))
+}
+
+func TestConsole_lookups(t *testing.T) {
+	c := New(strings.NewReader(""), ioutil.Discard, "egon", "general")
+
+	user, err := c.GetUserInfo(UserID)
+	require.NoError(t, err)
+	assert.Equal(t, "egon", user.Name)
+	_, err = c.GetUserInfo("U0ELSE")
+	assert.Error(t, err)
+
+	channel, err := c.GetConversationInfo(ChannelID, false)
+	require.NoError(t, err)
+	assert.Equal(t, "general", channel.Name)
+	dm, err := c.GetConversationInfo(DMID, false)
+	require.NoError(t, err)
+	assert.True(t, dm.IsIM)
+
+	im, _, _, err := c.OpenConversation(&slack.OpenConversationParameters{Users: []string{UserID}})
+	require.NoError(t, err)
+	assert.Equal(t, DMID, im.ID)
+
+	users, err := c.GetUsers()
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+	channels, cursor, err := c.GetConversations(&slack.GetConversationsParameters{})
+	require.NoError(t, err)
+	assert.Len(t, channels, 2)
+	assert.Empty(t, cursor)
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"?door open", "?door open"},
+		{"?say <b> & </b>", "?say &lt;b&gt; &amp; &lt;/b&gt;"},
+		{"?karma <@U0CONSOLE>++", "?karma <@U0CONSOLE>++"},
+		{"?where <#C0CONSOLE|general> <!here>", "?where <#C0CONSOLE|general> <!here>"},
+		{"a < b > c", "a &lt; b &gt; c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			assert.Equal(t, tt.want, encode(tt.text))
+		})
+	}
+}
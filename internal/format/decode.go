@@ -0,0 +1,90 @@
+package format
+
+import (
+	"strings"
+)
+
+// Names looks up the names of mentioned users and channels
+type Names interface {
+	UserName(id string) (string, bool)
+	ChannelName(id string) (string, bool)
+}
+
+// Decode converts text sent by slack back to what the user typed. Entities are unescaped, links
+// become their URL, email links their address, and mentions become @name or #channel using names,
+// or the label slack sent if the name isn't known.
+func Decode(text string, names Names) string {
+	var b strings.Builder
+	for len(text) > 0 {
+		i := strings.IndexAny(text, "&<")
+		if i < 0 {
+			b.WriteString(text)
+			break
+		}
+		b.WriteString(text[:i])
+		text = text[i:]
+
+		if text[0] == '&' {
+			if entity := leadingEntity(text); entity != "" {
+				b.WriteString(unescape(entity))
+				text = text[len(entity):]
+				continue
+			}
+		} else if end := strings.IndexByte(text, '>'); end > 0 {
+			b.WriteString(decodeToken(text[1:end], names))
+			text = text[end+1:]
+			continue
+		}
+		b.WriteByte(text[0])
+		text = text[1:]
+	}
+	return b.String()
+}
+
+// unescape unescapes every entity in text
+func unescape(text string) string {
+	return strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">").Replace(text)
+}
+
+// decodeToken returns the text a <token> stands for
+func decodeToken(token string, names Names) string {
+	parts := strings.SplitN(token, "|", 2)
+	target, label := parts[0], ""
+	if len(parts) > 1 {
+		label = Decode(parts[1], names)
+	}
+
+	switch {
+	case strings.HasPrefix(target, "@"):
+		if name, ok := names.UserName(target[1:]); ok {
+			return "@" + name
+		}
+		return "@" + strings.TrimPrefix(firstOf(label, target[1:]), "@")
+	case strings.HasPrefix(target, "#"):
+		if name, ok := names.ChannelName(target[1:]); ok {
+			return "#" + name
+		}
+		return "#" + strings.TrimPrefix(firstOf(label, target[1:]), "#")
+	case strings.HasPrefix(target, "!"):
+		command := strings.SplitN(target[1:], "^", 2)[0]
+		switch command {
+		case "channel", "here", "everyone", "group":
+			return "@" + command
+		}
+		// User groups and dates have a label which is how they were shown
+		return firstOf(label, target)
+	case strings.HasPrefix(target, "mailto:"):
+		return strings.TrimPrefix(target, "mailto:")
+	}
+	return unescape(target)
+}
+
+// firstOf returns the first of values which isn't empty
+func firstOf(values ...string) string {
+	for _, s := range values {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
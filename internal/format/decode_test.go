@@ -0,0 +1,55 @@
+package format
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// names knows one user and one channel
+type names struct{}
+
+func (names) UserName(id string) (string, bool) {
+	if id == "U024BE7LH" {
+		return "egon", true
+	}
+	return "", false
+}
+
+func (names) ChannelName(id string) (string, bool) {
+	if id == "C024BE7LR" {
+		return "general", true
+	}
+	return "", false
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "open the door", "open the door"},
+		{"entities", "a &amp; b &lt;3 &gt;", "a & b <3 >"},
+		{"unknown entity", "&nbsp;", "&nbsp;"},
+		{"user", "tell <@U024BE7LH> hi", "tell @egon hi"},
+		{"labelled user", "<@U024BE7LH|spengler>", "@egon"},
+		{"unknown user", "<@U999|ray>", "@ray"},
+		{"unknown unlabelled user", "<@U999>", "@U999"},
+		{"channel", "<#C024BE7LR>", "#general"},
+		{"unknown channel", "<#C999|random>", "#random"},
+		{"link", "<http://x.com|x.com>", "http://x.com"},
+		{"escaped link", "<https://example.com/?a=1&amp;b=2>", "https://example.com/?a=1&b=2"},
+		{"email", "<mailto:egon@example.com|egon@example.com>", "egon@example.com"},
+		{"special", "<!here> <!channel|channel>", "@here @channel"},
+		{"usergroup", "<!subteam^SAZ94GDB8|@trustees>", "@trustees"},
+		{"date", "<!date^1392734382^{date_short}|Feb 18, 2014>", "Feb 18, 2014"},
+		{"unclosed", "a <b", "a <b"},
+		{"bare greater than", "a > b", "a > b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Decode(tt.text, names{}))
+		})
+	}
+}
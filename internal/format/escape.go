@@ -0,0 +1,92 @@
+package format
+
+import (
+	"strings"
+)
+
+// Allow lists the mentions Sanitise lets through
+type Allow struct {
+	// Special mentions are @channel, @here and @everyone
+	Special bool
+	// Usergroups are mentions of user groups, such as @trustees
+	Usergroups bool
+}
+
+// Sanitise makes text safe to send to slack. User mentions, channel links, URLs and dates are
+// kept, mentions not allowed by allow are escaped so they show as text without notifying anyone,
+// and any other &, < or > is escaped. The entities &amp;, &lt; and &gt; are assumed to be escaped
+// already.
+func Sanitise(text string, allow Allow) string {
+	var b strings.Builder
+	for len(text) > 0 {
+		i := strings.IndexAny(text, "&<>")
+		if i < 0 {
+			b.WriteString(text)
+			break
+		}
+		b.WriteString(text[:i])
+		text = text[i:]
+
+		switch text[0] {
+		case '&':
+			if entity := leadingEntity(text); entity != "" {
+				b.WriteString(entity)
+				text = text[len(entity):]
+				continue
+			}
+		case '<':
+			if end := strings.IndexAny(text[1:], "<>"); end >= 0 && text[1+end] == '>' {
+				token := text[:end+2]
+				if keepToken(token[1:len(token)-1], allow) {
+					b.WriteString(token)
+					text = text[len(token):]
+					continue
+				}
+			}
+		}
+		b.WriteString(Escape(text[:1]))
+		text = text[1:]
+	}
+	return b.String()
+}
+
+// Escape escapes every &, < and > in text, so none of it is treated as a mention or link
+func Escape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// leadingEntity returns the escaped entity text starts with, if any
+func leadingEntity(text string) string {
+	for _, entity := range []string{"&amp;", "&lt;", "&gt;"} {
+		if strings.HasPrefix(text, entity) {
+			return entity
+		}
+	}
+	return ""
+}
+
+// keepToken reports whether the <token> should be sent as it is
+func keepToken(token string, allow Allow) bool {
+	target := strings.SplitN(token, "|", 2)[0]
+	switch {
+	case target == "":
+		return false
+	case target[0] == '@', target[0] == '#':
+		// Users and channels
+		return len(target) > 1
+	case target[0] == '!':
+		command := strings.SplitN(target[1:], "^", 2)[0]
+		switch command {
+		case "channel", "here", "everyone", "group":
+			return allow.Special
+		case "subteam":
+			return allow.Usergroups
+		case "date":
+			return true
+		}
+		return false
+	}
+	// Links, which must have a scheme such as https: or mailto:
+	scheme := strings.SplitN(target, ":", 2)
+	return len(scheme) == 2 && scheme[0] != "" && !strings.ContainsAny(scheme[0], " \t") && scheme[1] != ""
+}
@@ -0,0 +1,50 @@
+package format
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitise(t *testing.T) {
+	all := Allow{Special: true, Usergroups: true}
+	tests := []struct {
+		name  string
+		text  string
+		allow Allow
+		want  string
+	}{
+		{"plain", "the door is open\n", Allow{}, "the door is open\n"},
+		{"user mention", "<@U024BE7LH>, the door is open", Allow{}, "<@U024BE7LH>, the door is open"},
+		{"labelled user mention", "<@U024BE7LH|egon> opened it", Allow{}, "<@U024BE7LH|egon> opened it"},
+		{"channel link", "see <#C024BE7LR|general>", Allow{}, "see <#C024BE7LR|general>"},
+		{"link", "<https://example.com/webcam.jpg|webcam>", Allow{}, "<https://example.com/webcam.jpg|webcam>"},
+		{"mailto", "<mailto:trustees@example.com>", Allow{}, "<mailto:trustees@example.com>"},
+		{"date", "<!date^1392734382^{date_short}|Feb 18, 2014>", Allow{}, "<!date^1392734382^{date_short}|Feb 18, 2014>"},
+		{"channel", "<!channel> the door is open", Allow{}, "&lt;!channel&gt; the door is open"},
+		{"here", "<!here|here>", Allow{}, "&lt;!here|here&gt;"},
+		{"everyone", "<!everyone>", Allow{}, "&lt;!everyone&gt;"},
+		{"special allowed", "<!channel> <!here> <!everyone>", Allow{Special: true}, "<!channel> <!here> <!everyone>"},
+		{"usergroup allowed", "<!subteam^SAZ94GDB8|@trustees>", Allow{Special: true, Usergroups: true}, "<!subteam^SAZ94GDB8|@trustees>"},
+		{"usergroup blocked", "<!subteam^SAZ94GDB8|@trustees>", Allow{Special: true}, "&lt;!subteam^SAZ94GDB8|@trustees&gt;"},
+		{"unknown command", "<!bees>", all, "&lt;!bees&gt;"},
+		{"comparison", "1 < 2 && 3 > 2", Allow{}, "1 &lt; 2 &amp;&amp; 3 &gt; 2"},
+		{"html", "<b>bold</b>", all, "&lt;b&gt;bold&lt;/b&gt;"},
+		{"empty brackets", "<>", all, "&lt;&gt;"},
+		{"arrow", "<- back", Allow{}, "&lt;- back"},
+		{"nested", "<<!channel>>", Allow{}, "&lt;&lt;!channel&gt;&gt;"},
+		{"not a scheme", "<a b:c>", all, "&lt;a b:c&gt;"},
+		{"already escaped", "fish &amp; chips &lt;3", Allow{}, "fish &amp; chips &lt;3"},
+		{"unknown entity", "&nbsp;", Allow{}, "&amp;nbsp;"},
+		{"unclosed", "<@U024BE7LH", Allow{}, "&lt;@U024BE7LH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Sanitise(tt.text, tt.allow))
+		})
+	}
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, "&lt;!channel&gt; &amp;", Escape("<!channel> &"))
+}
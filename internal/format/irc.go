@@ -0,0 +1,204 @@
+// Package format converts text between commands and slack's mrkdwn.
+package format
+
+import (
+	"strings"
+	"unicode"
+)
+
+// IRC formatting control codes
+const (
+	ircBold          = '\x02'
+	ircColour        = '\x03'
+	ircHexColour     = '\x04'
+	ircReset         = '\x0f'
+	ircMonospace     = '\x11'
+	ircReverse       = '\x16'
+	ircItalic        = '\x1d'
+	ircStrikethrough = '\x1e'
+	ircUnderline     = '\x1f'
+	ctcpDelimiter    = '\x01'
+)
+
+// ircStyles maps IRC formatting codes to mrkdwn markers. Slack has no underline, so underline is
+// treated as another italic code.
+var ircStyles = map[rune]string{
+	ircBold:          "*",
+	ircItalic:        "_",
+	ircUnderline:     "_",
+	ircStrikethrough: "~",
+	ircMonospace:     "`",
+}
+
+// IRC converts a line of output written for the IRC smib to mrkdwn. Bold, italic, underline,
+// strikethrough and monospace become mrkdwn, colours are removed and "/me waves" or a CTCP ACTION
+// becomes an italic action line. A trailing newline is kept.
+func IRC(line string) string {
+	text := strings.TrimSuffix(line, "\n")
+	newline := line[len(text):]
+
+	if action, ok := ircAction(text); ok {
+		text = stripIRC(action)
+		if strings.TrimSpace(text) == "" {
+			return line
+		}
+		return "_" + strings.TrimSpace(text) + "_" + newline
+	}
+	return convertIRC(text) + newline
+}
+
+// ircAction returns the action in text if it is one
+func ircAction(text string) (string, bool) {
+	if strings.HasPrefix(text, "/me ") {
+		return strings.TrimPrefix(text, "/me "), true
+	}
+	const ctcpAction = string(ctcpDelimiter) + "ACTION "
+	if strings.HasPrefix(text, ctcpAction) {
+		return strings.TrimSuffix(strings.TrimPrefix(text, ctcpAction), string(ctcpDelimiter)), true
+	}
+	return "", false
+}
+
+// stripIRC removes all IRC formatting from text
+func stripIRC(text string) string {
+	var b strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == ircColour:
+			i += colourLength(runes[i+1:], isDigit, 2)
+		case r == ircHexColour:
+			i += colourLength(runes[i+1:], isHexDigit, 6)
+		case isIRCControl(r):
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// convertIRC replaces the IRC formatting in text with mrkdwn
+func convertIRC(text string) string {
+	var f ircFormatter
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == ircColour:
+			i += colourLength(runes[i+1:], isDigit, 2)
+		case r == ircHexColour:
+			i += colourLength(runes[i+1:], isHexDigit, 6)
+		case r == ircReset:
+			f.reset()
+		case ircStyles[r] != "":
+			f.toggle(ircStyles[r])
+		case isIRCControl(r):
+		default:
+			f.write(r)
+		}
+	}
+	f.reset()
+	return f.out.String()
+}
+
+// ircFormatter writes text with mrkdwn markers. mrkdwn markers only work against non-space
+// characters, so opening markers wait for the next visible character and closing markers go
+// before trailing spaces.
+type ircFormatter struct {
+	out strings.Builder
+	// open are the markers in effect, in the order they were opened
+	open []string
+	// pending markers have been opened but not yet written
+	pending []string
+}
+
+// toggle opens marker, or closes it if it is open
+func (f *ircFormatter) toggle(marker string) {
+	for i, m := range f.pending {
+		if m == marker {
+			// Nothing was formatted
+			f.pending = append(f.pending[:i], f.pending[i+1:]...)
+			return
+		}
+	}
+	for i, m := range f.open {
+		if m == marker {
+			// Close the markers opened since, then reopen them
+			reopen := append([]string{}, f.open[i+1:]...)
+			f.close(f.open[i:])
+			f.open = f.open[:i]
+			f.pending = append(reopen, f.pending...)
+			return
+		}
+	}
+	f.pending = append(f.pending, marker)
+}
+
+// reset closes every marker
+func (f *ircFormatter) reset() {
+	f.pending = nil
+	f.close(f.open)
+	f.open = nil
+}
+
+// close writes the closing markers for markers, innermost first, before any trailing spaces
+func (f *ircFormatter) close(markers []string) {
+	if len(markers) == 0 {
+		return
+	}
+	written := f.out.String()
+	text := strings.TrimRightFunc(written, unicode.IsSpace)
+	var closing strings.Builder
+	for i := len(markers) - 1; i >= 0; i-- {
+		closing.WriteString(markers[i])
+	}
+	f.out.Reset()
+	f.out.WriteString(text + closing.String() + written[len(text):])
+}
+
+// write writes r, first opening any pending markers if r is visible
+func (f *ircFormatter) write(r rune) {
+	if len(f.pending) > 0 && !unicode.IsSpace(r) {
+		for _, m := range f.pending {
+			f.out.WriteString(m)
+		}
+		f.open = append(f.open, f.pending...)
+		f.pending = nil
+	}
+	f.out.WriteRune(r)
+}
+
+// colourLength returns how many of runes are the foreground and background of a colour code
+func colourLength(runes []rune, valid func(rune) bool, max int) int {
+	n := countPrefix(runes, valid, max)
+	if n > 0 && n < len(runes) && runes[n] == ',' {
+		if bg := countPrefix(runes[n+1:], valid, max); bg > 0 {
+			n += 1 + bg
+		}
+	}
+	return n
+}
+
+// countPrefix returns how many of the first max runes are valid
+func countPrefix(runes []rune, valid func(rune) bool, max int) int {
+	n := 0
+	for n < len(runes) && n < max && valid(runes[n]) {
+		n++
+	}
+	return n
+}
+
+func isDigit(r rune) bool { return r >= '0' && r <= '9' }
+
+func isHexDigit(r rune) bool {
+	return isDigit(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+// isIRCControl reports whether r is a formatting code with no mrkdwn equivalent
+func isIRCControl(r rune) bool {
+	switch r {
+	case ircBold, ircColour, ircHexColour, ircReset, ircMonospace, ircReverse, ircItalic,
+		ircStrikethrough, ircUnderline, ctcpDelimiter:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package format
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIRC(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"plain", "the door is open\n", "the door is open\n"},
+		{"no newline", "the door is open", "the door is open"},
+		{"bold", "the door is \x02open\x02\n", "the door is *open*\n"},
+		{"italic", "\x1dmaybe\x1d\n", "_maybe_\n"},
+		{"underline", "\x1fimportant\x1f", "_important_"},
+		{"strikethrough", "\x1eclosed\x1e open", "~closed~ open"},
+		{"monospace", "run \x11?door\x11", "run `?door`"},
+		{"unclosed", "\x02open", "*open*"},
+		{"reset", "\x02\x1dopen\x0f now", "*_open_* now"},
+		{"nested", "\x02bold \x1dboth\x1d\x02", "*bold _both_*"},
+		{"overlapping", "\x02bold \x1dboth\x02 italic\x1d", "*bold _both_* _italic_"},
+		{"spaces inside markers", "door \x02 open \x02 now", "door  *open*  now"},
+		{"empty", "\x02\x02nothing", "nothing"},
+		{"colour", "\x034red\x03 and \x0304,12blue\x03", "red and blue"},
+		{"colour before digits", "\x0304,1234", "34"},
+		{"colour without background", "\x033,cats", ",cats"},
+		{"hex colour", "\x04FF0000red\x04", "red"},
+		{"reverse", "\x16inverted\x16", "inverted"},
+		{"bold colour", "\x02\x033open\x03\x02", "*open*"},
+		{"action", "/me waves\n", "_waves_\n"},
+		{"formatted action", "/me \x02waves\x02 at \x034you", "_waves at you_"},
+		{"ctcp action", "\x01ACTION waves\x01\n", "_waves_\n"},
+		{"empty action", "/me \n", "/me \n"},
+		{"me mid line", "tell them /me waves", "tell them /me waves"},
+		{"unicode", "\x02café\x02 ☕", "*café* ☕"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IRC(tt.line))
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Package metrics holds the prometheus metrics exported by SMIB.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Command outcomes used for the outcome label of CommandsRun
+const (
+	OutcomeOK        = "ok"
+	OutcomeFailed    = "failed"
+	OutcomeNotFound  = "not_found"
+	OutcomeNotUnique = "not_unique"
+	OutcomeError     = "error"
+)
+
+// Cache lookup results used for the result label of CacheLookups
+const (
+	CacheHit      = "hit"
+	CacheMiss     = "miss"
+	CacheStale    = "stale"
+	CacheNegative = "negative"
+)
+
+var (
+	// Connected is 1 while SMIB is connected to slack.
+	Connected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smib_connected",
+		Help: "Whether SMIB is currently connected to slack.",
+	})
+
+	// Connects counts every successful connection to slack, anything over 1 is a reconnect.
+	Connects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smib_connects_total",
+		Help: "Number of times SMIB has connected to slack.",
+	})
+
+	// Disconnects counts disconnections from slack.
+	Disconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smib_disconnects_total",
+		Help: "Number of times SMIB has been disconnected from slack.",
+	})
+
+	// EventsReceived counts incoming slack events by type.
+	EventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smib_events_received_total",
+		Help: "Number of events received from slack, by event type.",
+	}, []string{"type"})
+
+	// MessagesIgnored counts messages which were not considered as commands, by reason.
+	MessagesIgnored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smib_messages_ignored_total",
+		Help: "Number of messages ignored because of who sent them or their subtype, by reason.",
+	}, []string{"reason"})
+
+	// CommandsRun counts command invocations by command name and outcome. The command
+	// label is empty when the command could not be resolved.
+	CommandsRun = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smib_commands_total",
+		Help: "Number of commands run, by command and outcome.",
+	}, []string{"command", "outcome"})
+
+	// CommandDuration observes how long commands took to run to completion.
+	CommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "smib_command_duration_seconds",
+		Help:    "Time taken for commands to exit, by command.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"command"})
+
+	// OutputLines counts lines of command output sent to slack.
+	OutputLines = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smib_output_lines_total",
+		Help: "Number of lines of command output sent to slack.",
+	})
+
+	// MessagesRetried counts messages sent again because slack refused them or didn't acknowledge
+	// them.
+	MessagesRetried = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smib_messages_retried_total",
+		Help: "Number of times a message to slack was retried.",
+	})
+
+	// MessagesFailed counts messages which were given up on after every retry failed.
+	MessagesFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smib_messages_failed_total",
+		Help: "Number of messages to slack which could not be delivered.",
+	})
+
+	// OutgoingQueueDepth is the number of messages and other calls waiting in the outbox.
+	OutgoingQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smib_outgoing_queue_depth",
+		Help: "Number of outgoing messages, edits and deletes waiting to be sent to slack.",
+	})
+
+	// RateLimited counts the times slack told SMIB to slow down.
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smib_rate_limited_total",
+		Help: "Number of times slack rate limited SMIB.",
+	})
+
+	// CacheLookups counts user and conversation lookups by cache and result. Misses and stale
+	// results are the ones which called the slack API.
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smib_cache_lookups_total",
+		Help: "Number of user and conversation lookups, by cache and result.",
+	}, []string{"cache", "result"})
+)
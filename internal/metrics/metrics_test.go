@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	EventsReceived.WithLabelValues("message").Inc()
+	CommandsRun.WithLabelValues("ping", OutcomeOK).Inc()
+	CommandDuration.WithLabelValues("ping").Observe(0.2)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(EventsReceived.WithLabelValues("message")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(CommandsRun.WithLabelValues("ping", OutcomeOK)))
+	histogram := &dto.Metric{}
+	require.NoError(t, CommandDuration.WithLabelValues("ping").(prometheus.Histogram).Write(histogram))
+	assert.Equal(t, uint64(1), histogram.GetHistogram().GetSampleCount())
+
+	for _, name := range []string{
+		"smib_events_received_total",
+		"smib_commands_total",
+		"smib_command_duration_seconds",
+	} {
+		count, err := testutil.GatherAndCount(prometheus.DefaultGatherer, name)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count, "%s is registered", name)
+	}
+}
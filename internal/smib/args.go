@@ -0,0 +1,69 @@
+package smib
+
+import (
+	"encoding/json"
+
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/format"
+)
+
+// commandArgs returns the args to pass to a command with manifest, and the extra values passed
+// with them. The raw args are always passed in the environment. An error is returned if the
+// command wants argv and the args can't be split into words, or a command.UsageError if they
+// don't match its params.
+func (s *SMIB) commandArgs(raw string, manifest command.Manifest) (string, command.Extra, error) {
+	args := raw
+	var decode func(string) string
+	if manifest.DecodeArgs {
+		decode = func(text string) string { return format.Decode(text, cachedNames{s}) }
+		args = decode(raw)
+	}
+	extra := command.Extra{Env: []string{command.RawArgsEnv + "=" + raw}}
+
+	if manifest.Argv {
+		words, err := command.SplitArgs(args)
+		if err != nil {
+			return "", command.Extra{}, err
+		}
+		if words == nil {
+			words = []string{}
+		}
+		argv, err := json.Marshal(words)
+		if err != nil {
+			return "", command.Extra{}, err
+		}
+		extra.Env = append(extra.Env, command.ArgvEnv+"="+string(argv))
+		extra.Args = words
+	}
+
+	if len(manifest.Params) > 0 {
+		// Params are checked against the raw args so users and channels can be recognised
+		env, err := manifest.ParseParams(raw, decode)
+		if err != nil {
+			return "", command.Extra{}, err
+		}
+		extra.Env = append(extra.Env, env...)
+	}
+	return args, extra, nil
+}
+
+// cachedNames looks up the names of mentioned users and channels for format.Decode
+type cachedNames struct {
+	s *SMIB
+}
+
+func (n cachedNames) UserName(id string) (string, bool) {
+	user, err := n.s.getUser(id)
+	if err != nil {
+		return "", false
+	}
+	return user.Name, true
+}
+
+func (n cachedNames) ChannelName(id string) (string, bool) {
+	channel, err := n.s.getConversation(id)
+	if err != nil || channel.Name == "" {
+		return "", false
+	}
+	return channel.Name, true
+}
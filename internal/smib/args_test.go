@@ -0,0 +1,222 @@
+package smib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMIB_run_decodeArgs(t *testing.T) {
+	const raw = "<@U024BE7LH> &amp; <#C024BE7LR> <http://x.com|x.com>"
+	tests := []struct {
+		name     string
+		manifest command.Manifest
+		want     string
+	}{
+		{
+			name: "raw by default",
+			want: raw,
+		},
+		{
+			name:     "decoded",
+			manifest: command.Manifest{DecodeArgs: true},
+			want:     "@spengler & #general http://x.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCmd := &mockCommand{manifests: map[string]command.Manifest{"wiki": tt.manifest}}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			mockCmd.On("Run", mock.Anything, "wiki", mock.Anything, mock.Anything, mock.Anything, mock.Anything, tt.want).
+				Return(output(""), nil).Once()
+			smib := SMIB{slack: &reactionTransport{}, cmd: mockCmd}
+
+			_, err := smib.run(context.Background(), invocation{cmd: "wiki", args: raw, user: "Xspengler", channel: "Xgeneral"}, func(string, bool) {})
+			require.NoError(t, err)
+			assert.Equal(t, []command.Extra{{Env: []string{"SMIB_RAW_ARGS=" + raw}}}, mockCmd.extras)
+		})
+	}
+}
+
+func TestSMIB_run_argv(t *testing.T) {
+	tests := []struct {
+		name      string
+		manifest  command.Manifest
+		args      string
+		wantArgs  string
+		wantExtra []command.Extra
+		wantReply string
+	}{
+		{
+			name:      "not split by default",
+			args:      `open "front door"`,
+			wantArgs:  `open "front door"`,
+			wantExtra: []command.Extra{{Env: []string{`SMIB_RAW_ARGS=open "front door"`}}},
+		},
+		{
+			name:     "split",
+			manifest: command.Manifest{Argv: true},
+			args:     "open “front door”",
+			wantArgs: "open “front door”",
+			wantExtra: []command.Extra{{
+				Env:  []string{"SMIB_RAW_ARGS=open “front door”", `SMIB_ARGV=["open","front door"]`},
+				Args: []string{"open", "front door"},
+			}},
+		},
+		{
+			name:     "no args",
+			manifest: command.Manifest{Argv: true},
+			wantExtra: []command.Extra{{
+				Env:  []string{"SMIB_RAW_ARGS=", "SMIB_ARGV=[]"},
+				Args: []string{},
+			}},
+		},
+		{
+			name:     "split after decoding",
+			manifest: command.Manifest{Argv: true, DecodeArgs: true},
+			args:     "<@U024BE7LH> 'fish &amp; chips'",
+			wantArgs: "@spengler 'fish & chips'",
+			wantExtra: []command.Extra{{
+				Env:  []string{"SMIB_RAW_ARGS=<@U024BE7LH> 'fish &amp; chips'", `SMIB_ARGV=["@spengler","fish \u0026 chips"]`},
+				Args: []string{"@spengler", "fish & chips"},
+			}},
+		},
+		{
+			name:      "unbalanced quote",
+			manifest:  command.Manifest{Argv: true},
+			args:      `open "front door`,
+			wantReply: `Sorry <@Xspengler>, I couldn't read your args for door, a quote was never closed. Put args with spaces in quotes, like "front door".`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCmd := &mockCommand{manifests: map[string]command.Manifest{"door": tt.manifest}}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			if tt.wantReply == "" {
+				mockCmd.On("Run", mock.Anything, "door", mock.Anything, mock.Anything, mock.Anything, mock.Anything, tt.wantArgs).
+					Return(output(""), nil).Once()
+			}
+			smib := SMIB{slack: &reactionTransport{}, cmd: mockCmd}
+
+			var replies []string
+			var private bool
+			ok, err := smib.run(context.Background(), invocation{cmd: "door", args: tt.args, user: "Xspengler", channel: "Xgeneral"}, func(text string, p bool) {
+				replies = append(replies, text)
+				private = p
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantExtra, mockCmd.extras)
+			if tt.wantReply != "" {
+				assert.False(t, ok)
+				assert.True(t, private)
+				assert.Equal(t, []string{tt.wantReply}, replies)
+			} else {
+				assert.Empty(t, replies)
+			}
+		})
+	}
+}
+
+func TestSMIB_run_params(t *testing.T) {
+	manifest := command.Manifest{Params: []command.Param{
+		{Name: "who", Type: command.ParamUser, Required: true},
+		{Name: "minutes", Type: command.ParamDuration, Default: "5m"},
+		{Name: "message", Type: command.ParamText},
+	}}
+	tests := []struct {
+		name      string
+		decode    bool
+		argv      bool
+		args      string
+		wantEnv   []string
+		wantReply string
+	}{
+		{
+			name: "valid",
+			args: `<@U024BE7LH|spengler> 1h "fish &amp; chips"`,
+			wantEnv: []string{
+				`SMIB_RAW_ARGS=<@U024BE7LH|spengler> 1h "fish &amp; chips"`,
+				"SMIB_ARG_WHO=<@U024BE7LH>", "SMIB_ARG_MINUTES=3600", "SMIB_ARG_MESSAGE=fish &amp; chips",
+			},
+		},
+		{
+			name:   "decoded",
+			decode: true,
+			args:   `<@U024BE7LH|spengler> 1h fish &amp; chips`,
+			wantEnv: []string{
+				`SMIB_RAW_ARGS=<@U024BE7LH|spengler> 1h fish &amp; chips`,
+				"SMIB_ARG_WHO=<@U024BE7LH>", "SMIB_ARG_MINUTES=3600", "SMIB_ARG_MESSAGE=fish & chips",
+			},
+		},
+		{
+			name: "defaults",
+			args: "<@U024BE7LH>",
+			wantEnv: []string{
+				"SMIB_RAW_ARGS=<@U024BE7LH>",
+				"SMIB_ARG_WHO=<@U024BE7LH>", "SMIB_ARG_MINUTES=300", "SMIB_ARG_MESSAGE=",
+			},
+		},
+		{
+			name:      "missing",
+			wantReply: "Sorry <@Xspengler>, who is missing. Usage: `timer &lt;who:user&gt; [minutes:duration] [message]`",
+		},
+		{
+			name:      "invalid",
+			args:      "<@U024BE7LH> soon",
+			wantReply: "Sorry <@Xspengler>, minutes must be a length of time like 90s or 1h30m. Usage: `timer &lt;who:user&gt; [minutes:duration] [message]`",
+		},
+		{
+			name: "apostrophe",
+			args: "<@U024BE7LH> 1h don't  forget",
+			wantEnv: []string{
+				"SMIB_RAW_ARGS=<@U024BE7LH> 1h don't  forget",
+				"SMIB_ARG_WHO=<@U024BE7LH>", "SMIB_ARG_MINUTES=3600", "SMIB_ARG_MESSAGE=don't  forget",
+			},
+		},
+		{
+			name:      "unbalanced quote with argv",
+			argv:      true,
+			args:      `<@U024BE7LH> 1h "fish`,
+			wantReply: `Sorry <@Xspengler>, I couldn't read your args for tim, a quote was never closed. Put args with spaces in quotes, like "front door".`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := manifest
+			manifest.DecodeArgs = tt.decode
+			manifest.Argv = tt.argv
+			mockCmd := &mockCommand{manifests: map[string]command.Manifest{"tim": manifest}}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			if tt.wantReply == "" {
+				mockCmd.On("Run", mock.Anything, "tim", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+					Return(output(""), nil).Once()
+			} else {
+				mockCmd.On("Resolve", "tim").Return("timer", nil).Maybe()
+			}
+			smib := SMIB{slack: &reactionTransport{}, cmd: mockCmd}
+
+			var replies []string
+			ok, err := smib.run(context.Background(), invocation{cmd: "tim", args: tt.args, user: "Xspengler", channel: "Xgeneral"}, func(text string, private bool) {
+				assert.True(t, private)
+				replies = append(replies, text)
+			})
+			require.NoError(t, err)
+			if tt.wantReply != "" {
+				assert.False(t, ok)
+				assert.Equal(t, []string{tt.wantReply}, replies)
+				assert.Empty(t, mockCmd.extras)
+				return
+			}
+			assert.Empty(t, replies)
+			require.Len(t, mockCmd.extras, 1)
+			assert.Equal(t, tt.wantEnv, mockCmd.extras[0].Env)
+		})
+	}
+}
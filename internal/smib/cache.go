@@ -0,0 +1,198 @@
+package smib
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/metrics"
+)
+
+var (
+	// cacheTTL is how long looked up users and conversations are trusted, changes slack tells us
+	// about with events are applied straight away.
+	cacheTTL = time.Hour
+	// negativeCacheTTL is how long a failed lookup is remembered before slack is asked again.
+	negativeCacheTTL = time.Minute
+)
+
+// cache is a concurrency safe cache of slack lookups, the zero value is ready to use. When a
+// lookup fails an expired entry is used in preference to the error.
+type cache struct {
+	name string
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	warmed  time.Time
+}
+
+// cachedError is a failed lookup returned from the cache rather than from slack, callers which log
+// failures needn't log it again
+type cachedError struct {
+	error
+}
+
+func (e cachedError) Unwrap() error { return e.error }
+
+type cacheEntry struct {
+	value interface{}
+	// err is set for failed lookups, value may still hold a stale result
+	err     error
+	expires time.Time
+}
+
+// get returns the value for key, calling fetch if there is no unexpired entry. Fetch is not
+// called with the cache locked so concurrent misses for one key may both call it.
+func (c *cache) get(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		if entry.value == nil {
+			metrics.CacheLookups.WithLabelValues(c.name, metrics.CacheNegative).Inc()
+			return nil, cachedError{entry.err}
+		}
+		metrics.CacheLookups.WithLabelValues(c.name, metrics.CacheHit).Inc()
+		return entry.value, nil
+	}
+
+	value, err := fetch()
+	if err == nil {
+		metrics.CacheLookups.WithLabelValues(c.name, metrics.CacheMiss).Inc()
+		c.set(key, value)
+		return value, nil
+	}
+
+	if ok && entry.value != nil {
+		// Slack is having a bad time, keep using what we had and ask again later
+		metrics.CacheLookups.WithLabelValues(c.name, metrics.CacheStale).Inc()
+		c.store(key, cacheEntry{value: entry.value, err: err, expires: time.Now().Add(negativeCacheTTL)})
+		return entry.value, nil
+	}
+	metrics.CacheLookups.WithLabelValues(c.name, metrics.CacheMiss).Inc()
+	c.store(key, cacheEntry{err: err, expires: time.Now().Add(negativeCacheTTL)})
+	return nil, err
+}
+
+// set caches value for key
+func (c *cache) set(key string, value interface{}) {
+	c.store(key, cacheEntry{value: value, expires: time.Now().Add(cacheTTL)})
+}
+
+// seed caches value for key unless there is already an unexpired entry, which may be more complete
+func (c *cache) seed(key string, value interface{}) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && entry.value != nil && time.Now().Before(entry.expires) {
+		return
+	}
+	c.set(key, value)
+}
+
+// invalidate forgets key so the next get looks it up again
+func (c *cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// needsWarming reports whether the cache was last filled in bulk more than cacheTTL ago, and if so
+// records that it is being filled now.
+func (c *cache) needsWarming() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.warmed) < cacheTTL {
+		return false
+	}
+	c.warmed = time.Now()
+	return true
+}
+
+func (c *cache) store(key string, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]cacheEntry{}
+	}
+	c.entries[key] = entry
+}
+
+// getUser looks up a slack user by ID
+func (s *SMIB) getUser(id string) (*slack.User, error) {
+	user, err := s.users.get(id, func() (interface{}, error) {
+		user, err := s.slack.GetUserInfo(id)
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user.(*slack.User), nil
+}
+
+// getConversation looks up a slack conversation by ID
+func (s *SMIB) getConversation(id string) (*slack.Channel, error) {
+	channel, err := s.conversations.get(id, func() (interface{}, error) {
+		channel, err := s.slack.GetConversationInfo(id, false)
+		if err != nil {
+			return nil, err
+		}
+		return channel, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return channel.(*slack.Channel), nil
+}
+
+// seedSelf caches SMIB's own user from the info slack sends when it connects, which describes
+// only SMIB and its team. It doesn't replace a user already looked up, which has the full profile.
+func (s *SMIB) seedSelf(info *slack.Info) {
+	self := &slack.User{ID: info.User.ID, Name: info.User.Name}
+	if info.Team != nil {
+		self.TeamID = info.Team.ID
+	}
+	s.users.seed(self.ID, self)
+}
+
+// warmCaches fills the user and conversation caches in bulk, so the first command from each user
+// or in each channel doesn't have to wait for a lookup. It does nothing if the caches were filled
+// within cacheTTL, so reconnects don't use up our rate limit. It is only used with ListWorkspace.
+func (s *SMIB) warmCaches() {
+	if s.users.needsWarming() {
+		users, err := s.slack.GetUsers()
+		if err != nil {
+			log.Print("Failed to list users: ", err)
+		}
+		for i := range users {
+			s.users.set(users[i].ID, &users[i])
+		}
+	}
+
+	if s.conversations.needsWarming() {
+		params := &slack.GetConversationsParameters{
+			ExcludeArchived: "true",
+			Limit:           1000,
+			Types:           []string{"public_channel", "private_channel", "mpim", "im"},
+		}
+		for {
+			channels, cursor, err := s.slack.GetConversations(params)
+			if err != nil {
+				log.Print("Failed to list conversations: ", err)
+				return
+			}
+			for i := range channels {
+				s.conversations.set(channels[i].ID, &channels[i])
+			}
+			if cursor == "" {
+				return
+			}
+			params.Cursor = cursor
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package smib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/nlopes/slack/slacktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fetcher counts calls to a lookup and returns whatever it is told to
+type fetcher struct {
+	calls int
+	value interface{}
+	err   error
+}
+
+func (f *fetcher) fetch() (interface{}, error) {
+	f.calls++
+	return f.value, f.err
+}
+
+func shortCacheTTLs(t *testing.T) {
+	ttl, negativeTTL := cacheTTL, negativeCacheTTL
+	t.Cleanup(func() { cacheTTL, negativeCacheTTL = ttl, negativeTTL })
+	cacheTTL, negativeCacheTTL = 20*time.Millisecond, 20*time.Millisecond
+}
+
+func TestCache_get(t *testing.T) {
+	shortCacheTTLs(t)
+	c := cache{}
+	f := &fetcher{value: "egon"}
+
+	got, err := c.get("Xegon", f.fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "egon", got)
+	got, err = c.get("Xegon", f.fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "egon", got)
+	assert.Equal(t, 1, f.calls, "second lookup should be cached")
+
+	time.Sleep(cacheTTL)
+	f.value = "egon spengler"
+	got, err = c.get("Xegon", f.fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "egon spengler", got)
+	assert.Equal(t, 2, f.calls, "expired entry should be looked up again")
+}
+
+func TestCache_get_stale(t *testing.T) {
+	shortCacheTTLs(t)
+	c := cache{}
+	f := &fetcher{value: "egon"}
+
+	_, err := c.get("Xegon", f.fetch)
+	require.NoError(t, err)
+	time.Sleep(cacheTTL)
+
+	f.value, f.err = nil, errors.New("ratelimited")
+	got, err := c.get("Xegon", f.fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "egon", got, "stale entry should be used when the lookup fails")
+	got, err = c.get("Xegon", f.fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "egon", got)
+	assert.Equal(t, 2, f.calls, "failed lookup should not be retried straight away")
+
+	time.Sleep(negativeCacheTTL)
+	f.value, f.err = "egon spengler", nil
+	got, err = c.get("Xegon", f.fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "egon spengler", got)
+	assert.Equal(t, 3, f.calls)
+}
+
+func TestCache_get_negative(t *testing.T) {
+	shortCacheTTLs(t)
+	c := cache{}
+	f := &fetcher{err: errors.New("user_not_found")}
+
+	_, err := c.get("Xslimer", f.fetch)
+	assert.EqualError(t, err, "user_not_found")
+	_, err = c.get("Xslimer", f.fetch)
+	assert.EqualError(t, err, "user_not_found")
+	assert.Equal(t, 1, f.calls, "failed lookup should be cached")
+
+	time.Sleep(negativeCacheTTL)
+	f.value, f.err = "slimer", nil
+	got, err := c.get("Xslimer", f.fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "slimer", got)
+	assert.Equal(t, 2, f.calls)
+}
+
+func TestCache_invalidate(t *testing.T) {
+	c := cache{}
+	f := &fetcher{value: "ecto-1"}
+
+	c.set("Xcar", "ecto-0")
+	c.invalidate("Xcar")
+	got, err := c.get("Xcar", f.fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "ecto-1", got)
+	assert.Equal(t, 1, f.calls)
+}
+
+func TestCache_seed(t *testing.T) {
+	c := cache{}
+	c.seed("U1", "partial")
+	value, err := c.get("U1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "partial", value)
+
+	c.set("U1", "full")
+	c.seed("U1", "partial")
+	value, err = c.get("U1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "full", value, "seed doesn't replace a looked up value")
+}
+
+func TestCache_needsWarming(t *testing.T) {
+	shortCacheTTLs(t)
+	c := cache{}
+	assert.True(t, c.needsWarming())
+	assert.False(t, c.needsWarming())
+	time.Sleep(cacheTTL)
+	assert.True(t, c.needsWarming())
+}
+
+func TestSMIB_warmCaches(t *testing.T) {
+	testServer := slacktest.NewTestServer()
+	testServer.Handle("/users.list", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"members":[{"id":"Xspengler","name":"spengler"},{"id":"Xvenkman","name":"venkman"}]}`))
+	})
+	testServer.Handle("/conversations.list", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		if r.Form.Get("cursor") == "" {
+			w.Write([]byte(`{"ok":true,"channels":[{"id":"Xgeneral","name":"general"}],"response_metadata":{"next_cursor":"page2"}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"channels":[{"id":"Xcontainment","name":"containment","is_private":true}]}`))
+	})
+	testServer.Start()
+	defer testServer.Stop()
+
+	smib := SMIB{slack: rtmTransport{testServer.GetTestRTMInstance()}}
+	smib.warmCaches()
+
+	fail := func() (interface{}, error) { return nil, errors.New("should have been cached") }
+	user, err := smib.users.get("Xvenkman", fail)
+	require.NoError(t, err)
+	assert.Equal(t, "venkman", user.(*slack.User).Name)
+	channel, err := smib.conversations.get("Xcontainment", fail)
+	require.NoError(t, err)
+	assert.Equal(t, "containment", channel.(*slack.Channel).Name)
+	_, err = smib.conversations.get("Xgeneral", fail)
+	assert.NoError(t, err)
+}
+
+func TestListenAndRobot_cacheEvents(t *testing.T) {
+	testServer := slacktest.NewTestServer()
+	testServer.Start()
+	defer testServer.Stop()
+	testRTM := testServer.GetTestRTMInstance()
+
+	smib := SMIB{slack: rtmTransport{testRTM}}
+	smib.users.set("Xspengler", &slack.User{ID: "Xspengler", Name: "spengler"})
+	smib.conversations.set("Xgeneral", &slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}})
+	smib.conversations.set("Xcontainment", &slack.Channel{GroupConversation: slack.GroupConversation{Name: "containment"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		smib.ListenAndRobot(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	testRTM.IncomingEvents <- slack.RTMEvent{Type: "user_change", Data: &slack.UserChangeEvent{
+		User: slack.User{ID: "Xspengler", Name: "egon"},
+	}}
+	testRTM.IncomingEvents <- slack.RTMEvent{Type: "channel_rename", Data: &slack.ChannelRenameEvent{
+		Channel: slack.ChannelRenameInfo{ID: "Xgeneral", Name: "lobby"},
+	}}
+	testRTM.IncomingEvents <- slack.RTMEvent{Type: "group_rename", Data: &slack.GroupRenameEvent{
+		Group: slack.GroupRenameInfo{ID: "Xcontainment", Name: "grid"},
+	}}
+
+	waitUntil(t, func() bool {
+		user, err := smib.getUser("Xspengler")
+		return err == nil && user.Name == "egon"
+	})
+	waitUntil(t, func() bool {
+		_, err := smib.conversations.get("Xcontainment", func() (interface{}, error) { return nil, errors.New("not cached") })
+		return err != nil
+	})
+	_, err := smib.conversations.get("Xgeneral", func() (interface{}, error) { return nil, errors.New("not cached") })
+	assert.Error(t, err)
+}
@@ -0,0 +1,496 @@
+package smib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/format"
+	"github.com/somakeit/slacker-smib/internal/store"
+)
+
+// defaultCallbackGrace is how long commands may use the API after they exit if CallbackGrace is
+// unset
+const defaultCallbackGrace = 10 * time.Minute
+
+// callbackScope is what a command run may do with the API
+type callbackScope struct {
+	cmd string
+	// namespace is the command's keys in the Store, the command's name after resolving aliases
+	namespace string
+	// channel is where the command was run, threadTS is the thread it replies in and ts is the
+	// message which ran it, if any
+	channel, threadTS, ts string
+	user                  string
+	private               bool
+	allow                 format.Allow
+	// posted are the timestamps of messages posted with the API, which it may update
+	posted map[string]bool
+	// expires is when the scope stops working, it is zero while the command runs
+	expires time.Time
+}
+
+// callbackMessage is a message posted or updated with the API
+type callbackMessage struct {
+	Text string `json:"text"`
+	// TS is the message to update
+	TS string `json:"ts"`
+	// Private posts the message so only the user who ran the command sees it
+	Private bool `json:"private"`
+}
+
+// callbackReaction is a reaction added or removed with the API
+type callbackReaction struct {
+	Name string `json:"name"`
+	// TS is the message to react to, the message which ran the command if it is empty
+	TS     string `json:"ts"`
+	Remove bool   `json:"remove"`
+}
+
+// callbackPosted describes a message posted with the API
+type callbackPosted struct {
+	Channel string `json:"channel"`
+	TS      string `json:"ts,omitempty"`
+}
+
+// callbackUser describes a user to a command
+type callbackUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	RealName    string `json:"real_name"`
+	DisplayName string `json:"display_name"`
+}
+
+// callbackChannel describes a channel to a command
+type callbackChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// grantCallbacks returns a token which lets the command run for inv use the API, until
+// expireCallbacks is called and CallbackGrace has passed.
+func (s *SMIB) grantCallbacks(inv invocation, manifest command.Manifest) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate callback token: %s", err)
+	}
+	token := hex.EncodeToString(b)
+	namespace := inv.cmd
+	if s.Store != nil {
+		if name, err := s.cmd.Resolve(inv.cmd); err == nil {
+			namespace = name
+		}
+	}
+	scope := &callbackScope{
+		cmd:       inv.cmd,
+		namespace: namespace,
+		channel:   inv.channel,
+		threadTS:  inv.threadTS,
+		ts:        inv.ts,
+		user:      inv.user,
+		private:   manifest.Private,
+		allow:     s.allowedMentions(inv.cmd),
+		posted:    map[string]bool{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for t, scope := range s.callbacks {
+		if !scope.expires.IsZero() && now.After(scope.expires) {
+			delete(s.callbacks, t)
+		}
+	}
+	if s.callbacks == nil {
+		s.callbacks = map[string]*callbackScope{}
+	}
+	s.callbacks[token] = scope
+	return token, nil
+}
+
+// expireCallbacks starts the grace period after which token stops working
+func (s *SMIB) expireCallbacks(token string) {
+	grace := s.CallbackGrace
+	if grace <= 0 {
+		grace = defaultCallbackGrace
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if scope, ok := s.callbacks[token]; ok {
+		scope.expires = time.Now().Add(grace)
+	}
+}
+
+// callbackScope returns the scope of the bearer token in r, if it is valid
+func (s *SMIB) callbackScope(r *http.Request) (*callbackScope, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scope, ok := s.callbacks[token]
+	if !ok || (!scope.expires.IsZero() && time.Now().After(scope.expires)) {
+		return nil, false
+	}
+	return scope, true
+}
+
+// CallbackHandler serves the API commands use to act on slack, at CallbackURL. Each command run
+// gets a token which only works in the conversation it was run in, and expires CallbackGrace after
+// the command exits. Messages and reactions are paced with the rest of SMIB's output, requests
+// wait until they have been sent. Requests and responses are JSON:
+//
+//	POST /post {"text", "private"} posts a message in the command's conversation and thread
+//	POST /update {"ts", "text"} updates a message posted with /post
+//	POST /react {"name", "ts", "remove"} reacts to a message, the one which ran the command if ts is empty
+//	POST /dm {"text"} sends a direct message to the user who ran the command
+//	GET /user?id= and GET /channel?id= look up a user or channel
+//
+// If Store is set commands can also keep values in it, each command only sees its own keys:
+//
+//	GET /store/get?key= returns {"key", "value"}, or 404 if the key isn't set
+//	POST /store/set {"key", "value"} sets a key
+//	POST /store/incr {"key", "by"} adds by, or 1, to an integer key and returns it
+//	POST /store/cas {"key", "old", "value"} sets a key if it is old, or unset if old is empty
+//	POST /store/delete {"key"} removes a key
+//	GET /store/list?prefix= returns {"values"} with the keys which start with prefix
+func (s *SMIB) CallbackHandler() http.Handler {
+	routes := map[string]func(*callbackScope, *http.Request) (interface{}, error){
+		"POST /post":   s.callbackPost,
+		"POST /update": s.callbackUpdate,
+		"POST /react":  s.callbackReact,
+		"POST /dm":     s.callbackDM,
+		"GET /user":    s.callbackUser,
+		"GET /channel": s.callbackChannel,
+
+		"GET /store/get":     s.callbackStoreGet,
+		"POST /store/set":    s.callbackStoreSet,
+		"POST /store/incr":   s.callbackStoreIncr,
+		"POST /store/cas":    s.callbackStoreCAS,
+		"POST /store/delete": s.callbackStoreDelete,
+		"GET /store/list":    s.callbackStoreList,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := routes[r.Method+" "+r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		scope, ok := s.callbackScope(r)
+		if !ok {
+			http.Error(w, "invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		resp, err := route(scope, r)
+		var (
+			bad     callbackError
+			limited *slack.RateLimitedError
+		)
+		switch {
+		case errors.Is(err, errNoKey):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.As(err, &bad):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.As(err, &limited):
+			w.Header().Set("Retry-After", fmt.Sprint(int(limited.RetryAfter.Seconds())))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			log.Print(fmt.Sprintf("Callback %s %s from %s failed: %s", r.Method, r.URL.Path, scope.cmd, err))
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// callbackKey is a key read or changed in the store with the API
+type callbackKey struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// By is added to the value by /store/incr, 1 if it is unset
+	By *int64 `json:"by,omitempty"`
+	// Old is the value /store/cas expects
+	Old string `json:"old,omitempty"`
+}
+
+// callbackSwapped is the result of /store/cas
+type callbackSwapped struct {
+	Swapped bool `json:"swapped"`
+}
+
+// callbackValues is the result of /store/list
+type callbackValues struct {
+	Values map[string]string `json:"values"`
+}
+
+// callbackError is a bad request to the API
+type callbackError string
+
+func (e callbackError) Error() string {
+	return string(e)
+}
+
+// decodeCallback decodes the JSON body of r into v
+func decodeCallback(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v); err != nil {
+		return callbackError(fmt.Sprintf("invalid request: %s", err))
+	}
+	return nil
+}
+
+func (s *SMIB) callbackPost(scope *callbackScope, r *http.Request) (interface{}, error) {
+	var msg callbackMessage
+	if err := decodeCallback(r, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Text == "" {
+		return nil, callbackError("text is required")
+	}
+
+	options := []slack.MsgOption{slack.MsgOptionText(format.Sanitise(msg.Text, scope.allow), false)}
+	if scope.threadTS != "" {
+		options = append(options, slack.MsgOptionTS(scope.threadTS))
+	}
+	if (msg.Private || scope.private) && !s.isDM(scope.channel) {
+		err := s.call(scope.channel, func() error {
+			_, err := s.slack.PostEphemeral(scope.channel, scope.user, options...)
+			return err
+		})
+		return callbackPosted{Channel: scope.channel}, err
+	}
+	var channel, ts string
+	err := s.call(scope.channel, func() error {
+		var err error
+		channel, ts, err = s.slack.PostMessage(scope.channel, options...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	scope.posted[ts] = true
+	s.mu.Unlock()
+	return callbackPosted{Channel: channel, TS: ts}, nil
+}
+
+func (s *SMIB) callbackUpdate(scope *callbackScope, r *http.Request) (interface{}, error) {
+	var msg callbackMessage
+	if err := decodeCallback(r, &msg); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	posted := scope.posted[msg.TS]
+	s.mu.Unlock()
+	if !posted {
+		return nil, callbackError("only messages posted with /post can be updated")
+	}
+	if msg.Text == "" {
+		return nil, callbackError("text is required")
+	}
+	err := s.call(scope.channel, func() error {
+		_, _, _, err := s.slack.UpdateMessage(scope.channel, msg.TS, slack.MsgOptionText(format.Sanitise(msg.Text, scope.allow), false))
+		return err
+	})
+	return callbackPosted{Channel: scope.channel, TS: msg.TS}, err
+}
+
+func (s *SMIB) callbackReact(scope *callbackScope, r *http.Request) (interface{}, error) {
+	var reaction callbackReaction
+	if err := decodeCallback(r, &reaction); err != nil {
+		return nil, err
+	}
+	name := strings.Trim(reaction.Name, ":")
+	if name == "" {
+		return nil, callbackError("name is required")
+	}
+	ts := reaction.TS
+	if ts == "" {
+		ts = scope.ts
+	}
+	if ts == "" {
+		return nil, callbackError("ts is required, the command wasn't run by a message")
+	}
+
+	item := slack.NewRefToMessage(scope.channel, ts)
+	err := s.call(scope.channel, func() error {
+		var err error
+		if reaction.Remove {
+			err = s.slack.RemoveReaction(name, item)
+		} else {
+			err = s.slack.AddReaction(name, item)
+		}
+		if err != nil && (err.Error() == "already_reacted" || err.Error() == "no_reaction") {
+			err = nil
+		}
+		return err
+	})
+	return struct{}{}, err
+}
+
+func (s *SMIB) callbackDM(scope *callbackScope, r *http.Request) (interface{}, error) {
+	var msg callbackMessage
+	if err := decodeCallback(r, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Text == "" {
+		return nil, callbackError("text is required")
+	}
+	var channel, ts string
+	err := s.call(scope.channel, func() error {
+		im, _, _, err := s.slack.OpenConversation(&slack.OpenConversationParameters{Users: []string{scope.user}, ReturnIM: true})
+		if err != nil {
+			return err
+		}
+		channel, ts, err = s.slack.PostMessage(im.ID, slack.MsgOptionText(format.Sanitise(msg.Text, scope.allow), false))
+		return err
+	})
+	return callbackPosted{Channel: channel, TS: ts}, err
+}
+
+func (s *SMIB) callbackUser(scope *callbackScope, r *http.Request) (interface{}, error) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = scope.user
+	}
+	user, err := s.getUser(id)
+	if err != nil {
+		return nil, err
+	}
+	return callbackUser{ID: user.ID, Name: user.Name, RealName: user.RealName, DisplayName: user.Profile.DisplayName}, nil
+}
+
+func (s *SMIB) callbackChannel(scope *callbackScope, r *http.Request) (interface{}, error) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = scope.channel
+	}
+	channel, err := s.getConversation(id)
+	if err != nil {
+		return nil, err
+	}
+	return callbackChannel{ID: channel.ID, Name: channel.Name, Type: channelTypeOf(channel)}, nil
+}
+
+// errNoKey is returned by /store/get when the key isn't set
+var errNoKey = errors.New("key is not set")
+
+// callbackStore returns the Store, or an error if there isn't one
+func (s *SMIB) callbackStore() (*store.Store, error) {
+	if s.Store == nil {
+		return nil, callbackError("the store isn't enabled")
+	}
+	return s.Store, nil
+}
+
+// storeError turns mistakes in store requests into bad requests
+func storeError(err error) error {
+	if errors.Is(err, store.ErrEmptyKey) || errors.Is(err, store.ErrNotInteger) {
+		return callbackError(err.Error())
+	}
+	return err
+}
+
+func (s *SMIB) callbackStoreGet(scope *callbackScope, r *http.Request) (interface{}, error) {
+	st, err := s.callbackStore()
+	if err != nil {
+		return nil, err
+	}
+	key := r.URL.Query().Get("key")
+	value, ok, err := st.Get(scope.namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errNoKey
+	}
+	return callbackKey{Key: key, Value: value}, nil
+}
+
+func (s *SMIB) callbackStoreSet(scope *callbackScope, r *http.Request) (interface{}, error) {
+	st, err := s.callbackStore()
+	if err != nil {
+		return nil, err
+	}
+	var key callbackKey
+	if err := decodeCallback(r, &key); err != nil {
+		return nil, err
+	}
+	if err := st.Set(scope.namespace, key.Key, key.Value); err != nil {
+		return nil, storeError(err)
+	}
+	return callbackKey{Key: key.Key, Value: key.Value}, nil
+}
+
+func (s *SMIB) callbackStoreIncr(scope *callbackScope, r *http.Request) (interface{}, error) {
+	st, err := s.callbackStore()
+	if err != nil {
+		return nil, err
+	}
+	var key callbackKey
+	if err := decodeCallback(r, &key); err != nil {
+		return nil, err
+	}
+	by := int64(1)
+	if key.By != nil {
+		by = *key.By
+	}
+	n, err := st.Incr(scope.namespace, key.Key, by)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return callbackKey{Key: key.Key, Value: strconv.FormatInt(n, 10)}, nil
+}
+
+func (s *SMIB) callbackStoreCAS(scope *callbackScope, r *http.Request) (interface{}, error) {
+	st, err := s.callbackStore()
+	if err != nil {
+		return nil, err
+	}
+	var key callbackKey
+	if err := decodeCallback(r, &key); err != nil {
+		return nil, err
+	}
+	swapped, err := st.CompareAndSwap(scope.namespace, key.Key, key.Old, key.Value)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return callbackSwapped{Swapped: swapped}, nil
+}
+
+func (s *SMIB) callbackStoreDelete(scope *callbackScope, r *http.Request) (interface{}, error) {
+	st, err := s.callbackStore()
+	if err != nil {
+		return nil, err
+	}
+	var key callbackKey
+	if err := decodeCallback(r, &key); err != nil {
+		return nil, err
+	}
+	return struct{}{}, storeError(st.Delete(scope.namespace, key.Key))
+}
+
+func (s *SMIB) callbackStoreList(scope *callbackScope, r *http.Request) (interface{}, error) {
+	st, err := s.callbackStore()
+	if err != nil {
+		return nil, err
+	}
+	values, err := st.List(scope.namespace, r.URL.Query().Get("prefix"))
+	if err != nil {
+		return nil, err
+	}
+	return callbackValues{Values: values}, nil
+}
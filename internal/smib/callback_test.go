@@ -0,0 +1,376 @@
+package smib
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// callbackTransport records updated messages as well as reactions
+type callbackTransport struct {
+	reactionTransport
+
+	updated []map[string]string
+}
+
+func (c *callbackTransport) UpdateMessage(channelID, timestamp string, options ...slack.MsgOption) (string, string, string, error) {
+	_, values, err := slack.UnsafeApplyMsgOptions("", channelID, "", options...)
+	if err != nil {
+		return "", "", "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updated = append(c.updated, map[string]string{"channel": channelID, "ts": timestamp, "text": values.Get("text")})
+	return channelID, timestamp, values.Get("text"), nil
+}
+
+func TestSMIB_CallbackHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		channel       string
+		private       bool
+		requests      [][3]string
+		wantStatus    int
+		wantBody      string
+		wantPosted    []map[string]string
+		wantEphemeral []map[string]string
+		wantUpdated   []map[string]string
+		wantReactions []string
+	}{
+		{
+			name:       "post",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"POST", "/post", `{"text": "done <!channel>"}`}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"channel":"Xgeneral","ts":"1630000009.000900"}`,
+			wantPosted: []map[string]string{{"channel": "Xgeneral", "text": "done &lt;!channel&gt;", "thread_ts": "99.9"}},
+		},
+		{
+			name:       "post private",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"POST", "/post", `{"text": "the code is 1234", "private": true}`}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"channel":"Xgeneral"}`,
+			wantEphemeral: []map[string]string{
+				{"channel": "Xgeneral", "user": "Xspengler", "text": "the code is 1234", "thread_ts": "99.9"},
+			},
+		},
+		{
+			name:       "private command",
+			channel:    "Xgeneral",
+			private:    true,
+			requests:   [][3]string{{"POST", "/post", `{"text": "the code is 1234"}`}},
+			wantStatus: http.StatusOK,
+			wantEphemeral: []map[string]string{
+				{"channel": "Xgeneral", "user": "Xspengler", "text": "the code is 1234", "thread_ts": "99.9"},
+			},
+		},
+		{
+			name:       "post nothing",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"POST", "/post", `{}`}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "text is required",
+		},
+		{
+			name:       "invalid JSON",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"POST", "/post", `text`}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:    "update",
+			channel: "Xgeneral",
+			requests: [][3]string{
+				{"POST", "/post", `{"text": "printing"}`},
+				{"POST", "/update", `{"ts": "1630000009.000900", "text": "printed"}`},
+			},
+			wantStatus:  http.StatusOK,
+			wantPosted:  []map[string]string{{"channel": "Xgeneral", "text": "printing", "thread_ts": "99.9"}},
+			wantUpdated: []map[string]string{{"channel": "Xgeneral", "ts": "1630000009.000900", "text": "printed"}},
+		},
+		{
+			name:       "update someone else's message",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"POST", "/update", `{"ts": "1.1", "text": "printed"}`}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "only messages posted with /post can be updated",
+		},
+		{
+			name:          "react",
+			channel:       "Xgeneral",
+			requests:      [][3]string{{"POST", "/react", `{"name": ":printer:"}`}, {"POST", "/react", `{"name": "eyes", "remove": true}`}},
+			wantStatus:    http.StatusOK,
+			wantReactions: []string{"+printer", "-eyes"},
+		},
+		{
+			name:       "dm",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"POST", "/dm", `{"text": "your print is ready"}`}},
+			wantStatus: http.StatusOK,
+			wantPosted: []map[string]string{{"channel": "DXspengler", "text": "your print is ready", "thread_ts": ""}},
+		},
+		{
+			name:       "user",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"GET", "/user?id=Xvenkman", ""}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":"Xvenkman","name":"spengler","real_name":"","display_name":""}`,
+		},
+		{
+			name:       "channel",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"GET", "/channel", ""}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":"","name":"general","type":"public_channel"}`,
+		},
+		{
+			name:       "unknown",
+			channel:    "Xgeneral",
+			requests:   [][3]string{{"POST", "/delete", "{}"}},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &callbackTransport{}
+			smib := SMIB{slack: transport}
+			server := httptest.NewServer(smib.CallbackHandler())
+			defer server.Close()
+			token, err := smib.grantCallbacks(
+				invocation{cmd: "print", user: "Xspengler", channel: tt.channel, ts: "99.9", threadTS: "99.9"},
+				command.Manifest{Private: tt.private},
+			)
+			require.NoError(t, err)
+
+			var (
+				status int
+				body   string
+			)
+			for _, request := range tt.requests {
+				req, err := http.NewRequest(request[0], server.URL+request[1], strings.NewReader(request[2]))
+				require.NoError(t, err)
+				req.Header.Set("Authorization", "Bearer "+token)
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				b, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				require.NoError(t, err)
+				status, body = resp.StatusCode, strings.TrimSpace(string(b))
+			}
+			assert.Equal(t, tt.wantStatus, status)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, body)
+			}
+
+			assertRecorded(t, tt.wantPosted, transport.getPosted())
+			assertRecorded(t, tt.wantEphemeral, transport.getEphemeral())
+			assertRecorded(t, tt.wantUpdated, transport.updated)
+			if tt.wantReactions == nil {
+				assert.Empty(t, transport.getReactions())
+			} else {
+				assert.Equal(t, tt.wantReactions, transport.getReactions())
+			}
+		})
+	}
+}
+
+// assertRecorded checks the transport recorded want, or nothing if want is nil
+func assertRecorded(t *testing.T, want, got []map[string]string) {
+	t.Helper()
+	if want == nil {
+		assert.Empty(t, got)
+		return
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestSMIB_CallbackHandler_store(t *testing.T) {
+	tests := []struct {
+		name       string
+		noStore    bool
+		requests   [][3]string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "get unset",
+			requests:   [][3]string{{"GET", "/store/get?key=egon", ""}},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "set and get",
+			requests:   [][3]string{{"POST", "/store/set", `{"key": "egon", "value": "3"}`}, {"GET", "/store/get?key=egon", ""}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"key":"egon","value":"3"}`,
+		},
+		{
+			name:       "set empty key",
+			requests:   [][3]string{{"POST", "/store/set", `{"value": "3"}`}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "key must not be empty",
+		},
+		{
+			name:       "incr",
+			requests:   [][3]string{{"POST", "/store/incr", `{"key": "egon"}`}, {"POST", "/store/incr", `{"key": "egon", "by": 5}`}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"key":"egon","value":"6"}`,
+		},
+		{
+			name:       "incr not an integer",
+			requests:   [][3]string{{"POST", "/store/set", `{"key": "egon", "value": "lots"}`}, {"POST", "/store/incr", `{"key": "egon"}`}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "value is not an integer",
+		},
+		{
+			name:       "cas",
+			requests:   [][3]string{{"POST", "/store/cas", `{"key": "holder", "value": "egon"}`}},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"swapped":true}`,
+		},
+		{
+			name: "cas changed",
+			requests: [][3]string{
+				{"POST", "/store/set", `{"key": "holder", "value": "ray"}`},
+				{"POST", "/store/cas", `{"key": "holder", "old": "egon", "value": "venkman"}`},
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"swapped":false}`,
+		},
+		{
+			name: "delete",
+			requests: [][3]string{
+				{"POST", "/store/set", `{"key": "egon", "value": "3"}`},
+				{"POST", "/store/delete", `{"key": "egon"}`},
+				{"GET", "/store/get?key=egon", ""},
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "list",
+			requests: [][3]string{
+				{"POST", "/store/set", `{"key": "user:egon", "value": "3"}`},
+				{"POST", "/store/set", `{"key": "team", "value": "ghostbusters"}`},
+				{"GET", "/store/list?prefix=user:", ""},
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"values":{"user:egon":"3"}}`,
+		},
+		{
+			name:       "no store",
+			noStore:    true,
+			requests:   [][3]string{{"GET", "/store/get?key=egon", ""}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "the store isn't enabled",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCmd := &mockCommand{}
+			mockCmd.Test(t)
+			mockCmd.On("Resolve", "k").Return("karma", nil).Maybe()
+			smib := SMIB{slack: &callbackTransport{}, cmd: mockCmd}
+			if !tt.noStore {
+				st, err := store.Open(filepath.Join(t.TempDir(), "smib.db"))
+				require.NoError(t, err)
+				defer st.Close()
+				smib.Store = st
+			}
+			server := httptest.NewServer(smib.CallbackHandler())
+			defer server.Close()
+			token, err := smib.grantCallbacks(invocation{cmd: "k", user: "Xspengler", channel: "Xgeneral"}, command.Manifest{})
+			require.NoError(t, err)
+
+			var (
+				status int
+				body   string
+			)
+			for _, request := range tt.requests {
+				req, err := http.NewRequest(request[0], server.URL+request[1], strings.NewReader(request[2]))
+				require.NoError(t, err)
+				req.Header.Set("Authorization", "Bearer "+token)
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				b, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				require.NoError(t, err)
+				status, body = resp.StatusCode, strings.TrimSpace(string(b))
+			}
+			assert.Equal(t, tt.wantStatus, status)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, body)
+			}
+			if smib.Store != nil {
+				values, err := smib.Store.List("k", "")
+				require.NoError(t, err)
+				assert.Empty(t, values, "keys are kept under the resolved command name")
+			}
+		})
+	}
+}
+
+func TestSMIB_CallbackHandler_tokens(t *testing.T) {
+	smib := SMIB{slack: &callbackTransport{}, CallbackGrace: 50 * time.Millisecond}
+	server := httptest.NewServer(smib.CallbackHandler())
+	defer server.Close()
+	token, err := smib.grantCallbacks(invocation{cmd: "print", user: "Xspengler", channel: "Xgeneral"}, command.Manifest{})
+	require.NoError(t, err)
+
+	get := func(token string) int {
+		req, err := http.NewRequest("GET", server.URL+"/user", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, get(""))
+	assert.Equal(t, http.StatusUnauthorized, get("not"+token))
+	assert.Equal(t, http.StatusOK, get(token), "works while the command runs")
+
+	smib.expireCallbacks(token)
+	assert.Equal(t, http.StatusOK, get(token), "works during the grace period")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusUnauthorized, get(token), "expired")
+}
+
+func TestSMIB_run_callbacks(t *testing.T) {
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	mockCmd.On("Run", mock.Anything, "print", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(output(""), nil).Once()
+	smib := SMIB{slack: &reactionTransport{}, cmd: mockCmd, CallbackURL: "http://127.0.0.1:8081"}
+
+	_, err := smib.run(context.Background(), invocation{cmd: "print", user: "Xspengler", channel: "Xgeneral"}, func(string, bool) {})
+	require.NoError(t, err)
+	require.Len(t, mockCmd.extras, 1)
+	env := mockCmd.extras[0].Env
+	assert.Contains(t, env, "SMIB_API_URL=http://127.0.0.1:8081")
+
+	var token string
+	for _, e := range env {
+		if strings.HasPrefix(e, "SMIB_API_TOKEN=") {
+			token = strings.TrimPrefix(e, "SMIB_API_TOKEN=")
+		}
+	}
+	require.Len(t, token, 32)
+	smib.mu.Lock()
+	scope := smib.callbacks[token]
+	smib.mu.Unlock()
+	require.NotNil(t, scope)
+	assert.False(t, scope.expires.IsZero(), "the grace period starts when the command exits")
+}
@@ -0,0 +1,68 @@
+package smib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/command"
+)
+
+// conversationContext returns the channel name and type passed to commands run in channelID. The
+// name is "null" for direct messages, as it was for the IRC bot.
+func (s *SMIB) conversationContext(channelID string) (name, channelType string) {
+	channel, err := s.getConversation(channelID)
+	if err != nil {
+		// Guess from the ID rather than reporting every channel we can't see as a DM
+		var cached cachedError
+		if !errors.As(err, &cached) {
+			log.Print(fmt.Sprintf("Failed to get conversation info for %s: %s", channelID, err))
+		}
+		channelType = guessChannelType(channelID)
+		if channelType == command.ChannelIM {
+			return "null", channelType
+		}
+		return channelID, channelType
+	}
+
+	channelType = channelTypeOf(channel)
+	if channelType == command.ChannelIM {
+		return "null", channelType
+	}
+	return channel.Name, channelType
+}
+
+// isDM reports whether channelID is a direct message with smib
+func (s *SMIB) isDM(channelID string) bool {
+	_, channelType := s.conversationContext(channelID)
+	return channelType == command.ChannelIM
+}
+
+// channelTypeOf classifies a conversation returned by conversations.info
+func channelTypeOf(channel *slack.Channel) string {
+	switch {
+	case channel.IsIM:
+		return command.ChannelIM
+	case channel.IsMpIM:
+		return command.ChannelMPIM
+	case channel.IsPrivate, channel.IsGroup:
+		return command.ChannelPrivate
+	default:
+		return command.ChannelPublic
+	}
+}
+
+// guessChannelType classifies a conversation by its ID alone. Private channels and group DMs both
+// have G IDs and newer private channels have C IDs, so this is only a fallback.
+func guessChannelType(channelID string) string {
+	switch {
+	case strings.HasPrefix(channelID, "D"):
+		return command.ChannelIM
+	case strings.HasPrefix(channelID, "G"):
+		return command.ChannelPrivate
+	default:
+		return command.ChannelPublic
+	}
+}
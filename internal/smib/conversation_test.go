@@ -0,0 +1,74 @@
+package smib
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_channelTypeOf(t *testing.T) {
+	tests := []struct {
+		name         string
+		conversation slack.Conversation
+		want         string
+	}{
+		{"public channel", slack.Conversation{}, "public_channel"},
+		{"private channel", slack.Conversation{IsPrivate: true}, "private_channel"},
+		{"legacy private group", slack.Conversation{IsGroup: true}, "private_channel"},
+		{"im", slack.Conversation{IsIM: true, IsPrivate: true}, "im"},
+		{"mpim", slack.Conversation{IsMpIM: true, IsPrivate: true}, "mpim"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channel := &slack.Channel{GroupConversation: slack.GroupConversation{Conversation: tt.conversation}}
+			assert.Equal(t, tt.want, channelTypeOf(channel))
+		})
+	}
+}
+
+func Test_guessChannelType(t *testing.T) {
+	assert.Equal(t, "im", guessChannelType("D024BE91L"))
+	assert.Equal(t, "private_channel", guessChannelType("G024BE91L"))
+	assert.Equal(t, "public_channel", guessChannelType("C024BE91L"))
+}
+
+func TestSMIB_isDM(t *testing.T) {
+	smib := SMIB{slack: &fakeTransport{}}
+	dm := &slack.Channel{}
+	dm.IsIM = true
+	smib.conversations.set("Cmigrated", dm)
+	smib.conversations.set("Dgeneral", &slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}})
+
+	assert.True(t, smib.isDM("Cmigrated"), "slack says it's a DM whatever its ID")
+	assert.False(t, smib.isDM("Dgeneral"))
+}
+
+// hiddenTransport can't see any conversations
+type hiddenTransport struct {
+	fakeTransport
+}
+
+func (h *hiddenTransport) GetConversationInfo(channelID string, includeLocale bool) (*slack.Channel, error) {
+	return nil, errors.New("channel_not_found")
+}
+
+func TestSMIB_conversationContext_logsOnce(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	smib := SMIB{slack: &hiddenTransport{}}
+	for i := 0; i < 3; i++ {
+		name, channelType := smib.conversationContext("Gsecret")
+		assert.Equal(t, "Gsecret", name)
+		assert.Equal(t, "private_channel", channelType)
+	}
+	assert.Equal(t, 1, strings.Count(logged.String(), "Failed to get conversation info for Gsecret"),
+		"failures served from the cache aren't logged again")
+}
@@ -0,0 +1,215 @@
+package smib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/metrics"
+)
+
+const (
+	// maxSendAttempts is how many times a message is sent before giving up on it, the last attempt
+	// uses chat.postMessage in case the transport is what is refusing it.
+	maxSendAttempts = 3
+)
+
+var (
+	// ackTimeout is how long slack has to acknowledge a message before it is sent again. The RTM
+	// API doesn't say which message an error is for, so this is how RTM failures are noticed.
+	ackTimeout = 10 * time.Second
+	// retryBackoff is how long to wait before the first retry, it doubles for each retry after.
+	retryBackoff = time.Second
+)
+
+// errAckTimeout means slack did not acknowledge a message in time
+var errAckTimeout = errors.New("no acknowledgement from slack")
+
+// delivery is a message waiting to be acknowledged by slack
+type delivery struct {
+	msg      *slack.OutgoingMessage
+	attempts int
+	// inFlight is set while the latest attempt is waiting for a result
+	inFlight bool
+	// timer fails the latest attempt if it isn't acknowledged in time
+	timer *time.Timer
+}
+
+// stop records that the latest attempt has a result, s.mu must be held
+func (d *delivery) stop() {
+	d.inFlight = false
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+// messageIDError is implemented by send errors which say which message failed, such as the ack
+// errors from socketmode.
+type messageIDError interface {
+	MessageID() int
+}
+
+// sendMessage queues msg to be sent to slack. Messages are retried until slack acknowledges them,
+// typing messages are sent once.
+func (s *SMIB) sendMessage(msg *slack.OutgoingMessage) {
+	s.track(msg)
+	s.enqueue(msg.Channel, func() error {
+		return s.transmit(msg)
+	})
+}
+
+// track records that msg is waiting to be acknowledged by slack
+func (s *SMIB) track(msg *slack.OutgoingMessage) {
+	if msg.Type != "message" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deliveries == nil {
+		s.deliveries = map[int]*delivery{}
+	}
+	s.deliveries[msg.ID] = &delivery{msg: msg}
+}
+
+// transmit hands msg to the transport, starting the wait for its acknowledgement. It must only be
+// called by the outbox.
+func (s *SMIB) transmit(msg *slack.OutgoingMessage) error {
+	s.mu.Lock()
+	if d, ok := s.deliveries[msg.ID]; ok {
+		d.attempts++
+		d.inFlight = true
+		d.timer = time.AfterFunc(ackTimeout, func() {
+			s.sendFailed(msg.ID, errAckTimeout)
+		})
+	}
+	s.mu.Unlock()
+
+	s.slack.SendMessage(msg)
+	return nil
+}
+
+// acked records that slack has acknowledged the message with the given id, giving it timestamp ts
+func (s *SMIB) acked(id int, ts string) {
+	s.mu.Lock()
+	if d, ok := s.deliveries[id]; ok {
+		d.stop()
+		delete(s.deliveries, id)
+	}
+	s.mu.Unlock()
+	s.replyAcked(id, ts)
+}
+
+// ackError handles an ack_error event. Errors which don't say which message they are for are
+// logged, the message will be retried when its acknowledgement times out.
+func (s *SMIB) ackError(err error) {
+	s.rateLimited(err)
+	var idErr messageIDError
+	if !errors.As(err, &idErr) {
+		log.Print("Slack rejected a message: ", err)
+		return
+	}
+	s.sendFailed(idErr.MessageID(), err)
+}
+
+// sendFailed retries the message with the given id after a backoff, or gives up on it if it has
+// been sent maxSendAttempts times.
+func (s *SMIB) sendFailed(id int, err error) {
+	s.mu.Lock()
+	d, ok := s.deliveries[id]
+	if !ok || !d.inFlight {
+		// Already acknowledged, or already waiting to be retried
+		s.mu.Unlock()
+		return
+	}
+	d.stop()
+	if d.attempts >= maxSendAttempts {
+		delete(s.deliveries, id)
+		delete(s.awaitingTS, id)
+		s.mu.Unlock()
+		metrics.MessagesFailed.Inc()
+		log.Print(fmt.Sprintf("Gave up sending message to %s after %d attempts: %s: %q", d.msg.Channel, d.attempts, err, d.msg.Text))
+		return
+	}
+	s.mu.Unlock()
+
+	metrics.MessagesRetried.Inc()
+	backoff := retryBackoff << (d.attempts - 1)
+	log.Print(fmt.Sprintf("Message to %s failed: %s, retrying in %s", d.msg.Channel, err, backoff))
+	time.AfterFunc(backoff, func() {
+		s.retry(id, d)
+	})
+}
+
+// retry sends d again under a new message ID. The final attempt uses chat.postMessage instead of
+// the transport.
+func (s *SMIB) retry(oldID int, d *delivery) {
+	msg := s.slack.NewOutgoingMessage(d.msg.Text, d.msg.Channel)
+	id := msg.ID
+	*msg = *d.msg
+	msg.ID = id
+
+	s.mu.Lock()
+	if s.deliveries[oldID] != d {
+		// Slack acknowledged it after all
+		s.mu.Unlock()
+		return
+	}
+	delete(s.deliveries, oldID)
+	s.deliveries[id] = &delivery{msg: msg, attempts: d.attempts}
+	if reply, ok := s.awaitingTS[oldID]; ok {
+		delete(s.awaitingTS, oldID)
+		s.awaitingTS[id] = reply
+	}
+	s.mu.Unlock()
+
+	if d.attempts+1 < maxSendAttempts {
+		s.enqueue(msg.Channel, func() error {
+			return s.transmit(msg)
+		})
+		return
+	}
+	s.enqueue(msg.Channel, func() error {
+		return s.post(msg)
+	})
+}
+
+// post sends msg with chat.postMessage, bypassing the transport. It must only be called by the
+// outbox.
+func (s *SMIB) post(msg *slack.OutgoingMessage) error {
+	options := []slack.MsgOption{slack.MsgOptionText(msg.Text, false)}
+	if msg.ThreadTimestamp != "" {
+		options = append(options, slack.MsgOptionTS(msg.ThreadTimestamp))
+	}
+	if msg.ThreadBroadcast {
+		options = append(options, slack.MsgOptionBroadcast())
+	}
+
+	_, ts, err := s.slack.PostMessage(msg.Channel, options...)
+	var limited *slack.RateLimitedError
+	if errors.As(err, &limited) {
+		return err
+	}
+
+	s.mu.Lock()
+	if d, ok := s.deliveries[msg.ID]; ok {
+		d.attempts++
+		d.inFlight = true
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.sendFailed(msg.ID, err)
+		return nil
+	}
+	s.acked(msg.ID, ts)
+	return nil
+}
+
+// pending returns the number of sent messages slack has not yet acknowledged
+func (s *SMIB) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.deliveries)
+}
@@ -0,0 +1,271 @@
+package smib
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/somakeit/slacker-smib/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTransport records messages without sending them anywhere. Methods it doesn't implement
+// panic.
+type fakeTransport struct {
+	Transport
+
+	mu           sync.Mutex
+	nextID       int
+	sent         []slack.OutgoingMessage
+	posted       []map[string]string
+	postErr      error
+	ephemeral    []map[string]string
+	ephemeralErr error
+	uploaded     []map[string]string
+	// shared holds the content of files which can be downloaded, by URL
+	shared map[string]string
+}
+
+func (f *fakeTransport) NewOutgoingMessage(text, channelID string, options ...slack.RTMsgOption) *slack.OutgoingMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	msg := &slack.OutgoingMessage{ID: f.nextID, Type: "message", Channel: channelID, Text: text}
+	for _, option := range options {
+		option(msg)
+	}
+	return msg
+}
+
+func (f *fakeTransport) SendMessage(msg *slack.OutgoingMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, *msg)
+}
+
+func (f *fakeTransport) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	_, values, err := slack.UnsafeApplyMsgOptions("", channelID, "", options...)
+	if err != nil {
+		return "", "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.postErr != nil {
+		return "", "", f.postErr
+	}
+	f.posted = append(f.posted, map[string]string{
+		"channel":   values.Get("channel"),
+		"text":      values.Get("text"),
+		"thread_ts": values.Get("thread_ts"),
+	})
+	return channelID, "1630000009.000900", nil
+}
+
+func (f *fakeTransport) PostEphemeral(channelID, userID string, options ...slack.MsgOption) (string, error) {
+	_, values, err := slack.UnsafeApplyMsgOptions("", channelID, "", options...)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ephemeralErr != nil {
+		return "", f.ephemeralErr
+	}
+	f.ephemeral = append(f.ephemeral, map[string]string{
+		"channel":   values.Get("channel"),
+		"user":      userID,
+		"text":      values.Get("text"),
+		"thread_ts": values.Get("thread_ts"),
+	})
+	return "1630000009.000900", nil
+}
+
+func (f *fakeTransport) OpenConversation(params *slack.OpenConversationParameters) (*slack.Channel, bool, bool, error) {
+	channel := &slack.Channel{}
+	channel.ID = "D" + params.Users[0]
+	return channel, false, false, nil
+}
+
+func (f *fakeTransport) UploadFile(params slack.FileUploadParameters) (*slack.File, error) {
+	content := params.Content
+	if params.Reader != nil {
+		b, err := ioutil.ReadAll(params.Reader)
+		if err != nil {
+			return nil, err
+		}
+		content = string(b)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploaded = append(f.uploaded, map[string]string{
+		"channels":        strings.Join(params.Channels, ","),
+		"thread_ts":       params.ThreadTimestamp,
+		"filename":        params.Filename,
+		"filetype":        params.Filetype,
+		"title":           params.Title,
+		"initial_comment": params.InitialComment,
+		"content":         content,
+	})
+	return &slack.File{}, nil
+}
+
+func (f *fakeTransport) GetFile(downloadURL string, writer io.Writer) error {
+	content, ok := f.shared[downloadURL]
+	if !ok {
+		return errors.New("404 Not Found")
+	}
+	_, err := io.Copy(writer, strings.NewReader(content))
+	return err
+}
+
+func (f *fakeTransport) getSent() []slack.OutgoingMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]slack.OutgoingMessage{}, f.sent...)
+}
+
+func (f *fakeTransport) getEphemeral() []map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]string{}, f.ephemeral...)
+}
+
+func (f *fakeTransport) getUploaded() []map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]string{}, f.uploaded...)
+}
+
+func (f *fakeTransport) getPosted() []map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]string{}, f.posted...)
+}
+
+// sendError is an ack error which says which message failed
+type sendError int
+
+func (e sendError) Error() string  { return "refused" }
+func (e sendError) MessageID() int { return int(e) }
+
+func shortDeliveryTimeouts(t *testing.T) {
+	timeout, backoff := ackTimeout, retryBackoff
+	t.Cleanup(func() { ackTimeout, retryBackoff = timeout, backoff })
+	ackTimeout, retryBackoff = 20*time.Millisecond, time.Millisecond
+}
+
+func TestSMIB_sendMessage_acked(t *testing.T) {
+	transport := &fakeTransport{}
+	smib := &SMIB{slack: transport}
+
+	set := &replySet{at: time.Now()}
+	reply := smib.addReply(set)
+	msg := transport.NewOutgoingMessage("computer says yes", "Xgeneral")
+	smib.awaitAck(reply, msg.ID)
+	smib.sendMessage(msg)
+	drain(t, smib)
+	assert.Equal(t, 1, smib.pending())
+
+	smib.acked(msg.ID, "1630000000.000200")
+	assert.Equal(t, 0, smib.pending())
+	assert.Equal(t, "1630000000.000200", reply.ts)
+	assert.Len(t, transport.getSent(), 1)
+}
+
+func TestSMIB_sendMessage_ackTimeout(t *testing.T) {
+	shortDeliveryTimeouts(t)
+	transport := &fakeTransport{}
+	smib := &SMIB{slack: transport}
+	retried := testutil.ToFloat64(metrics.MessagesRetried)
+
+	msg := transport.NewOutgoingMessage("computer says yes", "Xgeneral", slack.RTMsgOptionTS("1.1"))
+	smib.sendMessage(msg)
+	waitUntil(t, func() bool { return len(transport.getSent()) == 2 }, "message should be retried")
+
+	sent := transport.getSent()
+	assert.NotEqual(t, sent[0].ID, sent[1].ID, "retries need a new ID")
+	assert.Equal(t, "computer says yes", sent[1].Text)
+	assert.Equal(t, "1.1", sent[1].ThreadTimestamp)
+	assert.Equal(t, retried+1, testutil.ToFloat64(metrics.MessagesRetried))
+
+	smib.acked(sent[0].ID, "1630000000.000200")
+	assert.Equal(t, 1, smib.pending(), "the retry is still waiting")
+	smib.acked(sent[1].ID, "1630000000.000300")
+	assert.Equal(t, 0, smib.pending())
+}
+
+func TestSMIB_sendMessage_lateAck(t *testing.T) {
+	shortDeliveryTimeouts(t)
+	retryBackoff = 50 * time.Millisecond
+	transport := &fakeTransport{}
+	smib := &SMIB{slack: transport}
+
+	msg := transport.NewOutgoingMessage("computer says yes", "Xgeneral")
+	smib.sendMessage(msg)
+	time.Sleep(ackTimeout + 10*time.Millisecond)
+	smib.acked(msg.ID, "1630000000.000200")
+	time.Sleep(retryBackoff + 10*time.Millisecond)
+
+	assert.Len(t, transport.getSent(), 1, "an acknowledged message should not be retried")
+	assert.Equal(t, 0, smib.pending())
+}
+
+func TestSMIB_sendMessage_fallback(t *testing.T) {
+	shortDeliveryTimeouts(t)
+	ackTimeout = time.Minute
+	transport := &fakeTransport{}
+	smib := &SMIB{slack: transport}
+
+	set := &replySet{at: time.Now()}
+	reply := smib.addReply(set)
+	msg := transport.NewOutgoingMessage("computer says yes", "Xgeneral", slack.RTMsgOptionTS("1.1"))
+	smib.awaitAck(reply, msg.ID)
+	smib.sendMessage(msg)
+
+	for attempt := 1; attempt < maxSendAttempts; attempt++ {
+		waitUntil(t, func() bool { return len(transport.getSent()) == attempt })
+		drain(t, smib)
+		smib.ackError(sendError(transport.getSent()[attempt-1].ID))
+	}
+
+	waitUntil(t, func() bool { return smib.pending() == 0 }, "final attempt should be posted")
+	assert.Len(t, transport.getSent(), maxSendAttempts-1)
+	assert.Equal(t, []map[string]string{{"channel": "Xgeneral", "text": "computer says yes", "thread_ts": "1.1"}}, transport.getPosted())
+	smib.mu.Lock()
+	assert.Equal(t, "1630000009.000900", reply.ts)
+	smib.mu.Unlock()
+}
+
+func TestSMIB_sendMessage_gaveUp(t *testing.T) {
+	shortDeliveryTimeouts(t)
+	transport := &fakeTransport{postErr: errors.New("channel_not_found")}
+	smib := &SMIB{slack: transport}
+	failed := testutil.ToFloat64(metrics.MessagesFailed)
+
+	smib.sendMessage(transport.NewOutgoingMessage("computer says yes", "Xgeneral"))
+	waitUntil(t, func() bool { return smib.pending() == 0 }, "message should be given up on")
+
+	assert.Len(t, transport.getSent(), maxSendAttempts-1)
+	assert.Empty(t, transport.getPosted())
+	assert.Equal(t, failed+1, testutil.ToFloat64(metrics.MessagesFailed))
+}
+
+func TestSMIB_ackError_unidentified(t *testing.T) {
+	transport := &fakeTransport{}
+	smib := &SMIB{slack: transport}
+
+	msg := transport.NewOutgoingMessage("computer says yes", "Xgeneral")
+	smib.sendMessage(msg)
+	drain(t, smib)
+	smib.ackError(errors.New("oops"))
+
+	require.Equal(t, 1, smib.pending(), "errors without an ID wait for the ack timeout")
+	assert.Len(t, transport.getSent(), 1)
+}
@@ -0,0 +1,120 @@
+package smib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nlopes/slack"
+)
+
+// defaultMaxDownload is the largest shared file downloaded if Files.MaxDownloadBytes is unset
+const defaultMaxDownload = 10 << 20
+
+// sharedDir is the directory in a command's temp dir which files shared with the command are
+// downloaded to. Only files the command writes to the temp dir itself are uploaded.
+const sharedDir = "shared"
+
+// sharedFile describes a downloaded file to the command
+type sharedFile struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Mimetype string `json:"mimetype"`
+}
+
+// tooBigError is returned when a shared file is over the download limit
+type tooBigError struct {
+	name string
+}
+
+func (e tooBigError) Error() string {
+	return fmt.Sprintf("file '%s' is too big to download", e.name)
+}
+
+// maxDownload returns the largest file which may be shared with a command
+func (s *SMIB) maxDownload() int64 {
+	if s.Files.MaxDownloadBytes > 0 {
+		return s.Files.MaxDownloadBytes
+	}
+	return defaultMaxDownload
+}
+
+// downloadFiles downloads files into the shared directory in dir, and returns them described as
+// JSON for the command. A tooBigError is returned if any file is over the download limit.
+func (s *SMIB) downloadFiles(dir string, files []slack.File) (string, error) {
+	for _, file := range files {
+		if int64(file.Size) > s.maxDownload() {
+			return "", tooBigError{file.Name}
+		}
+	}
+
+	dir = filepath.Join(dir, sharedDir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create shared files dir: %s", err)
+	}
+	shared := make([]sharedFile, 0, len(files))
+	for _, file := range files {
+		path := filepath.Join(dir, sharedName(dir, file))
+		if err := s.downloadFile(path, file); err != nil {
+			return "", err
+		}
+		shared = append(shared, sharedFile{Path: path, Name: file.Name, Mimetype: file.Mimetype})
+	}
+
+	env, err := json.Marshal(shared)
+	if err != nil {
+		return "", err
+	}
+	return string(env), nil
+}
+
+// sharedName returns a name for file in dir which is safe and not already used
+func sharedName(dir string, file slack.File) string {
+	name := filepath.Base(file.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = file.ID
+	}
+	if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+		name = file.ID + "-" + name
+	}
+	return name
+}
+
+// downloadFile downloads file to path, stopping if it turns out to be over the download limit
+func (s *SMIB) downloadFile(path string, file slack.File) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create shared file: %s", err)
+	}
+	defer f.Close()
+
+	url := file.URLPrivateDownload
+	if url == "" {
+		url = file.URLPrivate
+	}
+	err = s.slack.GetFile(url, &limitedWriter{w: f, n: s.maxDownload(), name: file.Name})
+	if _, ok := err.(tooBigError); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download '%s': %s", file.Name, err)
+	}
+	return f.Close()
+}
+
+// limitedWriter writes at most n bytes to w, then fails with a tooBigError
+type limitedWriter struct {
+	w    io.Writer
+	n    int64
+	name string
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, tooBigError{l.name}
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
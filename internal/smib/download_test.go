@@ -0,0 +1,124 @@
+package smib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMIB_handleMessage_sharedFiles(t *testing.T) {
+	label := slack.File{ID: "F1", Name: "label.png", Mimetype: "image/png", Size: 5, URLPrivateDownload: "https://files/label.png"}
+	tests := []struct {
+		name          string
+		files         []slack.File
+		shared        map[string]string
+		maxDownload   int64
+		wantShared    []sharedFile
+		wantContent   []string
+		wantEphemeral string
+		wantErr       string
+	}{
+		{
+			name:        "one file",
+			files:       []slack.File{label},
+			shared:      map[string]string{"https://files/label.png": "PNG!!"},
+			wantShared:  []sharedFile{{Path: "shared/label.png", Name: "label.png", Mimetype: "image/png"}},
+			wantContent: []string{"PNG!!"},
+		},
+		{
+			name: "same names",
+			files: []slack.File{
+				label,
+				{ID: "F2", Name: "../label.png", Mimetype: "image/png", Size: 6, URLPrivate: "https://files/other.png"},
+			},
+			shared: map[string]string{"https://files/label.png": "PNG!!", "https://files/other.png": "PNG2!!"},
+			wantShared: []sharedFile{
+				{Path: "shared/label.png", Name: "label.png", Mimetype: "image/png"},
+				{Path: "shared/F2-label.png", Name: "../label.png", Mimetype: "image/png"},
+			},
+			wantContent: []string{"PNG!!", "PNG2!!"},
+		},
+		{
+			name:          "too big",
+			files:         []slack.File{label},
+			maxDownload:   4,
+			wantEphemeral: "Sorry <@Xspengler>, label.png is too big for me to download, the limit is 4 bytes.",
+		},
+		{
+			name:          "bigger than it said",
+			files:         []slack.File{label},
+			shared:        map[string]string{"https://files/label.png": "PNG!!!!!!"},
+			maxDownload:   5,
+			wantEphemeral: "Sorry <@Xspengler>, label.png is too big for me to download, the limit is 5 bytes.",
+		},
+		{
+			name:          "download fails",
+			files:         []slack.File{label},
+			wantEphemeral: "Sorry <@Xspengler>, I couldn't download the files you shared with print.",
+			wantErr:       "failed to download 'label.png': 404 Not Found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &reactionTransport{}
+			transport.shared = tt.shared
+			mockCmd := &mockCommand{}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			var gotShared []sharedFile
+			var gotContent []string
+			if tt.wantEphemeral == "" {
+				mockCmd.On("Run", mock.Anything, "print", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+					Return(output(""), nil).Once().
+					Run(func(mock.Arguments) {
+						dir := mockCmd.tempDirs[0]
+						for _, env := range mockCmd.extras[0].Env {
+							if strings.HasPrefix(env, command.FilesEnv+"=") {
+								require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(env, command.FilesEnv+"=")), &gotShared))
+							}
+						}
+						for i, file := range gotShared {
+							content, err := ioutil.ReadFile(file.Path)
+							require.NoError(t, err)
+							gotContent = append(gotContent, string(content))
+							gotShared[i].Path, err = filepath.Rel(dir, file.Path)
+							require.NoError(t, err)
+						}
+					})
+			}
+			smib := SMIB{
+				slack:    transport,
+				cmd:      mockCmd,
+				Feedback: config.Feedback{Style: config.FeedbackNone},
+				Files:    config.Files{MaxDownloadBytes: tt.maxDownload},
+			}
+
+			message := &slack.MessageEvent{Msg: slack.Msg{SubType: "file_share", Text: "?print", Channel: "Xgeneral", User: "Xspengler", Files: tt.files}}
+			err := smib.handleMessage(context.Background(), message)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			drain(t, &smib)
+
+			assert.Equal(t, tt.wantShared, gotShared)
+			assert.Equal(t, tt.wantContent, gotContent)
+			assert.Empty(t, transport.getUploaded(), "shared files aren't uploaded back")
+			if tt.wantEphemeral != "" {
+				require.Len(t, transport.getEphemeral(), 1)
+				assert.Equal(t, tt.wantEphemeral, transport.getEphemeral()[0]["text"])
+			}
+		})
+	}
+}
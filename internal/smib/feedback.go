@@ -0,0 +1,123 @@
+package smib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/config"
+)
+
+// Reactions used by the reactions feedback style
+const (
+	reactionRunning = "hourglass"
+	reactionOK      = "white_check_mark"
+	reactionFailed  = "x"
+)
+
+// typingInterval is how often the typing indicator is refreshed while a command runs, slack clears
+// it after a few seconds.
+var typingInterval = 3 * time.Second
+
+// feedbackStyle returns the feedback style for channel, which Feedback.Channels may name by ID or
+// by name.
+func (s *SMIB) feedbackStyle(channel string) string {
+	if style, ok := s.Feedback.Channels[channel]; ok {
+		return style
+	}
+	if len(s.Feedback.Channels) > 0 {
+		name, _ := s.conversationContext(channel)
+		if style, ok := s.Feedback.Channels[name]; ok {
+			return style
+		}
+	}
+	if s.Feedback.Style == "" {
+		return config.FeedbackTyping
+	}
+	return s.Feedback.Style
+}
+
+// startFeedback shows the command in message is running, in the style configured for its channel.
+// The returned func ends the feedback, showing whether the command succeeded. Reactions are left
+// alone if the message was edited or deleted while the command ran, the edit clears them for its
+// own run.
+func (s *SMIB) startFeedback(message *slack.MessageEvent, replies *replySet) func(ok bool) {
+	channel := message.Channel
+	switch s.feedbackStyle(channel) {
+	case config.FeedbackNone:
+		return func(bool) {}
+	case config.FeedbackReactions:
+		item := slack.NewRefToMessage(channel, message.Timestamp)
+		s.react(item, reactionRunning, true)
+		return func(ok bool) {
+			if s.superseded(replies) {
+				return
+			}
+			s.react(item, reactionRunning, false)
+			if ok {
+				s.react(item, reactionOK, true)
+			} else {
+				s.react(item, reactionFailed, true)
+			}
+		}
+	}
+
+	s.sendTyping(channel)
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(typingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sendTyping(channel)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func(bool) { close(stop) }
+}
+
+// sendTyping shows SMIB typing in channel, unless the outbox is busy or short of tokens. The
+// indicator isn't worth holding up replies for, and is refreshed soon anyway.
+func (s *SMIB) sendTyping(channel string) {
+	msg := s.slack.NewTypingMessage(channel)
+	s.getOutbox().offer(channel, func() error {
+		return s.transmit(msg)
+	})
+}
+
+// clearFeedback removes the reactions of a previous run from message, which may still be running,
+// before it is run again
+func (s *SMIB) clearFeedback(message *slack.MessageEvent) {
+	if s.feedbackStyle(message.Channel) != config.FeedbackReactions {
+		return
+	}
+	item := slack.NewRefToMessage(message.Channel, message.Timestamp)
+	s.react(item, reactionRunning, false)
+	s.react(item, reactionOK, false)
+	s.react(item, reactionFailed, false)
+}
+
+// react adds or removes the reaction name on item, in turn with the channel's messages
+func (s *SMIB) react(item slack.ItemRef, name string, add bool) {
+	s.enqueue(item.Channel, func() error {
+		change, verb := s.slack.AddReaction, "add"
+		if !add {
+			change, verb = s.slack.RemoveReaction, "remove"
+		}
+		err := change(name, item)
+		var limited *slack.RateLimitedError
+		switch {
+		case err == nil, errors.As(err, &limited):
+			return err
+		case err.Error() == "already_reacted", err.Error() == "no_reaction":
+			return nil
+		}
+		log.Print(fmt.Sprintf("Failed to %s reaction %s in %s: %s", verb, name, item.Channel, err))
+		return nil
+	})
+}
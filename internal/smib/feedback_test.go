@@ -0,0 +1,321 @@
+package smib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// reactionTransport records reactions added and removed, as "+name" and "-name"
+type reactionTransport struct {
+	fakeTransport
+
+	reactionsMu sync.Mutex
+	reactions   []string
+}
+
+func (r *reactionTransport) AddReaction(name string, item slack.ItemRef) error {
+	r.reactionsMu.Lock()
+	defer r.reactionsMu.Unlock()
+	r.reactions = append(r.reactions, "+"+name)
+	return nil
+}
+
+func (r *reactionTransport) RemoveReaction(name string, item slack.ItemRef) error {
+	r.reactionsMu.Lock()
+	defer r.reactionsMu.Unlock()
+	r.reactions = append(r.reactions, "-"+name)
+	return nil
+}
+
+func (r *reactionTransport) NewTypingMessage(channelID string) *slack.OutgoingMessage {
+	return &slack.OutgoingMessage{Type: "typing", Channel: channelID}
+}
+
+func (r *reactionTransport) GetUserInfo(user string) (*slack.User, error) {
+	return &slack.User{ID: user, Name: "spengler"}, nil
+}
+
+// GetConversationInfo says conversations with D IDs are DMs and every other is #general
+func (r *reactionTransport) GetConversationInfo(channelID string, includeLocale bool) (*slack.Channel, error) {
+	if strings.HasPrefix(channelID, "D") {
+		channel := &slack.Channel{}
+		channel.ID = channelID
+		channel.IsIM = true
+		return channel, nil
+	}
+	return &slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}}, nil
+}
+
+func (r *reactionTransport) getReactions() []string {
+	r.reactionsMu.Lock()
+	defer r.reactionsMu.Unlock()
+	return append([]string{}, r.reactions...)
+}
+
+func (r *reactionTransport) typing() int {
+	count := 0
+	for _, msg := range r.getSent() {
+		if msg.Type == "typing" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSMIB_feedbackStyle(t *testing.T) {
+	tests := []struct {
+		name     string
+		feedback config.Feedback
+		want     string
+	}{
+		{
+			name: "unset",
+			want: config.FeedbackTyping,
+		},
+		{
+			name:     "default style",
+			feedback: config.Feedback{Style: config.FeedbackReactions},
+			want:     config.FeedbackReactions,
+		},
+		{
+			name: "channel by ID",
+			feedback: config.Feedback{
+				Style:    config.FeedbackTyping,
+				Channels: map[string]string{"Xgeneral": config.FeedbackNone},
+			},
+			want: config.FeedbackNone,
+		},
+		{
+			name: "channel by name",
+			feedback: config.Feedback{
+				Style:    config.FeedbackTyping,
+				Channels: map[string]string{"general": config.FeedbackReactions},
+			},
+			want: config.FeedbackReactions,
+		},
+		{
+			name: "other channel",
+			feedback: config.Feedback{
+				Style:    config.FeedbackNone,
+				Channels: map[string]string{"random": config.FeedbackReactions},
+			},
+			want: config.FeedbackNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			smib := SMIB{slack: &reactionTransport{}, Feedback: tt.feedback}
+			assert.Equal(t, tt.want, smib.feedbackStyle("Xgeneral"))
+		})
+	}
+}
+
+func TestSMIB_handleMessage_reactions(t *testing.T) {
+	tests := []struct {
+		name   string
+		output func() (*closedChecker, error)
+		want   []string
+	}{
+		{
+			name: "success",
+			output: func() (*closedChecker, error) {
+				return output("open\n"), nil
+			},
+			want: []string{"+hourglass", "-hourglass", "+white_check_mark"},
+		},
+		{
+			name: "command failed",
+			output: func() (*closedChecker, error) {
+				return &closedChecker{reader: bytes.NewReader([]byte("i bad\n")), exitErr: errors.New("exit status 1")}, nil
+			},
+			want: []string{"+hourglass", "-hourglass", "+x"},
+		},
+		{
+			name: "command not found",
+			output: func() (*closedChecker, error) {
+				return nil, command.NotFoundError("")
+			},
+			want: []string{"+hourglass", "-hourglass", "+x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &reactionTransport{}
+			mockCmd := &mockCommand{}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			out, err := tt.output()
+			if out != nil {
+				mockCmd.On("Run", mock.Anything, "door", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+					Return(out, err).Once()
+			} else {
+				mockCmd.On("Run", mock.Anything, "door", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+					Return(ioutil.NopCloser(nil), err).Once()
+			}
+			smib := SMIB{
+				slack:    transport,
+				cmd:      mockCmd,
+				Feedback: config.Feedback{Style: config.FeedbackReactions},
+			}
+
+			message := &slack.MessageEvent{Msg: slack.Msg{Text: "?door", Channel: "Xgeneral", User: "Xspengler", Timestamp: "100.000100"}}
+			require.NoError(t, smib.handleMessage(context.Background(), message))
+			drain(t, &smib)
+			assert.Equal(t, tt.want, transport.getReactions())
+			assert.Zero(t, transport.typing(), "reactions replace the typing indicator")
+		})
+	}
+}
+
+func TestSMIB_handleMessage_typingRefreshed(t *testing.T) {
+	defer func(interval time.Duration) { typingInterval = interval }(typingInterval)
+	typingInterval = 5 * time.Millisecond
+
+	transport := &reactionTransport{}
+	cmdOut := make(chan struct{})
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	mockCmd.On("Run", mock.Anything, "sleep", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(&closedChecker{reader: &blockingReader{until: cmdOut}}, nil).Once()
+	smib := SMIB{slack: transport, cmd: mockCmd}
+
+	message := &slack.MessageEvent{Msg: slack.Msg{Text: "?sleep", Channel: "Xgeneral", User: "Xspengler", Timestamp: "100.000100"}}
+	done := make(chan error)
+	go func() {
+		done <- smib.handleMessage(context.Background(), message)
+	}()
+	waitUntil(t, func() bool { return transport.typing() >= 3 }, "typing was not refreshed")
+	close(cmdOut)
+	require.NoError(t, <-done)
+
+	drain(t, &smib)
+	typing := transport.typing()
+	time.Sleep(20 * time.Millisecond)
+	drain(t, &smib)
+	assert.Equal(t, typing, transport.typing(), "typing stops when the command finishes")
+	assert.Empty(t, transport.getReactions())
+}
+
+func TestSMIB_handleMessage_typingSpareTokens(t *testing.T) {
+	defer func(interval time.Duration) { typingInterval = interval }(typingInterval)
+	typingInterval = 5 * time.Millisecond
+
+	transport := &reactionTransport{}
+	cmdOut := make(chan struct{})
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	mockCmd.On("Run", mock.Anything, "sleep", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(&closedChecker{reader: io.MultiReader(&blockingReader{until: cmdOut}, bytes.NewReader([]byte("awake\n")))}, nil).Once()
+	smib := SMIB{slack: transport, cmd: mockCmd, SendInterval: time.Hour, SendBurst: 3}
+	defer smib.getOutbox().close()
+
+	message := &slack.MessageEvent{Msg: slack.Msg{Text: "?sleep", Channel: "Xgeneral", User: "Xspengler", Timestamp: "100.000100"}}
+	done := make(chan error)
+	go func() {
+		done <- smib.handleMessage(context.Background(), message)
+	}()
+	waitUntil(t, func() bool { return transport.typing() >= 2 }, "typing was not refreshed")
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2, transport.typing(), "typing stops refreshing when one token is left")
+
+	close(cmdOut)
+	require.NoError(t, <-done)
+	drain(t, &smib)
+	sent := transport.getSent()
+	require.Len(t, sent, 3)
+	assert.Equal(t, "awake\n", sent[2].Text, "the reply has the last token")
+}
+
+func TestSMIB_handleEdit_clearsReactions(t *testing.T) {
+	transport := &reactionTransport{}
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	mockCmd.On("Run", mock.Anything, "door", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(output("open\n"), nil).Once()
+	smib := SMIB{
+		slack:      transport,
+		cmd:        mockCmd,
+		EditWindow: time.Minute,
+		Feedback:   config.Feedback{Channels: map[string]string{"general": config.FeedbackReactions}},
+	}
+
+	edit := &slack.MessageEvent{
+		Msg:             slack.Msg{SubType: "message_changed", Channel: "Xgeneral"},
+		SubMessage:      &slack.Msg{Text: "?door", User: "Xspengler", Timestamp: tsNow()},
+		PreviousMessage: &slack.Msg{Text: "?dor", User: "Xspengler"},
+	}
+	require.NoError(t, smib.handleMessage(context.Background(), edit))
+	drain(t, &smib)
+	assert.Equal(t, []string{"-hourglass", "-white_check_mark", "-x", "+hourglass", "-hourglass", "+white_check_mark"}, transport.getReactions())
+}
+
+func TestSMIB_handleEdit_cancelsReactions(t *testing.T) {
+	transport := &reactionTransport{}
+	cmdOut := make(chan struct{})
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	mockCmd.On("Run", mock.Anything, "dor", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(&closedChecker{reader: &blockingReader{until: cmdOut}, exitErr: errors.New("killed")}, nil).Once()
+	mockCmd.On("Run", mock.Anything, "door", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(output("open\n"), nil).Once()
+	smib := SMIB{
+		slack:      transport,
+		cmd:        mockCmd,
+		EditWindow: time.Minute,
+		Feedback:   config.Feedback{Channels: map[string]string{"general": config.FeedbackReactions}},
+	}
+
+	ts := tsNow()
+	message := &slack.MessageEvent{Msg: slack.Msg{Text: "?dor", Channel: "Xgeneral", User: "Xspengler", Timestamp: ts}}
+	done := make(chan error)
+	go func() {
+		done <- smib.handleMessage(context.Background(), message)
+	}()
+	waitUntil(t, func() bool { return len(transport.getReactions()) == 1 }, "the first run didn't start")
+
+	edit := &slack.MessageEvent{
+		Msg:             slack.Msg{SubType: "message_changed", Channel: "Xgeneral"},
+		SubMessage:      &slack.Msg{Text: "?door", User: "Xspengler", Timestamp: ts},
+		PreviousMessage: &slack.Msg{Text: "?dor", User: "Xspengler"},
+	}
+	require.NoError(t, smib.handleMessage(context.Background(), edit))
+	close(cmdOut)
+	require.NoError(t, <-done)
+	drain(t, &smib)
+	assert.Equal(t, []string{"+hourglass", "-hourglass", "-white_check_mark", "-x", "+hourglass", "-hourglass", "+white_check_mark"},
+		transport.getReactions(), "the cancelled run leaves no reactions")
+}
+
+// blockingReader returns EOF once until is closed
+type blockingReader struct {
+	until chan struct{}
+}
+
+func (b *blockingReader) Read([]byte) (int, error) {
+	<-b.until
+	return 0, io.EOF
+}
+
+// tsNow returns a slack timestamp for the current time
+func tsNow() string {
+	return fmt.Sprintf("%d.000100", time.Now().Unix())
+}
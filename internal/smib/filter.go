@@ -0,0 +1,44 @@
+package smib
+
+import (
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/metrics"
+)
+
+// userSubtypes are the message subtypes which are written by a person and may be commands, every
+// other subtype is a system message such as channel_join or a hidden one such as message_changed.
+var userSubtypes = map[string]bool{
+	"":                 true,
+	"thread_broadcast": true,
+	"file_share":       true,
+}
+
+// ignoreReason returns why message must not be treated as a command, or "" if it may be one.
+// Messages from bots are ignored unless the bot is in AllowedBots, and SMIB's own messages are
+// always ignored so a command printing "?something" can't start a loop.
+func (s *SMIB) ignoreReason(message *slack.MessageEvent) string {
+	switch {
+	case message.Hidden:
+		return "hidden"
+	case message.User != "" && message.User == s.getSelfID():
+		return "self"
+	case message.BotID != "" || message.SubType == "bot_message":
+		if contains(s.AllowedBots, message.BotID) || (message.User != "" && contains(s.AllowedBots, message.User)) {
+			return ""
+		}
+		return "bot"
+	case !userSubtypes[message.SubType]:
+		return "subtype"
+	}
+	return ""
+}
+
+// ignoreMessage reports whether message must not be treated as a command
+func (s *SMIB) ignoreMessage(message *slack.MessageEvent) bool {
+	reason := s.ignoreReason(message)
+	if reason == "" {
+		return false
+	}
+	metrics.MessagesIgnored.WithLabelValues(reason).Inc()
+	return true
+}
@@ -0,0 +1,47 @@
+package smib
+
+import (
+	"testing"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSMIB_ignoreReason(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  slack.Msg
+		want string
+	}{
+		{name: "user message", msg: slack.Msg{User: "Xspengler", Text: "?door"}},
+		{name: "thread broadcast", msg: slack.Msg{User: "Xspengler", SubType: "thread_broadcast", Text: "?door"}},
+		{name: "file share", msg: slack.Msg{User: "Xspengler", SubType: "file_share", Text: "?qr"}},
+		{name: "own message", msg: slack.Msg{User: "Usmib", Text: "?door"}, want: "self"},
+		{name: "own bot message", msg: slack.Msg{User: "Usmib", BotID: "Bsmib", Text: "?door"}, want: "self"},
+		{name: "bot message subtype", msg: slack.Msg{SubType: "bot_message", Username: "webhook", Text: "?door"}, want: "bot"},
+		{name: "bot id", msg: slack.Msg{User: "Uother", BotID: "Bother", Text: "?door"}, want: "bot"},
+		{name: "allowed bot by bot id", msg: slack.Msg{SubType: "bot_message", BotID: "Bfriend", Text: "?door"}},
+		{name: "allowed bot by user id", msg: slack.Msg{User: "Ufriend", BotID: "Bfriend2", Text: "?door"}},
+		{name: "hidden", msg: slack.Msg{SubType: "message_changed", Hidden: true}, want: "hidden"},
+		{name: "message deleted", msg: slack.Msg{SubType: "message_deleted", Hidden: true}, want: "hidden"},
+		{name: "message changed without hidden", msg: slack.Msg{SubType: "message_changed"}, want: "subtype"},
+		{name: "channel join", msg: slack.Msg{User: "Xspengler", SubType: "channel_join", Text: "<@Xspengler> has joined the channel"}, want: "subtype"},
+		{name: "channel leave", msg: slack.Msg{User: "Xspengler", SubType: "channel_leave"}, want: "subtype"},
+		{name: "channel topic", msg: slack.Msg{User: "Xspengler", SubType: "channel_topic", Text: "?door"}, want: "subtype"},
+		{name: "channel purpose", msg: slack.Msg{User: "Xspengler", SubType: "channel_purpose"}, want: "subtype"},
+		{name: "channel name", msg: slack.Msg{User: "Xspengler", SubType: "channel_name"}, want: "subtype"},
+		{name: "group join", msg: slack.Msg{User: "Xspengler", SubType: "group_join"}, want: "subtype"},
+		{name: "pinned item", msg: slack.Msg{User: "Xspengler", SubType: "pinned_item"}, want: "subtype"},
+		{name: "me message", msg: slack.Msg{User: "Xspengler", SubType: "me_message", Text: "?door"}, want: "subtype"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			smib := &SMIB{
+				AllowedBots: []string{"Bfriend", "Ufriend"},
+				selfID:      "Usmib",
+			}
+			msg := slack.MessageEvent{Msg: tt.msg}
+			assert.Equal(t, tt.want, smib.ignoreReason(&msg))
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package smib
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthy returns an error if SMIB has been disconnected from slack for longer than maxDown
+func (s *SMIB) healthy(maxDown time.Duration) error {
+	status := s.Status()
+	if status.State == StateConnected {
+		return nil
+	}
+	down := time.Since(status.DownSince)
+	if down > maxDown {
+		return fmt.Errorf("disconnected from slack for %s", down.Round(time.Second))
+	}
+	return nil
+}
+
+// HealthHandler serves a health check which fails if SMIB has been disconnected from slack for
+// longer than maxDown.
+func (s *SMIB) HealthHandler(maxDown time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.healthy(maxDown); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
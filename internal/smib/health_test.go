@@ -0,0 +1,74 @@
+package smib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/somakeit/slacker-smib/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSMIB_HealthHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     State
+		downSince time.Time
+		wantCode  int
+	}{
+		{
+			name:     "connected",
+			state:    StateConnected,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:      "recently disconnected",
+			state:     StateDisconnected,
+			downSince: time.Now().Add(-time.Second),
+			wantCode:  http.StatusOK,
+		},
+		{
+			name:      "disconnected too long",
+			state:     StateConnecting,
+			downSince: time.Now().Add(-time.Hour),
+			wantCode:  http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			smib := &SMIB{status: Status{State: tt.state, DownSince: tt.downSince}}
+
+			w := httptest.NewRecorder()
+			smib.HealthHandler(time.Minute).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+}
+
+func TestSMIB_updateStatus_health(t *testing.T) {
+	smib := New(&fakeTransport{}, nil)
+	defer smib.getOutbox().close()
+	connects := testutil.ToFloat64(metrics.Connects)
+	disconnects := testutil.ToFloat64(metrics.Disconnects)
+	assert.NoError(t, smib.healthy(time.Minute), "just started")
+	assert.Error(t, smib.healthy(0))
+
+	smib.updateStatus(StateConnected, nil)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.Connected))
+	assert.Equal(t, connects+1, testutil.ToFloat64(metrics.Connects))
+	assert.NoError(t, smib.healthy(0))
+
+	smib.updateStatus(StateDisconnected, nil)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.Connected))
+	assert.Equal(t, disconnects+1, testutil.ToFloat64(metrics.Disconnects))
+	downSince := smib.Status().DownSince
+	assert.WithinDuration(t, time.Now(), downSince, time.Second)
+	assert.NoError(t, smib.healthy(time.Minute))
+	assert.Error(t, smib.healthy(0))
+
+	smib.updateStatus(StateConnecting, nil)
+	assert.Equal(t, downSince, smib.Status().DownSince, "reconnecting doesn't reset the downtime")
+	assert.Equal(t, disconnects+1, testutil.ToFloat64(metrics.Disconnects))
+}
@@ -0,0 +1,351 @@
+package smib
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/metrics"
+)
+
+const (
+	defaultSendInterval = time.Second
+	defaultSendBurst    = 5
+	// maxQueued is how many calls may wait in the outbox, beyond this senders block until there is
+	// room. This holds up the commands producing the output rather than using unbounded memory.
+	maxQueued = 1000
+	// rateLimitBackoff is how long to stop sending when slack says we are rate limited but not for
+	// how long.
+	rateLimitBackoff = 5 * time.Second
+)
+
+// clock is the source of time for the outbox, tests replace it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// outgoing is a queued call to slack on behalf of a channel
+type outgoing struct {
+	channel string
+	// send makes the call, it returns a *slack.RateLimitedError if it should be retried later
+	send func() error
+}
+
+// outbox makes calls to slack one at a time, in order for each channel and taking turns between
+// channels. Calls are paced with a token bucket, allowing burst calls at once and then one every
+// interval, and are paused when slack says we are rate limited. An interval of 0 disables pacing.
+type outbox struct {
+	clock    clock
+	interval time.Duration
+	burst    int
+	limit    int
+
+	mu          sync.Mutex
+	notFull     *sync.Cond
+	channels    map[string][]*outgoing
+	ready       []string
+	queued      int
+	tokens      float64
+	filled      time.Time
+	pausedUntil time.Time
+	held        bool
+	closed      bool
+	wake        chan struct{}
+	// stopped is closed when the outbox is closed
+	stopped chan struct{}
+}
+
+// newOutbox returns a running outbox
+func newOutbox(c clock, interval time.Duration, burst int) *outbox {
+	o := &outbox{
+		clock:    c,
+		interval: interval,
+		burst:    burst,
+		limit:    maxQueued,
+		channels: map[string][]*outgoing{},
+		tokens:   float64(burst),
+		filled:   c.Now(),
+		wake:     make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+	}
+	o.notFull = sync.NewCond(&o.mu)
+	go o.run()
+	return o
+}
+
+// enqueue queues send to be called for channel, blocking while the outbox is full. It returns
+// false if the outbox is closed.
+func (o *outbox) enqueue(channel string, send func() error) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.queued >= o.limit && !o.closed {
+		o.notFull.Wait()
+	}
+	if o.closed {
+		return false
+	}
+	o.push(channel, send)
+	return true
+}
+
+// offer queues send for channel like enqueue, but only if it can be made straight away and still
+// leave a token for the next call, so calls which don't matter much never hold up those which do.
+// It returns whether send was queued.
+func (o *outbox) offer(channel string, send func() error) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.clock.Now()
+	if o.closed || o.held || o.queued > 0 || now.Before(o.pausedUntil) {
+		return false
+	}
+	if o.interval > 0 {
+		if o.refill(now); o.tokens < 2 {
+			return false
+		}
+	}
+	o.push(channel, send)
+	return true
+}
+
+// push adds send to channel's queue, o.mu must be held
+func (o *outbox) push(channel string, send func() error) {
+	if len(o.channels[channel]) == 0 {
+		o.ready = append(o.ready, channel)
+	}
+	o.channels[channel] = append(o.channels[channel], &outgoing{channel: channel, send: send})
+	o.queued++
+	metrics.OutgoingQueueDepth.Inc()
+	o.signal()
+}
+
+// backoff stops all calls for d
+func (o *outbox) backoff(d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	metrics.RateLimited.Inc()
+	if until := o.clock.Now().Add(d); until.After(o.pausedUntil) {
+		o.pausedUntil = until
+	}
+	o.signal()
+}
+
+// hold stops all calls until it is called again with held false
+func (o *outbox) hold(held bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.held = held
+	o.signal()
+}
+
+// close stops the outbox, calls still queued are dropped
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	close(o.stopped)
+	if o.queued > 0 {
+		log.Printf("Dropping %d queued messages", o.queued)
+	}
+	metrics.OutgoingQueueDepth.Sub(float64(o.queued))
+	o.notFull.Broadcast()
+	o.signal()
+}
+
+// signal wakes the sender, o.mu must be held
+func (o *outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run makes queued calls until the outbox is closed
+func (o *outbox) run() {
+	for {
+		item, ok := o.next()
+		if !ok {
+			return
+		}
+
+		err := item.send()
+		var limited *slack.RateLimitedError
+		if errors.As(err, &limited) {
+			log.Print("Rate limited by slack, retrying in ", limited.RetryAfter)
+			o.backoff(limited.RetryAfter)
+			o.requeue(item)
+			continue
+		}
+		if err != nil {
+			log.Print("Failed to send to slack: ", err)
+		}
+		o.done()
+	}
+}
+
+// next waits until a call is queued and may be made, returning false if the outbox is closed
+func (o *outbox) next() (*outgoing, bool) {
+	for {
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return nil, false
+		}
+		var wait <-chan time.Time
+		if len(o.ready) > 0 && !o.held {
+			delay := o.delay()
+			if delay <= 0 {
+				item := o.pop()
+				o.mu.Unlock()
+				return item, true
+			}
+			wait = o.clock.After(delay)
+		}
+		o.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-o.wake:
+		}
+	}
+}
+
+// delay returns how long until the next call may be made, taking a token if it may be made now.
+// o.mu must be held.
+func (o *outbox) delay() time.Duration {
+	now := o.clock.Now()
+	if now.Before(o.pausedUntil) {
+		return o.pausedUntil.Sub(now)
+	}
+	if o.interval <= 0 {
+		return 0
+	}
+
+	o.refill(now)
+	if o.tokens >= 1 {
+		o.tokens--
+		return 0
+	}
+	return time.Duration((1 - o.tokens) * float64(o.interval))
+}
+
+// refill adds the tokens earned since the bucket was last filled, up to the burst. o.mu must be
+// held.
+func (o *outbox) refill(now time.Time) {
+	o.tokens += float64(now.Sub(o.filled)) / float64(o.interval)
+	if o.tokens > float64(o.burst) {
+		o.tokens = float64(o.burst)
+	}
+	o.filled = now
+}
+
+// pop takes the next call from the channel whose turn it is, o.mu must be held
+func (o *outbox) pop() *outgoing {
+	channel := o.ready[0]
+	o.ready = o.ready[1:]
+	queue := o.channels[channel]
+	item := queue[0]
+	if len(queue) > 1 {
+		o.channels[channel] = queue[1:]
+		o.ready = append(o.ready, channel)
+	} else {
+		delete(o.channels, channel)
+	}
+	return item
+}
+
+// requeue puts item back at the front of the queue
+func (o *outbox) requeue(item *outgoing) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.channels[item.channel]) == 0 {
+		o.ready = append([]string{item.channel}, o.ready...)
+	} else {
+		o.ready = append([]string{item.channel}, removeString(o.ready, item.channel)...)
+	}
+	o.channels[item.channel] = append([]*outgoing{item}, o.channels[item.channel]...)
+}
+
+// done records that a call has been made
+func (o *outbox) done() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.queued--
+	metrics.OutgoingQueueDepth.Dec()
+	o.notFull.Signal()
+}
+
+func removeString(list []string, s string) []string {
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// rateLimited pauses the outbox if err, from an ack_error event, says SMIB is rate limited
+func (s *SMIB) rateLimited(err error) {
+	var limited *slack.RateLimitedError
+	if errors.As(err, &limited) {
+		s.getOutbox().backoff(limited.RetryAfter)
+	}
+}
+
+// getOutbox returns the outbox, starting it on first use
+func (s *SMIB) getOutbox() *outbox {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.out == nil {
+		s.out = newOutbox(realClock{}, s.SendInterval, s.SendBurst)
+	}
+	return s.out
+}
+
+// enqueue queues a call to slack for channel
+func (s *SMIB) enqueue(channel string, send func() error) {
+	if !s.getOutbox().enqueue(channel, send) {
+		log.Print("Not sending to ", channel, ", smib is shutting down")
+	}
+}
+
+// errShuttingDown is returned by call when the outbox is closed before the call is made
+var errShuttingDown = errors.New("smib is shutting down")
+
+// call queues a call to slack for channel like enqueue, and waits for its result. Calls which are
+// rate limited are retried.
+func (s *SMIB) call(channel string, send func() error) error {
+	out := s.getOutbox()
+	result := make(chan error, 1)
+	queued := out.enqueue(channel, func() error {
+		err := send()
+		var limited *slack.RateLimitedError
+		if !errors.As(err, &limited) {
+			result <- err
+		}
+		return err
+	})
+	if !queued {
+		return errShuttingDown
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-out.stopped:
+		return errShuttingDown
+	}
+}
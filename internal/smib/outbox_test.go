@@ -0,0 +1,342 @@
+package smib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitUntil polls condition until it is true, failing the test if it takes longer than a second
+func waitUntil(t *testing.T, condition func() bool, msgAndArgs ...interface{}) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "condition never satisfied", msgAndArgs...)
+		}
+	}
+}
+
+// fakeClock is a clock which only moves when told to
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 8, 26, 19, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock on by d, firing any timers which are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = waiting
+}
+
+// waitForTimer waits until something is waiting on the clock
+func (c *fakeClock) waitForTimer(t *testing.T) {
+	waitUntil(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.waiters) > 0
+	}, "nothing is waiting on the clock")
+}
+
+// sent records calls made by an outbox
+type sent struct {
+	mu    sync.Mutex
+	calls []string
+	times []time.Time
+}
+
+func (s *sent) call(c clock, name string) func() error {
+	return func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.calls = append(s.calls, name)
+		s.times = append(s.times, c.Now())
+		return nil
+	}
+}
+
+func (s *sent) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.calls)
+}
+
+func (s *sent) waitFor(t *testing.T, n int) {
+	waitUntil(t, func() bool { return s.count() >= n }, "expected %d calls", n)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, n, s.count(), "too many calls")
+}
+
+// drain waits for SMIB's outbox to make every queued call
+func drain(t *testing.T, s *SMIB) {
+	o := s.getOutbox()
+	waitUntil(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.queued == 0
+	}, "outbox did not drain")
+}
+
+func TestOutbox_rate(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	o := newOutbox(clock, time.Second, 3)
+	defer o.close()
+
+	s := &sent{}
+	for i := 0; i < 10; i++ {
+		o.enqueue("Xgeneral", s.call(clock, fmt.Sprint(i)))
+	}
+	s.waitFor(t, 3)
+
+	for i := 4; i <= 10; i++ {
+		clock.waitForTimer(t)
+		clock.Advance(time.Second)
+		s.waitFor(t, i)
+	}
+
+	var offsets []time.Duration
+	for _, at := range s.times {
+		offsets = append(offsets, at.Sub(start))
+	}
+	assert.Equal(t, []time.Duration{0, 0, 0, 1 * time.Second, 2 * time.Second, 3 * time.Second,
+		4 * time.Second, 5 * time.Second, 6 * time.Second, 7 * time.Second}, offsets)
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, s.calls)
+
+	// A quiet spell refills the bucket, but no further than the burst
+	clock.Advance(time.Minute)
+	for i := 0; i < 4; i++ {
+		o.enqueue("Xgeneral", s.call(clock, "later"))
+	}
+	s.waitFor(t, 13)
+}
+
+func TestOutbox_order(t *testing.T) {
+	clock := newFakeClock()
+	o := newOutbox(clock, 0, 0)
+	defer o.close()
+
+	s := &sent{}
+	release := make(chan struct{})
+	o.enqueue("Xblocker", func() error {
+		<-release
+		return nil
+	})
+	waitUntil(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return len(o.ready) == 0
+	})
+
+	for _, call := range []string{"A1", "A2", "A3", "B1", "B2", "C1"} {
+		o.enqueue("X"+call[:1], s.call(clock, call))
+	}
+	close(release)
+	s.waitFor(t, 6)
+	assert.Equal(t, []string{"A1", "B1", "C1", "A2", "B2", "A3"}, s.calls)
+}
+
+func TestOutbox_rateLimited(t *testing.T) {
+	clock := newFakeClock()
+	o := newOutbox(clock, 0, 0)
+	defer o.close()
+
+	s := &sent{}
+	limited := true
+	o.enqueue("Xgeneral", func() error {
+		if limited {
+			limited = false
+			return fmt.Errorf("chat.update: %w", &slack.RateLimitedError{RetryAfter: 30 * time.Second})
+		}
+		return s.call(clock, "A1")()
+	})
+	o.enqueue("Xgeneral", s.call(clock, "A2"))
+	o.enqueue("Xother", s.call(clock, "B1"))
+
+	clock.waitForTimer(t)
+	clock.Advance(29 * time.Second)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, 0, s.count(), "nothing should be sent while rate limited")
+
+	clock.Advance(time.Second)
+	s.waitFor(t, 3)
+	assert.Equal(t, []string{"A1", "B1", "A2"}, s.calls, "the limited call should be retried first")
+}
+
+func TestOutbox_backoff(t *testing.T) {
+	clock := newFakeClock()
+	o := newOutbox(clock, 0, 0)
+	defer o.close()
+
+	o.backoff(time.Minute)
+	o.backoff(time.Second)
+	s := &sent{}
+	o.enqueue("Xgeneral", s.call(clock, "A1"))
+
+	clock.waitForTimer(t)
+	clock.Advance(59 * time.Second)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, 0, s.count(), "a shorter backoff should not cut a longer one short")
+	clock.waitForTimer(t)
+	clock.Advance(time.Second)
+	s.waitFor(t, 1)
+}
+
+func TestOutbox_full(t *testing.T) {
+	clock := newFakeClock()
+	o := newOutbox(clock, time.Second, 1)
+	o.mu.Lock()
+	o.limit = 2
+	o.mu.Unlock()
+
+	s := &sent{}
+	o.enqueue("Xgeneral", s.call(clock, "A1"))
+	s.waitFor(t, 1)
+	o.enqueue("Xgeneral", s.call(clock, "A2"))
+	o.enqueue("Xgeneral", s.call(clock, "A3"))
+
+	blocked := make(chan bool)
+	go func() {
+		blocked <- o.enqueue("Xgeneral", s.call(clock, "A4"))
+	}()
+	select {
+	case <-blocked:
+		assert.Fail(t, "enqueue should block while the outbox is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.waitForTimer(t)
+	clock.Advance(time.Second)
+	assert.True(t, <-blocked)
+
+	o.close()
+	assert.False(t, o.enqueue("Xgeneral", s.call(clock, "A5")), "enqueue should fail once closed")
+}
+
+func TestOutbox_offer(t *testing.T) {
+	clock := newFakeClock()
+	o := newOutbox(clock, time.Second, 3)
+	defer o.close()
+
+	s := &sent{}
+	assert.True(t, o.offer("Xgeneral", s.call(clock, "A1")))
+	s.waitFor(t, 1)
+	assert.True(t, o.offer("Xgeneral", s.call(clock, "A2")))
+	s.waitFor(t, 2)
+	assert.False(t, o.offer("Xgeneral", s.call(clock, "A3")), "the last token is kept for enqueued calls")
+
+	clock.Advance(time.Second)
+	o.hold(true)
+	assert.True(t, o.enqueue("Xgeneral", s.call(clock, "A4")))
+	assert.False(t, o.offer("Xother", s.call(clock, "B1")), "not while held")
+	o.hold(false)
+	s.waitFor(t, 3)
+	assert.False(t, o.offer("Xother", s.call(clock, "B2")), "A4 took the token")
+
+	clock.Advance(time.Second)
+	o.backoff(time.Minute)
+	assert.False(t, o.offer("Xother", s.call(clock, "B3")), "not while rate limited")
+	clock.Advance(time.Minute)
+	assert.True(t, o.offer("Xother", s.call(clock, "B4")))
+	s.waitFor(t, 4)
+	assert.Equal(t, []string{"A1", "A2", "A4", "B4"}, s.calls)
+}
+
+func TestSMIB_rateLimited(t *testing.T) {
+	smib := &SMIB{}
+	o := smib.getOutbox()
+	defer o.close()
+
+	smib.rateLimited(errors.New("channel_not_found"))
+	o.mu.Lock()
+	assert.True(t, o.pausedUntil.IsZero())
+	o.mu.Unlock()
+
+	smib.rateLimited(fmt.Errorf("message 1: %w", &slack.RateLimitedError{RetryAfter: time.Minute}))
+	o.mu.Lock()
+	assert.WithinDuration(t, time.Now().Add(time.Minute), o.pausedUntil, time.Second)
+	o.mu.Unlock()
+}
+
+func TestSMIB_call(t *testing.T) {
+	smib := &SMIB{}
+	o := smib.getOutbox()
+
+	o.hold(true)
+	result := make(chan error, 1)
+	attempts := 0
+	go func() {
+		result <- smib.call("Xgeneral", func() error {
+			if attempts++; attempts == 1 {
+				return &slack.RateLimitedError{RetryAfter: time.Millisecond}
+			}
+			return errors.New("channel_not_found")
+		})
+	}()
+	select {
+	case <-result:
+		assert.Fail(t, "call returned while the outbox was held")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	o.hold(false)
+	select {
+	case err := <-result:
+		assert.EqualError(t, err, "channel_not_found", "the rate limited call should be retried")
+		assert.Equal(t, 2, attempts)
+	case <-time.After(time.Second):
+		assert.Fail(t, "call never returned")
+	}
+
+	o.hold(true)
+	go func() {
+		result <- smib.call("Xgeneral", func() error { return nil })
+	}()
+	waitUntil(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.queued > 0
+	})
+	o.close()
+	assert.Equal(t, errShuttingDown, <-result)
+	assert.Equal(t, errShuttingDown, smib.call("Xgeneral", func() error { return nil }))
+}
@@ -0,0 +1,65 @@
+package smib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// directivePrefix starts lines of command output which instruct SMIB instead of being sent, they
+// are only recognised before the first line of output. "#smib private" makes the rest of the output
+// private, "#smib title <text>" and "#smib comment <text>" set the title and comment of uploaded
+// files.
+const directivePrefix = "#smib "
+
+// directives are the instructions a command gave with its output
+type directives struct {
+	private        bool
+	title, comment string
+}
+
+// apply applies the directive in line
+func (d *directives) apply(line string) {
+	directive := strings.TrimSpace(strings.TrimPrefix(line, directivePrefix))
+	parts := strings.SplitN(directive, " ", 2)
+	switch {
+	case directive == "private":
+		d.private = true
+	case parts[0] == "title" && len(parts) == 2:
+		d.title = strings.TrimSpace(parts[1])
+	case parts[0] == "comment" && len(parts) == 2:
+		d.comment = strings.TrimSpace(parts[1])
+	default:
+		log.Print("Ignoring unknown output directive: ", directive)
+	}
+}
+
+// postPrivate sends text in channel so only user sees it. If slack won't show user an ephemeral
+// message there it is sent to them as a direct message instead.
+func (s *SMIB) postPrivate(channel, user, threadTS, text string) {
+	s.enqueue(channel, func() error {
+		options := []slack.MsgOption{slack.MsgOptionText(text, false)}
+		if threadTS != "" {
+			options = append(options, slack.MsgOptionTS(threadTS))
+		}
+		_, err := s.slack.PostEphemeral(channel, user, options...)
+		var limited *slack.RateLimitedError
+		if err == nil || errors.As(err, &limited) {
+			return err
+		}
+
+		log.Print(fmt.Sprintf("Failed to send ephemeral message to %s in %s, sending a DM: %s", user, channel, err))
+		im, _, _, err := s.slack.OpenConversation(&slack.OpenConversationParameters{Users: []string{user}, ReturnIM: true})
+		if err == nil {
+			_, _, err = s.slack.PostMessage(im.ID, slack.MsgOptionText(text, false))
+		}
+		if err != nil && !errors.As(err, &limited) {
+			log.Print(fmt.Sprintf("Failed to send DM to %s: %s", user, err))
+			return nil
+		}
+		return err
+	})
+}
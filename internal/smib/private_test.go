@@ -0,0 +1,132 @@
+package smib
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMIB_handleMessage_private(t *testing.T) {
+	tests := []struct {
+		name          string
+		channel       string
+		threadTS      string
+		manifest      command.Manifest
+		output        string
+		wantSent      []string
+		wantEphemeral []map[string]string
+	}{
+		{
+			name:     "public",
+			channel:  "Xgeneral",
+			output:   "the door is open\n",
+			wantSent: []string{"the door is open\n"},
+		},
+		{
+			name:     "private manifest",
+			channel:  "Xgeneral",
+			manifest: command.Manifest{Private: true},
+			output:   "the code is 1234\n",
+			wantEphemeral: []map[string]string{
+				{"channel": "Xgeneral", "user": "Xspengler", "text": "the code is 1234\n", "thread_ts": ""},
+			},
+		},
+		{
+			name:     "private directive in a thread",
+			channel:  "Xgeneral",
+			threadTS: "99.9",
+			output:   "#smib private\nthe code is 1234\n",
+			wantEphemeral: []map[string]string{
+				{"channel": "Xgeneral", "user": "Xspengler", "text": "the code is 1234\n", "thread_ts": "99.9"},
+			},
+		},
+		{
+			name:     "directives only lead the output",
+			channel:  "Xgeneral",
+			output:   "the door is open\n#smib private\n",
+			wantSent: []string{"the door is open\n", "#smib private\n"},
+		},
+		{
+			name:     "unknown directive",
+			channel:  "Xgeneral",
+			output:   "#smib shout\nthe door is open\n",
+			wantSent: []string{"the door is open\n"},
+		},
+		{
+			name:     "private in a DM",
+			channel:  "Dspengler",
+			manifest: command.Manifest{Private: true},
+			output:   "the code is 1234\n",
+			wantSent: []string{"the code is 1234\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &reactionTransport{}
+			mockCmd := &mockCommand{manifests: map[string]command.Manifest{"door": tt.manifest}}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			mockCmd.On("Run", mock.Anything, "door", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+				Return(output(tt.output), nil).Once()
+			smib := SMIB{
+				slack:    transport,
+				cmd:      mockCmd,
+				Feedback: config.Feedback{Style: config.FeedbackNone},
+			}
+
+			message := &slack.MessageEvent{Msg: slack.Msg{Text: "?door", Channel: tt.channel, User: "Xspengler", ThreadTimestamp: tt.threadTS}}
+			require.NoError(t, smib.handleMessage(context.Background(), message))
+			drain(t, &smib)
+
+			var sent []string
+			for _, msg := range transport.getSent() {
+				sent = append(sent, msg.Text)
+			}
+			assert.Equal(t, tt.wantSent, sent)
+			if tt.wantEphemeral == nil {
+				assert.Empty(t, transport.getEphemeral())
+			} else {
+				assert.Equal(t, tt.wantEphemeral, transport.getEphemeral())
+			}
+		})
+	}
+}
+
+func TestSMIB_postPrivate_dmFallback(t *testing.T) {
+	transport := &fakeTransport{ephemeralErr: errors.New("channel_not_found")}
+	smib := SMIB{slack: transport}
+
+	smib.postPrivate("Xgeneral", "Xspengler", "99.9", "the code is 1234")
+	drain(t, &smib)
+	assert.Equal(t, []map[string]string{
+		{"channel": "DXspengler", "text": "the code is 1234", "thread_ts": ""},
+	}, transport.getPosted())
+}
+
+func TestSMIB_run_privateErrors(t *testing.T) {
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	mockCmd.On("Run", mock.Anything, "dor", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(output(""), command.NotFoundError("")).Once()
+	mockCmd.On("Run", mock.Anything, "crash", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(output(""), errors.New("exec format error")).Once()
+	smib := SMIB{slack: &reactionTransport{}, cmd: mockCmd}
+
+	var private []bool
+	reply := func(text string, p bool) { private = append(private, p) }
+	ok, err := smib.run(context.Background(), invocation{cmd: "dor", user: "Xspengler", channel: "Xgeneral"}, reply)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+	ok, err = smib.run(context.Background(), invocation{cmd: "crash", user: "Xspengler", channel: "Xgeneral"}, reply)
+	assert.False(t, ok)
+	assert.Error(t, err)
+	assert.Equal(t, []bool{true, false}, private, "only typos are private")
+}
@@ -0,0 +1,231 @@
+package smib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// replySet is the replies SMIB sent to one invoking message
+type replySet struct {
+	at     time.Time
+	cancel context.CancelFunc
+	// superseded is set once the message is edited, which runs its command again, or deleted
+	superseded bool
+	// replies are in the order they were sent, a reply's ts is empty until slack acknowledges it
+	replies []*sentReply
+}
+
+type sentReply struct {
+	set *replySet
+	ts  string
+}
+
+// finish releases the context of the command run for set, it is safe to call on a nil set
+func (set *replySet) finish() {
+	if set != nil {
+		set.cancel()
+	}
+}
+
+// superseded reports whether the message set replies to has been edited or deleted since, it is
+// false for a nil set
+func (s *SMIB) superseded(set *replySet) bool {
+	if set == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return set.superseded
+}
+
+// replyKey identifies an invoking message
+func replyKey(channel, ts string) string {
+	return channel + "/" + ts
+}
+
+// trackReplies starts recording the replies to the message ts in channel, so they can be replaced
+// if it is edited or removed if it is deleted. The returned context is cancelled if the message is
+// edited or deleted before the command finishes. Replies are not tracked if EditWindow is 0, in
+// which case the returned set is nil.
+func (s *SMIB) trackReplies(ctx context.Context, channel, ts string) (context.Context, *replySet) {
+	if s.EditWindow <= 0 {
+		return ctx, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneReplies()
+	if s.replySets == nil {
+		s.replySets = map[string]*replySet{}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	set := &replySet{at: time.Now(), cancel: cancel}
+	s.replySets[replyKey(channel, ts)] = set
+	return ctx, set
+}
+
+// pruneReplies forgets replies older than EditWindow, s.mu must be held
+func (s *SMIB) pruneReplies() {
+	for key, set := range s.replySets {
+		if time.Since(set.at) > s.EditWindow {
+			delete(s.replySets, key)
+		}
+	}
+	for id, reply := range s.awaitingTS {
+		if time.Since(reply.set.at) > s.EditWindow {
+			delete(s.awaitingTS, id)
+		}
+	}
+}
+
+// addReply records that a reply to set is being sent, the reply's timestamp is set once slack has
+// accepted it. Replies are kept in the order addReply is called. It returns nil if set is nil.
+func (s *SMIB) addReply(set *replySet) *sentReply {
+	if set == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := &sentReply{set: set}
+	set.replies = append(set.replies, reply)
+	return reply
+}
+
+// awaitAck sets the timestamp of reply when slack acknowledges the message with the given ID
+func (s *SMIB) awaitAck(reply *sentReply, id int) {
+	if reply == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.awaitingTS == nil {
+		s.awaitingTS = map[int]*sentReply{}
+	}
+	s.awaitingTS[id] = reply
+}
+
+// setReplyTS sets the timestamp of reply
+func (s *SMIB) setReplyTS(reply *sentReply, ts string) {
+	if reply == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply.ts = ts
+}
+
+// replyAcked records the timestamp slack gave the message with the given ID
+func (s *SMIB) replyAcked(id int, ts string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reply, ok := s.awaitingTS[id]; ok {
+		reply.ts = ts
+		delete(s.awaitingTS, id)
+	}
+}
+
+// untrackReplies stops tracking the replies to the message ts in channel, cancelling its command
+// if it is still running. It returns the timestamps of the replies slack has acknowledged.
+func (s *SMIB) untrackReplies(channel, ts string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := replyKey(channel, ts)
+	set, ok := s.replySets[key]
+	if !ok {
+		return nil
+	}
+	delete(s.replySets, key)
+	set.superseded = true
+	set.cancel()
+
+	var sent []string
+	for _, reply := range set.replies {
+		if reply.ts != "" {
+			sent = append(sent, reply.ts)
+		}
+	}
+	return sent
+}
+
+// deleteReplies deletes the messages with timestamps ts from channel
+func (s *SMIB) deleteReplies(channel string, ts []string) {
+	for _, t := range ts {
+		t := t
+		s.enqueue(channel, func() error {
+			_, _, err := s.slack.DeleteMessage(channel, t)
+			var limited *slack.RateLimitedError
+			if err != nil && !errors.As(err, &limited) {
+				log.Print(fmt.Sprintf("Failed to delete reply %s in %s: %s", t, channel, err))
+				return nil
+			}
+			return err
+		})
+	}
+}
+
+// updateReply replaces the text of the reply with timestamp ts in channel, sending msg instead if
+// the reply can't be updated.
+func (s *SMIB) updateReply(reply *sentReply, channel, ts string, msg *slack.OutgoingMessage) {
+	s.enqueue(channel, func() error {
+		_, _, _, err := s.slack.UpdateMessage(channel, ts, slack.MsgOptionText(msg.Text, false))
+		var limited *slack.RateLimitedError
+		switch {
+		case err == nil:
+			s.setReplyTS(reply, ts)
+		case errors.As(err, &limited):
+			return err
+		default:
+			log.Print(fmt.Sprintf("Failed to update reply %s in %s: %s", ts, channel, err))
+			s.awaitAck(reply, msg.ID)
+			s.track(msg)
+			return s.transmit(msg)
+		}
+		return nil
+	})
+}
+
+// handleEdit reruns a command when its message is edited within EditWindow, replacing the
+// previous replies with the new output.
+func (s *SMIB) handleEdit(ctx context.Context, message *slack.MessageEvent) error {
+	if s.EditWindow <= 0 || message.SubMessage == nil {
+		return nil
+	}
+	if message.PreviousMessage != nil && message.PreviousMessage.Text == message.SubMessage.Text {
+		// Unfurling a link also changes the message
+		return nil
+	}
+
+	edited := &slack.MessageEvent{Msg: *message.SubMessage}
+	edited.Channel = message.Channel
+	if s.ignoreMessage(edited) || time.Since(tsTime(edited.Timestamp)) > s.EditWindow {
+		return nil
+	}
+
+	previous := s.untrackReplies(edited.Channel, edited.Timestamp)
+	s.clearFeedback(edited)
+	return s.invoke(ctx, edited, previous)
+}
+
+// handleDelete deletes SMIB's replies to a deleted message if DeleteReplies is set
+func (s *SMIB) handleDelete(message *slack.MessageEvent) {
+	if !s.DeleteReplies {
+		return
+	}
+	s.deleteReplies(message.Channel, s.untrackReplies(message.Channel, message.DeletedTimestamp))
+}
+
+// tsTime converts a slack message timestamp to a time
+func tsTime(ts string) time.Time {
+	seconds, err := strconv.ParseFloat(ts, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,255 @@
+package smib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/nlopes/slack/slacktest"
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// chatRecorder records chat.update, chat.delete and chat.postEphemeral calls
+type chatRecorder struct {
+	mu        sync.Mutex
+	updated   map[string]string
+	deleted   []string
+	ephemeral []string
+}
+
+func (c *chatRecorder) handle(server *slacktest.Server) {
+	c.updated = map[string]string{}
+	server.Handle("/chat.update", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		c.mu.Lock()
+		c.updated[r.Form.Get("ts")] = r.Form.Get("text")
+		c.mu.Unlock()
+		w.Write([]byte(`{"ok":true,"channel":"Xgeneral","ts":"` + r.Form.Get("ts") + `"}`))
+	})
+	server.Handle("/chat.delete", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		c.mu.Lock()
+		c.deleted = append(c.deleted, r.Form.Get("ts"))
+		c.mu.Unlock()
+		w.Write([]byte(`{"ok":true,"channel":"Xgeneral","ts":"` + r.Form.Get("ts") + `"}`))
+	})
+	server.Handle("/chat.postEphemeral", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		c.mu.Lock()
+		c.ephemeral = append(c.ephemeral, r.Form.Get("text"))
+		c.mu.Unlock()
+		w.Write([]byte(`{"ok":true,"message_ts":"300.1"}`))
+	})
+	server.Handle("/conversations.info", func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := json.Marshal(struct{ Channel slack.Channel }{slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}}})
+		w.Write(resp)
+	})
+}
+
+func (c *chatRecorder) getUpdated() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	updated := map[string]string{}
+	for ts, text := range c.updated {
+		updated[ts] = text
+	}
+	return updated
+}
+
+func (c *chatRecorder) getDeleted() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.deleted...)
+}
+
+func (c *chatRecorder) getEphemeral() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.ephemeral...)
+}
+
+// ackReplies acknowledges every reply waiting for a timestamp, giving them timestamps starting
+// from first in the order they were sent.
+func ackReplies(s *SMIB, first int) {
+	s.mu.Lock()
+	var ids []int
+	for id := range s.awaitingTS {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	sort.Ints(ids)
+	for _, id := range ids {
+		s.replyAcked(id, fmt.Sprintf("200.%d", first))
+		first++
+	}
+}
+
+func output(text string) *closedChecker {
+	return &closedChecker{reader: bytes.NewReader([]byte(text))}
+}
+
+func TestSMIB_handleMessage_editAndDelete(t *testing.T) {
+	chat := &chatRecorder{}
+	testServer := slacktest.NewTestServer()
+	chat.handle(testServer)
+	testServer.Start()
+	defer testServer.Stop()
+	testRTM := testServer.GetTestRTMInstance()
+	go testRTM.ManageConnection()
+
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	smib := SMIB{
+		slack:         rtmTransport{testRTM},
+		cmd:           mockCmd,
+		EditWindow:    time.Minute,
+		DeleteReplies: true,
+	}
+	ts := fmt.Sprintf("%d.000100", time.Now().Unix())
+	original := slack.Msg{Text: "?dor", User: "Xspengler", Timestamp: ts}
+
+	mockCmd.On("Run", mock.Anything, "dor", "<@Xspengler>", "spengler", "general", "public_channel", "").
+		Return(ioutil.NopCloser(nil), command.NotFoundError("")).Once()
+	message := &slack.MessageEvent{Msg: original}
+	message.Channel = "Xgeneral"
+	require.NoError(t, smib.handleMessage(context.Background(), message))
+	drain(t, &smib)
+	assert.Equal(t, []string{"Sorry <@Xspengler>, I don't have a dor command."}, chat.getEphemeral())
+
+	mockCmd.On("Run", mock.Anything, "door", "<@Xspengler>", "spengler", "general", "public_channel", "").
+		Return(output("open\nby egon\n"), nil).Once()
+	edited := original
+	edited.Text = "?door"
+	require.NoError(t, smib.handleMessage(context.Background(), &slack.MessageEvent{Msg: slack.Msg{
+		Type:    "message",
+		SubType: "message_changed",
+		Hidden:  true,
+		Channel: "Xgeneral",
+	},
+		SubMessage:      &edited,
+		PreviousMessage: &original,
+	}))
+	drain(t, &smib)
+	ackReplies(&smib, 1)
+	assert.Empty(t, chat.getUpdated(), "the private error can't be replaced")
+
+	mockCmd.On("Run", mock.Anything, "door", "<@Xspengler>", "spengler", "general", "public_channel", "").
+		Return(output("closed\n"), nil).Once()
+	again := edited
+	again.Text = "?door "
+	require.NoError(t, smib.handleMessage(context.Background(), &slack.MessageEvent{Msg: slack.Msg{
+		SubType: "message_changed",
+		Hidden:  true,
+		Channel: "Xgeneral",
+	},
+		SubMessage:      &again,
+		PreviousMessage: &edited,
+	}))
+	drain(t, &smib)
+	assert.Equal(t, map[string]string{"200.1": "closed\n"}, chat.getUpdated())
+	assert.Equal(t, []string{"200.2"}, chat.getDeleted(), "surplus replies should be deleted")
+
+	require.NoError(t, smib.handleMessage(context.Background(), &slack.MessageEvent{Msg: slack.Msg{
+		SubType:          "message_deleted",
+		Hidden:           true,
+		Channel:          "Xgeneral",
+		DeletedTimestamp: ts,
+	}}))
+	drain(t, &smib)
+	assert.Equal(t, []string{"200.2", "200.1"}, chat.getDeleted())
+
+	waitUntil(t, func() bool {
+		return sawMessage(t, testServer, "open\n", "") && sawMessage(t, testServer, "by egon\n", "")
+	})
+}
+
+func TestSMIB_handleEdit_ignored(t *testing.T) {
+	now := fmt.Sprintf("%d.000100", time.Now().Unix())
+	old := fmt.Sprintf("%d.000100", time.Now().Add(-time.Hour).Unix())
+	tests := []struct {
+		name       string
+		editWindow time.Duration
+		previous   slack.Msg
+		edited     slack.Msg
+	}{
+		{
+			name:       "edits disabled",
+			editWindow: 0,
+			previous:   slack.Msg{Text: "?dor", User: "Xspengler", Timestamp: now},
+			edited:     slack.Msg{Text: "?door", User: "Xspengler", Timestamp: now},
+		},
+		{
+			name:       "link unfurled",
+			editWindow: time.Minute,
+			previous:   slack.Msg{Text: "?door", User: "Xspengler", Timestamp: now},
+			edited:     slack.Msg{Text: "?door", User: "Xspengler", Timestamp: now},
+		},
+		{
+			name:       "too old",
+			editWindow: time.Minute,
+			previous:   slack.Msg{Text: "?dor", User: "Xspengler", Timestamp: old},
+			edited:     slack.Msg{Text: "?door", User: "Xspengler", Timestamp: old},
+		},
+		{
+			name:       "edited by a bot",
+			editWindow: time.Minute,
+			previous:   slack.Msg{Text: "?dor", BotID: "Bslimer", Timestamp: now},
+			edited:     slack.Msg{Text: "?door", BotID: "Bslimer", Timestamp: now},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCmd := &mockCommand{}
+			mockCmd.Test(t)
+			smib := SMIB{cmd: mockCmd, EditWindow: tt.editWindow}
+
+			err := smib.handleMessage(context.Background(), &slack.MessageEvent{Msg: slack.Msg{
+				SubType: "message_changed",
+				Hidden:  true,
+				Channel: "Xgeneral",
+			},
+				SubMessage:      &tt.edited,
+				PreviousMessage: &tt.previous,
+			})
+			assert.NoError(t, err)
+			mockCmd.AssertNotCalled(t, "Run")
+		})
+	}
+}
+
+func TestSMIB_trackReplies(t *testing.T) {
+	smib := SMIB{}
+	ctx, set := smib.trackReplies(context.Background(), "Xgeneral", "1.1")
+	assert.Nil(t, set, "replies should not be tracked without an edit window")
+	assert.Equal(t, context.Background(), ctx)
+	set.finish()
+
+	smib.EditWindow = 20 * time.Millisecond
+	ctx, set = smib.trackReplies(context.Background(), "Xgeneral", "1.1")
+	smib.addReply(set)
+	smib.awaitAck(smib.addReply(set), 2)
+	smib.replyAcked(2, "2.2")
+	assert.Equal(t, []string{"2.2"}, smib.untrackReplies("Xgeneral", "1.1"))
+	assert.Error(t, ctx.Err(), "untracking should cancel a running command")
+	assert.Nil(t, smib.untrackReplies("Xgeneral", "1.1"))
+
+	_, set = smib.trackReplies(context.Background(), "Xgeneral", "3.3")
+	smib.awaitAck(smib.addReply(set), 3)
+	set.finish()
+	time.Sleep(smib.EditWindow)
+	smib.trackReplies(context.Background(), "Xgeneral", "4.4")
+	assert.Nil(t, smib.untrackReplies("Xgeneral", "3.3"), "old replies should be forgotten")
+	assert.Empty(t, smib.awaitingTS)
+}
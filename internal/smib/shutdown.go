@@ -0,0 +1,58 @@
+package smib
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// flushPoll is how often flush checks for outstanding acknowledgements
+const flushPoll = 10 * time.Millisecond
+
+// startHandler registers a new handler and returns the context its command should run with. It
+// returns false if SMIB is shutting down, in which case no new commands should be run. The caller
+// must call s.handlers.Done() when the handler finishes.
+func (s *SMIB) startHandler() (context.Context, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return nil, false
+	}
+	s.initCommandContext()
+	s.handlers.Add(1)
+	return s.cmdCtx, true
+}
+
+// stop prevents any new handlers from starting
+func (s *SMIB) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopping = true
+}
+
+// killCommands kills every running command
+func (s *SMIB) killCommands() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initCommandContext()
+	s.cancelCommands()
+}
+
+// initCommandContext creates the context commands run with, s.mu must be held
+func (s *SMIB) initCommandContext() {
+	if s.cmdCtx == nil {
+		s.cmdCtx, s.cancelCommands = context.WithCancel(context.Background())
+	}
+}
+
+// flush waits up to timeout for slack to acknowledge every message sent so far
+func (s *SMIB) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for s.pending() > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("Gave up waiting for %d messages to be acknowledged", s.pending())
+			return
+		}
+		time.Sleep(flushPoll)
+	}
+}
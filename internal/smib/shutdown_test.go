@@ -0,0 +1,134 @@
+package smib
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/nlopes/slack/slacktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenAndRobot_shutdown(t *testing.T) {
+	tests := []struct {
+		name   string
+		grace  time.Duration
+		finish bool
+	}{
+		{
+			name:   "command finishes within grace period",
+			grace:  time.Second,
+			finish: true,
+		},
+		{
+			name:  "command killed after grace period",
+			grace: 10 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := slacktest.NewTestServer()
+			testServer.Start()
+			defer testServer.Stop()
+			testRTM := testServer.GetTestRTMInstance()
+
+			cmdOut, cmdIn := io.Pipe()
+			cmdCtx := make(chan context.Context, 1)
+			mockCmd := &mockCommand{}
+			mockCmd.Test(t)
+			mockCmd.On("Run", mock.Anything, "sleep", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+				Run(func(args mock.Arguments) { cmdCtx <- args.Get(0).(context.Context) }).
+				Return(io.ReadCloser(cmdOut), nil).Once()
+			defer mockCmd.AssertExpectations(t)
+
+			smib := SMIB{
+				ShutdownGrace: tt.grace,
+				FlushTimeout:  10 * time.Millisecond,
+				slack:         rtmTransport{testRTM},
+				cmd:           mockCmd,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() {
+				done <- smib.ListenAndRobot(ctx)
+			}()
+
+			testRTM.IncomingEvents <- slack.RTMEvent{
+				Type: "message",
+				Data: &slack.MessageEvent{Msg: slack.Msg{Text: "?sleep", Channel: "Xgeneral", User: "Xspengler"}},
+			}
+			var runCtx context.Context
+			select {
+			case runCtx = <-cmdCtx:
+			case <-time.After(time.Second):
+				require.FailNow(t, "command was not run")
+			}
+
+			cancel()
+			// Messages arriving during shutdown must not run commands
+			testRTM.IncomingEvents <- slack.RTMEvent{
+				Type: "message",
+				Data: &slack.MessageEvent{Msg: slack.Msg{Text: "?sleep", Channel: "Xgeneral", User: "Xspengler"}},
+			}
+
+			if tt.finish {
+				select {
+				case <-done:
+					require.FailNow(t, "ListenAndRobot returned while a command was running")
+				case <-time.After(50 * time.Millisecond):
+				}
+				assert.NoError(t, runCtx.Err(), "command was killed within the grace period")
+				cmdIn.Write([]byte("awake\n"))
+				cmdIn.Close()
+			} else {
+				go func() {
+					<-runCtx.Done()
+					cmdIn.Close()
+				}()
+			}
+
+			select {
+			case err := <-done:
+				assert.NoError(t, err)
+			case <-time.After(time.Second):
+				require.FailNow(t, "ListenAndRobot did not return")
+			}
+			if tt.finish {
+				assert.True(t, testServer.SawMessage("awake\n"))
+			}
+		})
+	}
+}
+
+func TestSMIB_flush(t *testing.T) {
+	testServer := slacktest.NewTestServer()
+	testServer.Start()
+	defer testServer.Stop()
+	testRTM := testServer.GetTestRTMInstance()
+	go testRTM.ManageConnection()
+
+	smib := SMIB{slack: rtmTransport{testRTM}}
+
+	smib.sendMessage(testRTM.NewTypingMessage("Xgeneral"))
+	assert.Equal(t, 0, smib.pending(), "typing messages are not acknowledged")
+
+	msg := testRTM.NewOutgoingMessage("hi", "Xgeneral")
+	smib.sendMessage(msg)
+	assert.Equal(t, 1, smib.pending())
+
+	start := time.Now()
+	smib.flush(20 * time.Millisecond)
+	assert.WithinDuration(t, start.Add(20*time.Millisecond), time.Now(), 50*time.Millisecond, "flush should time out")
+
+	smib.acked(msg.ID, "1630000000.000100")
+	assert.Equal(t, 0, smib.pending())
+
+	start = time.Now()
+	smib.flush(time.Second)
+	assert.WithinDuration(t, start, time.Now(), 50*time.Millisecond, "flush should return immediately")
+}
@@ -0,0 +1,219 @@
+package smib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// slashDeadline is how long a slash command may run before we acknowledge the request and send
+// the output to its response_url instead, slack requires a response within 3 seconds.
+var slashDeadline = 2500 * time.Millisecond
+
+// slashWaiting is called just before a slash command request starts waiting for the command, tests
+// use it to let the command finish first.
+var slashWaiting = func() {}
+
+const (
+	responseEphemeral = "ephemeral"
+	responseInChannel = "in_channel"
+)
+
+// slashResponse is a message sent in reply to a slash command
+type slashResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// slashOutput collects the output of a slash command, which is private if any of it is
+type slashOutput struct {
+	mu      sync.Mutex
+	lines   []string
+	private bool
+}
+
+func (o *slashOutput) add(text string, private bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lines = append(o.lines, strings.TrimSuffix(text, "\n"))
+	o.private = o.private || private
+}
+
+// responseType returns the response type for the output, ephemeral if it is private
+func (o *slashOutput) responseType(responseType string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.private {
+		return responseEphemeral
+	}
+	return responseType
+}
+
+func (o *slashOutput) text() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.lines, "\n")
+}
+
+// SlashCommandHandler serves slack slash commands such as "/smib door open", running the command
+// named by the first word of the text. Requests must be signed with secret. Output is only shown
+// to the invoking user unless the command is listed in inChannel.
+func (s *SMIB) SlashCommandHandler(secret string, inChannel []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "failed to read request", http.StatusBadRequest)
+			return
+		}
+		verifier, err := slack.NewSecretsVerifier(r.Header, secret)
+		if err != nil {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		verifier.Write(body)
+		if err := verifier.Ensure(); err != nil {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		slash, err := slack.SlashCommandParse(r)
+		if err != nil {
+			http.Error(w, "invalid slash command", http.StatusBadRequest)
+			return
+		}
+
+		parts := strings.SplitN(strings.TrimSpace(slash.Text), " ", 2)
+		inv := invocation{
+			cmd:     parts[0],
+			user:    slash.UserID,
+			channel: slash.ChannelID,
+		}
+		if len(parts) > 1 {
+			inv.args = parts[1]
+		}
+		if inv.cmd == "" {
+			writeSlashResponse(w, responseEphemeral, fmt.Sprintf("Usage: %s <command> [args]", slash.Command))
+			return
+		}
+
+		responseType := responseEphemeral
+		if name, err := s.cmd.Resolve(inv.cmd); err == nil && contains(inChannel, name) {
+			responseType = responseInChannel
+		}
+
+		ctx, ok := s.startHandler()
+		if !ok {
+			writeSlashResponse(w, responseEphemeral, "Sorry, I'm restarting, try again in a minute.")
+			return
+		}
+
+		output := &slashOutput{}
+		inv.upload = func(file outputFile, private bool) {
+			private = private || output.responseType(responseType) == responseEphemeral
+			s.uploadFile(inv.channel, "", inv.user, file, private)
+		}
+		// done is closed if the command finishes while the request is still open, otherwise
+		// expired is set and the output goes to the response_url
+		var (
+			done    = make(chan struct{})
+			mu      sync.Mutex
+			expired bool
+		)
+		go func() {
+			defer s.handlers.Done()
+			if _, err := s.run(ctx, inv, output.add); err != nil {
+				log.Print("Failed to handle slash command: ", err)
+			}
+
+			mu.Lock()
+			late := expired
+			if !late {
+				close(done)
+			}
+			mu.Unlock()
+			if late {
+				if err := postSlashResponse(slash.ResponseURL, output.responseType(responseType), output.text()); err != nil {
+					log.Print("Failed to send slash command response: ", err)
+				}
+			}
+		}()
+
+		slashWaiting()
+		timeout := time.NewTimer(slashDeadline)
+		defer timeout.Stop()
+		select {
+		case <-done:
+		case <-timeout.C:
+			mu.Lock()
+			select {
+			case <-done:
+			default:
+				expired = true
+			}
+			mu.Unlock()
+		}
+		if expired {
+			// Acknowledge the command, the output will follow on the response_url
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		writeSlashResponse(w, output.responseType(responseType), output.text())
+	})
+}
+
+// writeSlashResponse replies to a slash command request directly, a command with no output is
+// just acknowledged
+func writeSlashResponse(w http.ResponseWriter, responseType, text string) {
+	if text == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slashResponse{
+		ResponseType: responseType,
+		Text:         text,
+	})
+}
+
+// postSlashResponse sends a delayed reply to a slash command
+func postSlashResponse(responseURL, responseType, text string) error {
+	if text == "" {
+		return nil
+	}
+	body, err := json.Marshal(slashResponse{
+		ResponseType: responseType,
+		Text:         text,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response_url returned %s", resp.Status)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
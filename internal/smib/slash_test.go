@@ -0,0 +1,240 @@
+package smib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/nlopes/slack/slacktest"
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testSigningSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+func signedSlashRequest(t *testing.T, secret string, form url.Values) *http.Request {
+	body := form.Encode()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+
+	r := httptest.NewRequest("POST", "/slack/commands", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestSMIB_SlashCommandHandler(t *testing.T) {
+	defer func(d time.Duration) { slashDeadline = d }(slashDeadline)
+	slashDeadline = 50 * time.Millisecond
+
+	tests := []struct {
+		name         string
+		secret       string
+		text         string
+		primeCommand func(m *mockCommand, slowOutput io.ReadCloser)
+		slow         bool
+		wantCode     int
+		wantResponse *slashResponse
+		wantFollowUp *slashResponse
+	}{
+		{
+			name:     "bad signature",
+			secret:   "notthesecret",
+			text:     "door",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "no command",
+			secret:       testSigningSecret,
+			text:         " ",
+			wantCode:     http.StatusOK,
+			wantResponse: &slashResponse{ResponseType: "ephemeral", Text: "Usage: /smib <command> [args]"},
+		},
+		{
+			name:   "quick command",
+			secret: testSigningSecret,
+			text:   "countdown 3",
+			primeCommand: func(m *mockCommand, _ io.ReadCloser) {
+				m.On("Resolve", "countdown").Return("countdown", nil).Once()
+				m.On("Run", mock.Anything, "countdown", "<@Xspengler>", "spengler", "general", "public_channel", "3").
+					Return(ioutil.NopCloser(bytes.NewBufferString("3\n2\n1\n")), nil).Once()
+			},
+			wantCode:     http.StatusOK,
+			wantResponse: &slashResponse{ResponseType: "ephemeral", Text: "3\n2\n1"},
+		},
+		{
+			name:   "quiet command",
+			secret: testSigningSecret,
+			text:   "lights off",
+			primeCommand: func(m *mockCommand, _ io.ReadCloser) {
+				m.On("Resolve", "lights").Return("lights", nil).Once()
+				m.On("Run", mock.Anything, "lights", "<@Xspengler>", "spengler", "general", "public_channel", "off").
+					Return(ioutil.NopCloser(bytes.NewBufferString("")), nil).Once()
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:   "in channel command",
+			secret: testSigningSecret,
+			text:   "do",
+			primeCommand: func(m *mockCommand, _ io.ReadCloser) {
+				m.On("Resolve", "do").Return("door", nil).Once()
+				m.On("Run", mock.Anything, "do", "<@Xspengler>", "spengler", "general", "public_channel", "").
+					Return(ioutil.NopCloser(bytes.NewBufferString("The door is open\n")), nil).Once()
+			},
+			wantCode:     http.StatusOK,
+			wantResponse: &slashResponse{ResponseType: "in_channel", Text: "The door is open"},
+		},
+		{
+			name:   "in channel command with private output",
+			secret: testSigningSecret,
+			text:   "door code",
+			primeCommand: func(m *mockCommand, _ io.ReadCloser) {
+				m.On("Resolve", "door").Return("door", nil).Once()
+				m.On("Run", mock.Anything, "door", "<@Xspengler>", "spengler", "general", "public_channel", "code").
+					Return(ioutil.NopCloser(bytes.NewBufferString("#smib private\nThe code is 1234\n")), nil).Once()
+			},
+			wantCode:     http.StatusOK,
+			wantResponse: &slashResponse{ResponseType: "ephemeral", Text: "The code is 1234"},
+		},
+		{
+			name:   "unknown command",
+			secret: testSigningSecret,
+			text:   "dance",
+			primeCommand: func(m *mockCommand, _ io.ReadCloser) {
+				m.On("Resolve", "dance").Return("", command.NotFoundError("")).Once()
+				m.On("Run", mock.Anything, "dance", "<@Xspengler>", "spengler", "general", "public_channel", "").
+					Return(ioutil.NopCloser(nil), command.NotFoundError("")).Once()
+			},
+			wantCode:     http.StatusOK,
+			wantResponse: &slashResponse{ResponseType: "ephemeral", Text: "Sorry <@Xspengler>, I don't have a dance command."},
+		},
+		{
+			name:   "slow command",
+			secret: testSigningSecret,
+			text:   "webcam",
+			primeCommand: func(m *mockCommand, slowOutput io.ReadCloser) {
+				m.On("Resolve", "webcam").Return("webcam", nil).Once()
+				m.On("Run", mock.Anything, "webcam", "<@Xspengler>", "spengler", "general", "public_channel", "").
+					Return(slowOutput, nil).Once()
+			},
+			slow:         true,
+			wantCode:     http.StatusOK,
+			wantFollowUp: &slashResponse{ResponseType: "ephemeral", Text: "https://example.com/webcam.jpg"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := slacktest.NewTestServer()
+			testServer.Handle("/conversations.info", func(w http.ResponseWriter, r *http.Request) {
+				resp, _ := json.Marshal(struct{ Channel slack.Channel }{slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}}})
+				w.Write(resp)
+			})
+			testServer.Start()
+			defer testServer.Stop()
+
+			followUps := make(chan slashResponse, 1)
+			responseServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var resp slashResponse
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&resp))
+				followUps <- resp
+			}))
+			defer responseServer.Close()
+
+			mockCmd := &mockCommand{}
+			mockCmd.Test(t)
+			cmdOut, cmdIn := io.Pipe()
+			if tt.primeCommand != nil {
+				tt.primeCommand(mockCmd, cmdOut)
+			}
+			defer mockCmd.AssertExpectations(t)
+
+			smib := &SMIB{
+				slack: rtmTransport{testServer.GetTestRTMInstance()},
+				cmd:   mockCmd,
+			}
+
+			w := httptest.NewRecorder()
+			smib.SlashCommandHandler(testSigningSecret, []string{"door"}).ServeHTTP(w, signedSlashRequest(t, tt.secret, url.Values{
+				"command":      {"/smib"},
+				"text":         {tt.text},
+				"user_id":      {"Xspengler"},
+				"channel_id":   {"Xgeneral"},
+				"response_url": {responseServer.URL},
+			}))
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantResponse != nil {
+				var resp slashResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, *tt.wantResponse, resp)
+			}
+			if tt.wantCode == http.StatusOK && tt.wantResponse == nil {
+				assert.Empty(t, w.Body.String(), "commands without a response should be acknowledged with an empty body")
+			}
+			if tt.slow {
+				cmdIn.Write([]byte("https://example.com/webcam.jpg\n"))
+				cmdIn.Close()
+			}
+			if tt.wantFollowUp != nil {
+				select {
+				case resp := <-followUps:
+					assert.Equal(t, *tt.wantFollowUp, resp)
+				case <-time.After(time.Second):
+					assert.Fail(t, "no follow up response")
+				}
+			}
+			smib.handlers.Wait()
+		})
+	}
+}
+
+func TestSMIB_SlashCommandHandler_immediate(t *testing.T) {
+	defer func(d time.Duration, waiting func()) { slashDeadline, slashWaiting = d, waiting }(slashDeadline, slashWaiting)
+	slashDeadline = 5 * time.Second
+	slashWaiting = func() { time.Sleep(20 * time.Millisecond) }
+
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	mockCmd.On("Resolve", "dance").Return("", command.NotFoundError(""))
+	mockCmd.On("Run", mock.Anything, "dance", "<@Xspengler>", "spengler", "general", "public_channel", "").
+		Return(ioutil.NopCloser(nil), command.NotFoundError(""))
+	smib := &SMIB{slack: &fakeTransport{}, cmd: mockCmd}
+	smib.users.set("Xspengler", &slack.User{ID: "Xspengler", Name: "spengler"})
+	smib.conversations.set("Xgeneral", &slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}})
+	handler := smib.SlashCommandHandler(testSigningSecret, nil)
+
+	// The command fails before the handler starts waiting for it
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(w, signedSlashRequest(t, testSigningSecret, url.Values{
+			"command":    {"/smib"},
+			"text":       {"dance"},
+			"user_id":    {"Xspengler"},
+			"channel_id": {"Xgeneral"},
+		}))
+		require.Less(t, int64(time.Since(start)), int64(time.Second), "the response waited for the deadline")
+		var resp slashResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, slashResponse{ResponseType: "ephemeral", Text: "Sorry <@Xspengler>, I don't have a dance command."}, resp)
+	}
+	smib.handlers.Wait()
+}
@@ -2,148 +2,469 @@ package smib
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/nlopes/slack"
 	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/config"
+	"github.com/somakeit/slacker-smib/internal/format"
+	"github.com/somakeit/slacker-smib/internal/metrics"
+	"github.com/somakeit/slacker-smib/internal/store"
 )
 
 type commandRunner interface {
-	Run(cmd, user, userDisplay, channel, args string) (io.ReadCloser, error)
+	Resolve(cmd string) (string, error)
+	Manifest(cmd string) (command.Manifest, error)
+	Run(ctx context.Context, cmd, user, userDisplay, channel, channelType, args string, extra command.Extra) (io.ReadCloser, error)
 }
 
+const (
+	defaultShutdownGrace = 5 * time.Second
+	defaultFlushTimeout  = 2 * time.Second
+)
+
 // SMIB is the bot
 type SMIB struct {
-	slack *slack.RTM
+	// ShutdownGrace is how long running commands may take to finish after shutdown is requested,
+	// after which they are killed.
+	ShutdownGrace time.Duration
+	// FlushTimeout is how long to wait for slack to acknowledge sent messages during shutdown.
+	FlushTimeout time.Duration
+	// Triggers configures which messages are treated as commands, "?" prefixes if unset.
+	Triggers config.Triggers
+	// AllowedBots lists the bot or user IDs of bots which may run commands.
+	AllowedBots []string
+	// EditWindow is how long after a command is sent editing it reruns the command, replacing
+	// the previous replies. Edits are ignored if it is 0.
+	EditWindow time.Duration
+	// SendInterval and SendBurst pace messages sent to slack, burst messages may be sent at once
+	// and then one per interval. Messages are not paced if SendInterval is 0.
+	SendInterval time.Duration
+	SendBurst    int
+	// ListWorkspace lists every user and conversation into the caches when SMIB connects, at
+	// most once an hour, for socket mode. Otherwise they are looked up as they are first needed,
+	// except SMIB itself which is cached from the connected event.
+	ListWorkspace bool
+	// DeleteReplies deletes SMIB's replies when the command they reply to is deleted within
+	// EditWindow.
+	DeleteReplies bool
+	// Feedback configures how SMIB shows a command is running, typing if unset.
+	Feedback config.Feedback
+	// Output configures how command output is changed before it is sent.
+	Output config.Output
+	// Files configures files sent to and by commands, uploads and downloads are limited to 10MB
+	// if MaxUploadBytes or MaxDownloadBytes are unset.
+	Files config.Files
+	// CallbackURL is where commands can reach the API served by CallbackHandler, it is passed to
+	// them in $SMIB_API_URL. Commands aren't given the API if it is empty.
+	CallbackURL string
+	// CallbackGrace is how long after a command exits it may still use the API, 10 minutes if
+	// unset.
+	CallbackGrace time.Duration
+	// Store is the key-value store commands can use through the callback API, the store
+	// endpoints fail if it is nil.
+	Store *store.Store
+
+	slack Transport
 	cmd   commandRunner
+
+	mu             sync.Mutex
+	status         Status
+	hooks          []func(Status)
+	selfID         string
+	deliveries     map[int]*delivery
+	users          cache
+	conversations  cache
+	replySets      map[string]*replySet
+	callbacks      map[string]*callbackScope
+	awaitingTS     map[int]*sentReply
+	out            *outbox
+	handlers       sync.WaitGroup
+	stopping       bool
+	cmdCtx         context.Context
+	cancelCommands context.CancelFunc
+}
+
+// invocation is a request to run a command, however it reached SMIB
+type invocation struct {
+	cmd, args string
+	// user and channel are slack IDs
+	user, channel string
+	// ts is the message which ran the command and threadTS the thread replies go in, if any
+	ts, threadTS string
+	// upload sends a file the command wrote, files aren't sent if it is nil
+	upload func(file outputFile, private bool)
+	// files were shared with the command
+	files []slack.File
 }
 
-// New returns a new SMIB, client must be a pointer to a valid slack.Client and commandRunner
+// New returns a new SMIB, transport must be a valid slack Transport and commandRunner
 // must be a valid Smob command runner.
-func New(client *slack.Client, cmd commandRunner) *SMIB {
+func New(transport Transport, cmd commandRunner) *SMIB {
 	s := SMIB{
-		slack: client.NewRTM(),
-		cmd:   cmd,
+		ShutdownGrace: defaultShutdownGrace,
+		FlushTimeout:  defaultFlushTimeout,
+		SendInterval:  defaultSendInterval,
+		SendBurst:     defaultSendBurst,
+		slack:         transport,
+		cmd:           cmd,
+		status:        Status{State: StateStarting, Since: time.Now(), DownSince: time.Now()},
+		users:         cache{name: "users"},
+		conversations: cache{name: "conversations"},
 	}
 	return &s
 }
 
-// ListenAndRobot starts the
-func (s *SMIB) ListenAndRobot() error {
+// ListenAndRobot connects to slack and handles messages until ctx is done. On shutdown no new
+// messages are handled, running commands are given ShutdownGrace to finish before they are killed,
+// then sent messages are flushed and the connection is closed.
+func (s *SMIB) ListenAndRobot(ctx context.Context) error {
 	go s.slack.ManageConnection()
+	defer s.killCommands()
+
+	var (
+		shutdown = ctx.Done()
+		grace    <-chan time.Time
+		flushed  = make(chan struct{})
+	)
 
-	for event := range s.slack.IncomingEvents {
-		switch data := event.Data.(type) {
-		case *slack.MessageEvent:
+	for {
+		select {
+		case <-shutdown:
+			log.Print("Shutting down, waiting for running commands")
+			shutdown = nil
+			grace = time.After(s.ShutdownGrace)
+			s.stop()
 			go func() {
-				if err := s.handleMessage(data); err != nil {
-					log.Print("Faled to handle message: ", err)
-				}
+				s.handlers.Wait()
+				s.flush(s.FlushTimeout)
+				close(flushed)
 			}()
-		case *slack.ConnectedEvent:
-			log.Println("SMIB connected")
+		case <-grace:
+			log.Print("Commands still running after ", s.ShutdownGrace, ", killing them")
+			s.killCommands()
+		case <-flushed:
+			if err := s.slack.Disconnect(); err != nil {
+				log.Print("Failed to disconnect: ", err)
+			}
+			log.Print("SMIB shut down")
+			return nil
+		case event, ok := <-s.slack.Events():
+			if !ok {
+				return errors.New("IncomingEvents channel was closed")
+			}
+			metrics.EventsReceived.WithLabelValues(event.Type).Inc()
+			switch data := event.Data.(type) {
+			case *slack.MessageEvent:
+				if ctx.Err() != nil {
+					// Shutdown was requested but select picked this event first
+					continue
+				}
+				cmdCtx, ok := s.startHandler()
+				if !ok {
+					continue
+				}
+				go func() {
+					defer s.handlers.Done()
+					if err := s.handleMessage(cmdCtx, data); err != nil {
+						log.Print("Faled to handle message: ", err)
+					}
+				}()
+			case *slack.AckMessage:
+				s.acked(data.ReplyTo, data.Timestamp)
+			case *slack.AckErrorEvent:
+				s.ackError(data.ErrorObj)
+			case *slack.UserChangeEvent:
+				user := data.User
+				s.users.set(user.ID, &user)
+			case *slack.ChannelRenameEvent:
+				s.conversations.invalidate(data.Channel.ID)
+			case *slack.GroupRenameEvent:
+				s.conversations.invalidate(data.Group.ID)
+			default:
+				if err := s.handleConnectionEvent(event.Data); err != nil {
+					s.getOutbox().close()
+					return err
+				}
+			}
 		}
 	}
-
-	return errors.New("IncomingEvents channel was closed")
 }
 
-func (s *SMIB) handleMessage(message *slack.MessageEvent) error {
-	if len(message.Text) < 1 || message.Text[0] != '?' {
+func (s *SMIB) handleMessage(ctx context.Context, message *slack.MessageEvent) error {
+	switch message.SubType {
+	case "message_changed":
+		return s.handleEdit(ctx, message)
+	case "message_deleted":
+		s.handleDelete(message)
 		return nil
 	}
 
-	parts := strings.SplitN(message.Text, " ", 2)
-	cmd := strings.TrimPrefix(parts[0], "?")
-	args := ""
-	if len(parts) > 1 {
-		args = parts[1]
+	if s.ignoreMessage(message) {
+		return nil
 	}
+	return s.invoke(ctx, message, nil)
+}
 
-	if len(cmd) < 1 {
+// invoke runs the command in message, if it is one. The first replies update the messages with
+// timestamps previous, any of those left over afterwards are deleted.
+func (s *SMIB) invoke(ctx context.Context, message *slack.MessageEvent, previous []string) error {
+	defer func() {
+		s.deleteReplies(message.Channel, previous)
+	}()
+
+	isDM := func() bool { return s.isDM(message.Channel) }
+	cmd, args, ok := parseCommand(message.Text, s.Triggers, isDM, s.getSelfID())
+	if !ok {
 		return nil
 	}
 
-	s.slack.SendMessage(s.slack.NewTypingMessage(message.Channel))
+	ctx, replies := s.trackReplies(ctx, message.Channel, message.Timestamp)
+	defer replies.finish()
+
+	finish := s.startFeedback(message, replies)
 
-	user, err := s.slack.GetUserInfo(message.User)
+	var msgOpts []slack.RTMsgOption
+	if message.ThreadTimestamp != "" {
+		msgOpts = append(msgOpts, slack.RTMsgOptionTS(message.ThreadTimestamp))
+	}
+	reply := func(text string, private bool) {
+		if private && !isDM() {
+			s.postPrivate(message.Channel, message.User, message.ThreadTimestamp, text)
+			return
+		}
+		msg := s.slack.NewOutgoingMessage(text, message.Channel, msgOpts...)
+		sent := s.addReply(replies)
+		if len(previous) > 0 {
+			s.updateReply(sent, message.Channel, previous[0], msg)
+			previous = previous[1:]
+			return
+		}
+		s.awaitAck(sent, msg.ID)
+		s.sendMessage(msg)
+	}
+
+	upload := func(file outputFile, private bool) {
+		s.uploadFile(message.Channel, message.ThreadTimestamp, message.User, file, private)
+	}
+
+	ok, err := s.run(ctx, invocation{
+		cmd:      cmd,
+		args:     args,
+		user:     message.User,
+		channel:  message.Channel,
+		ts:       message.Timestamp,
+		threadTS: message.ThreadTimestamp,
+		upload:   upload,
+		files:    message.Files,
+	}, reply)
+	finish(ok)
+	return err
+}
+
+// setSelfID records SMIB's own slack user ID
+func (s *SMIB) setSelfID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.selfID = id
+}
+
+// getSelfID returns SMIB's own slack user ID, empty until connected
+func (s *SMIB) getSelfID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selfID
+}
+
+// run runs the command for inv, sending its output and any errors with reply. Replies only the
+// invoking user should see are private. It returns whether the command ran and exited
+// successfully.
+func (s *SMIB) run(ctx context.Context, inv invocation, reply func(text string, private bool)) (bool, error) {
+	user, err := s.getUser(inv.user)
 	if err != nil {
-		return fmt.Errorf("failed to get user info: %s", err)
+		return false, fmt.Errorf("failed to get user info: %s", err)
 	}
 
-	userMention := "<@" + message.User + ">"
+	userMention := "<@" + inv.user + ">"
 
-	channelName := "null" // If GetChannelInfo fails, we're probablt in an IM or Group
-	channel, err := s.slack.GetChannelInfo(message.Channel)
-	if err == nil {
-		channelName = channel.Name
+	channelName, channelType := s.conversationContext(inv.channel)
+
+	manifest, err := s.manifest(inv.cmd)
+	if err != nil {
+		reply(fmt.Sprintf("Sorry %s, %s's manifest is broken.", userMention, format.Escape(inv.cmd)), false)
+		return false, err
+	}
+	args, extra, err := s.commandArgs(inv.args, manifest)
+	switch err.(type) {
+	case nil:
+	case command.UsageError:
+		name, resolveErr := s.cmd.Resolve(inv.cmd)
+		if resolveErr != nil {
+			name = inv.cmd
+		}
+		reply(fmt.Sprintf("Sorry %s, %s. Usage: `%s`", userMention, format.Escape(err.Error()), format.Escape(manifest.Usage(name))), true)
+		return false, nil
+	default:
+		reply(fmt.Sprintf("Sorry %s, I couldn't read your args for %s, %s. Put args with spaces in quotes, like \"front door\".",
+			userMention, format.Escape(inv.cmd), format.Escape(err.Error())), true)
+		return false, nil
 	}
 
-	var msgOpts []slack.RTMsgOption
-	if message.ThreadTimestamp != "" {
-		msgOpts = append(msgOpts, slack.RTMsgOptionTS(message.ThreadTimestamp))
+	dir, err := ioutil.TempDir("", "smib-")
+	if err != nil {
+		reply(fmt.Sprintf("Sorry %s, %s is on fire.", userMention, format.Escape(inv.cmd)), false)
+		return false, fmt.Errorf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Print("Failed to remove temp dir: ", err)
+		}
+	}()
+	extra.Env = append(extra.Env, command.TempDirEnv+"="+dir)
+
+	if s.CallbackURL != "" {
+		token, err := s.grantCallbacks(inv, manifest)
+		if err != nil {
+			reply(fmt.Sprintf("Sorry %s, %s is on fire.", userMention, format.Escape(inv.cmd)), false)
+			return false, err
+		}
+		defer s.expireCallbacks(token)
+		extra.Env = append(extra.Env, command.CallbackURLEnv+"="+s.CallbackURL, command.CallbackTokenEnv+"="+token)
+	}
+
+	if len(inv.files) > 0 {
+		shared, err := s.downloadFiles(dir, inv.files)
+		var tooBig tooBigError
+		if errors.As(err, &tooBig) {
+			reply(fmt.Sprintf("Sorry %s, %s is too big for me to download, the limit is %s.",
+				userMention, format.Escape(tooBig.name), formatSize(s.maxDownload())), true)
+			return false, nil
+		}
+		if err != nil {
+			reply(fmt.Sprintf("Sorry %s, I couldn't download the files you shared with %s.", userMention, format.Escape(inv.cmd)), true)
+			return false, err
+		}
+		extra.Env = append(extra.Env, command.FilesEnv+"="+shared)
 	}
 
 	output, err := s.cmd.Run(
-		cmd,
+		ctx,
+		inv.cmd,
 		userMention,
 		user.Name,
 		channelName,
+		channelType,
 		args,
+		extra,
 	)
 	switch err := err.(type) {
 	case nil:
 		break
 	case command.NotFoundError:
-		s.slack.SendMessage(s.slack.NewOutgoingMessage(
-			fmt.Sprintf("Sorry %s, I don't have a %s command.", userMention, cmd),
-			message.Channel,
-			msgOpts...,
-		))
-		return nil
+		reply(fmt.Sprintf("Sorry %s, I don't have a %s command.", userMention, format.Escape(inv.cmd)), true)
+		return false, nil
 	case command.NotUniqueError:
-		s.slack.SendMessage(s.slack.NewOutgoingMessage(
-			fmt.Sprintf("Sorry %s, that wasn't unique, try one of: %s", userMention, err.GetCommands()),
-			message.Channel,
-			msgOpts...,
-		))
-		return nil
+		reply(fmt.Sprintf("Sorry %s, that wasn't unique, try one of: %s", userMention, format.Escape(err.GetCommands())), true)
+		return false, nil
 	default:
-		s.slack.SendMessage(s.slack.NewOutgoingMessage(
-			fmt.Sprintf("Sorry %s, %s is on fire.", userMention, cmd),
-			message.Channel,
-			msgOpts...,
-		))
-		return err
+		reply(fmt.Sprintf("Sorry %s, %s is on fire.", userMention, format.Escape(inv.cmd)), false)
+		return false, err
+	}
+
+	d := directives{private: manifest.Private}
+	ircFormatting := s.Output.IRCFormatting || manifest.IRCFormatting
+	allow := s.allowedMentions(inv.cmd)
+	send := func(line string) {
+		if ircFormatting {
+			line = format.IRC(line)
+		}
+		reply(format.Sanitise(line, allow), d.private)
+	}
+
+	// With SnippetLines set output is held back, and if there's too much of it it is uploaded
+	// as a snippet when the command exits
+	snippetLines := s.Output.SnippetLines
+	if inv.upload == nil {
+		snippetLines = 0
+	}
+	var (
+		held     []string
+		heldSize int64
+	)
+	flush := func() {
+		if len(held) > snippetLines {
+			inv.upload(s.snippet(inv.cmd, held, d), d.private)
+			return
+		}
+		for _, line := range held {
+			send(line)
+		}
 	}
 
 	reader := bufio.NewReader(output)
+	leading := true
 	for {
 		out, err := reader.ReadString('\n')
-		if len(out) > 0 {
-			s.slack.SendMessage(s.slack.NewOutgoingMessage(
-				out,
-				message.Channel,
-				msgOpts...,
-			))
+		if leading && strings.HasPrefix(out, directivePrefix) {
+			d.apply(out)
+		} else if len(out) > 0 {
+			leading = false
+			metrics.OutputLines.Inc()
+			if snippetLines > 0 {
+				// Output beyond the upload limit would be cut from the snippet anyway
+				if heldSize <= s.maxUpload() {
+					held = append(held, out)
+					heldSize += int64(len(out))
+				}
+			} else {
+				send(out)
+			}
 		}
 		switch err {
 		case nil:
 			continue
 		case io.EOF:
-			output.Close()
-			return nil
+			// The command logs its own failure
+			ok := output.Close() == nil
+			flush()
+			if inv.upload != nil {
+				s.uploadDir(dir, inv.cmd, userMention, d, inv.upload, reply)
+			}
+			return ok, nil
 		default:
-			s.slack.SendMessage(s.slack.NewOutgoingMessage(
-				fmt.Sprintf("Sorry %s, %s exploded or something.", userMention, cmd),
-				message.Channel,
-				msgOpts...,
-			))
-			return fmt.Errorf("failed to read output from command: %s", err)
+			flush()
+			reply(fmt.Sprintf("Sorry %s, %s exploded or something.", userMention, format.Escape(inv.cmd)), d.private)
+			return false, fmt.Errorf("failed to read output from command: %s", err)
+		}
+	}
+}
+
+// manifest returns the manifest of cmd, or an error if it has one which can't be read. Commands
+// which can't be found have the zero Manifest, they are reported when they are run.
+func (s *SMIB) manifest(cmd string) (command.Manifest, error) {
+	manifest, err := s.cmd.Manifest(cmd)
+	switch err.(type) {
+	case nil, command.NotFoundError, command.NotUniqueError:
+		return manifest, nil
+	}
+	return command.Manifest{}, err
+}
+
+// allowedMentions returns the mentions cmd may make in its output
+func (s *SMIB) allowedMentions(cmd string) format.Allow {
+	if len(s.Output.AllowMentions) > 0 {
+		if name, err := s.cmd.Resolve(cmd); err == nil && contains(s.Output.AllowMentions, name) {
+			return format.Allow{Special: true, Usergroups: true}
 		}
 	}
+	return format.Allow{Usergroups: !s.Output.BlockUsergroups}
 }
@@ -2,30 +2,83 @@ package smib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/nlopes/slack"
 	"github.com/nlopes/slack/slacktest"
 	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type mockCommand struct {
 	mock.Mock
+
+	// extras records the Extra passed to each Run, which isn't mocked, without the temp dir
+	mu     sync.Mutex
+	extras []command.Extra
+
+	// files are written to the temp dir by Run, by name, and tempDirs records each temp dir
+	files    map[string]string
+	tempDirs []string
+
+	// manifests are returned by Manifest without being mocked, commands without one have the zero
+	// Manifest
+	manifests map[string]command.Manifest
+	// manifestErrs are returned by Manifest for commands with broken manifests
+	manifestErrs map[string]error
+}
+
+// mockContext stops testify printing a context's fields, which races with cancelling it
+type mockContext struct {
+	context.Context
 }
 
-func (m *mockCommand) Run(cmd, user, userDisplay, channel, args string) (io.ReadCloser, error) {
-	mArgs := m.Called(cmd, user, userDisplay, channel, args)
+func (mockContext) String() string { return "context" }
+
+func (m *mockCommand) Run(ctx context.Context, cmd, user, userDisplay, channel, channelType, args string, extra command.Extra) (io.ReadCloser, error) {
+	m.mu.Lock()
+	var env []string
+	for _, e := range extra.Env {
+		if dir := strings.TrimPrefix(e, command.TempDirEnv+"="); dir != e {
+			m.tempDirs = append(m.tempDirs, dir)
+			for name, content := range m.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					panic(err)
+				}
+			}
+			continue
+		}
+		env = append(env, e)
+	}
+	extra.Env = env
+	m.extras = append(m.extras, extra)
+	m.mu.Unlock()
+	mArgs := m.Called(mockContext{ctx}, cmd, user, userDisplay, channel, channelType, args)
 	return mArgs.Get(0).(io.ReadCloser), mArgs.Error(1)
 }
 
+func (m *mockCommand) Resolve(cmd string) (string, error) {
+	mArgs := m.Called(cmd)
+	return mArgs.String(0), mArgs.Error(1)
+}
+
+func (m *mockCommand) Manifest(cmd string) (command.Manifest, error) {
+	return m.manifests[cmd], m.manifestErrs[cmd]
+}
+
 type badReader struct{}
 
 func (badReader) Read([]byte) (int, error) {
@@ -39,6 +92,8 @@ func (badReader) Close() error {
 type closedChecker struct {
 	wasClosed bool
 	reader    io.Reader
+	// exitErr is returned by Close, as if the command failed
+	exitErr error
 }
 
 func (c *closedChecker) wrap(in io.Reader) io.ReadCloser {
@@ -52,21 +107,21 @@ func (c *closedChecker) Read(b []byte) (int, error) {
 
 func (c *closedChecker) Close() error {
 	c.wasClosed = true
-	return nil
+	return c.exitErr
 }
 
 func TestNew(t *testing.T) {
 	client := slack.New("xoxb-whatever")
 	cmd := &mockCommand{}
-	smib := New(client, cmd)
-	assert.IsType(t, &slack.RTM{}, smib.slack)
+	smib := New(RTM(client), cmd)
+	assert.IsType(t, rtmTransport{}, smib.slack)
 	assert.Same(t, cmd, smib.cmd)
 }
 
 func TestListenAndRobot(t *testing.T) {
 	testServer := slacktest.NewTestServer()
 	testServer.SetBotName("smib")
-	testServer.Handle("/channels.info", func(w http.ResponseWriter, r *http.Request) {
+	testServer.Handle("/conversations.info", func(w http.ResponseWriter, r *http.Request) {
 		assert.NoError(t, r.ParseForm())
 		assert.Equal(t, "Xgeneral", r.Form["channel"][0], "Need to paramaterise this mock")
 		resp, _ := json.Marshal(struct{ Channel slack.Channel }{slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}}})
@@ -78,18 +133,18 @@ func TestListenAndRobot(t *testing.T) {
 	mockCmd := &mockCommand{}
 	mockCmd.Test(t)
 	reply := ioutil.NopCloser(bytes.NewReader([]byte("woteva")))
-	mockCmd.On("Run", "command", "<@Xspengler>", "spengler", "general", "arg arg").Return(reply, nil).Once()
+	mockCmd.On("Run", mock.Anything, "command", "<@Xspengler>", "spengler", "general", "public_channel", "arg arg").Return(reply, nil).Once()
 	defer mockCmd.AssertExpectations(t)
 
 	smib := SMIB{
-		slack: testRTM,
+		slack: rtmTransport{testRTM},
 		cmd:   mockCmd,
 	}
 
 	done := make(chan struct{})
 	var err error
 	go func() {
-		err = smib.ListenAndRobot()
+		err = smib.ListenAndRobot(context.Background())
 		close(done)
 	}()
 
@@ -104,9 +159,9 @@ func TestListenAndRobot(t *testing.T) {
 		},
 	}
 
-	assert.Eventually(t, func() bool {
+	waitUntil(t, func() bool {
 		return testServer.SawMessage("woteva")
-	}, time.Second, time.Millisecond)
+	}, "reply was not sent")
 	t.Log(testServer.GetSeenInboundMessages())
 
 	testServer.Stop()
@@ -123,10 +178,13 @@ func TestSMIB_handleMessage(t *testing.T) {
 		name         string
 		message      *slack.MessageEvent
 		primeCommand func(*testing.T, *mockCommand, func(io.Reader) io.ReadCloser)
+		conversation slack.Channel
 		chanInfoErr  bool
 		wantMessage  []msgThread
-		wantErr      string
-		shouldClose  bool
+		// wantEphemeral are messages only the invoking user should see
+		wantEphemeral []msgThread
+		wantErr       string
+		shouldClose   bool
 	}{
 		{
 			name: "not a command",
@@ -159,7 +217,7 @@ func TestSMIB_handleMessage(t *testing.T) {
 			},
 			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
 				cmdReader := c(bytes.NewReader([]byte("computer says yes")))
-				m.On("Run", "command", "<@Xspengler>", "spengler", "general", "y0").Return(cmdReader, nil).Once()
+				m.On("Run", mock.Anything, "command", "<@Xspengler>", "spengler", "general", "public_channel", "y0").Return(cmdReader, nil).Once()
 			},
 			wantMessage: []msgThread{{"computer says yes", ""}},
 			shouldClose: true,
@@ -185,7 +243,7 @@ func TestSMIB_handleMessage(t *testing.T) {
 			},
 			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
 				cmdReader := c(bytes.NewReader([]byte("3\n2\n1\n")))
-				m.On("Run", "countdown", "<@Xspengler>", "spengler", "general", "").Return(cmdReader, nil).Once()
+				m.On("Run", mock.Anything, "countdown", "<@Xspengler>", "spengler", "general", "public_channel", "").Return(cmdReader, nil).Once()
 			},
 			wantMessage: []msgThread{{"3\n", ""}, {"2\n", ""}, {"1\n", ""}},
 			shouldClose: true,
@@ -202,9 +260,9 @@ func TestSMIB_handleMessage(t *testing.T) {
 			},
 			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
 				empty := c(bytes.NewReader(nil))
-				m.On("Run", "badcommand", "<@Xspengler>", "spengler", "general", "").Return(empty, command.NotFoundError("")).Once()
+				m.On("Run", mock.Anything, "badcommand", "<@Xspengler>", "spengler", "general", "public_channel", "").Return(empty, command.NotFoundError("")).Once()
 			},
-			wantMessage: []msgThread{{"Sorry <@Xspengler>, I don't have a badcommand command.", "3.3"}},
+			wantEphemeral: []msgThread{{"Sorry <@Xspengler>, I don't have a badcommand command.", "3.3"}},
 		},
 		{
 			name: "nonunique command",
@@ -218,14 +276,14 @@ func TestSMIB_handleMessage(t *testing.T) {
 			},
 			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
 				empty := c(bytes.NewReader(nil))
-				m.On("Run", "c", "<@Xspengler>", "spengler", "general", "").Return(
+				m.On("Run", mock.Anything, "c", "<@Xspengler>", "spengler", "general", "public_channel", "").Return(
 					empty,
 					command.NotUniqueError{
 						Commands: []string{"commands", "countdown"},
 					},
 				).Once()
 			},
-			wantMessage: []msgThread{{"Sorry <@Xspengler>, that wasn't unique, try one of: commands countdown", "4.4"}},
+			wantEphemeral: []msgThread{{"Sorry <@Xspengler>, that wasn't unique, try one of: commands countdown", "4.4"}},
 		},
 		{
 			name: "error running command",
@@ -239,11 +297,27 @@ func TestSMIB_handleMessage(t *testing.T) {
 			},
 			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
 				empty := c(bytes.NewReader(nil))
-				m.On("Run", "crash", "<@Xspengler>", "spengler", "general", "").Return(empty, errors.New("oops")).Once()
+				m.On("Run", mock.Anything, "crash", "<@Xspengler>", "spengler", "general", "public_channel", "").Return(empty, errors.New("oops")).Once()
 			},
 			wantMessage: []msgThread{{"Sorry <@Xspengler>, crash is on fire.", "5.5"}},
 			wantErr:     "oops",
 		},
+		{
+			name: "broken manifest",
+			message: &slack.MessageEvent{
+				Msg: slack.Msg{
+					Text:            "?door open",
+					User:            "Xspengler",
+					Channel:         "Xgeneral",
+					ThreadTimestamp: "5.5",
+				},
+			},
+			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
+				m.manifestErrs = map[string]error{"door": errors.New("failed to parse manifest for 'door'")}
+			},
+			wantMessage: []msgThread{{"Sorry <@Xspengler>, door's manifest is broken.", "5.5"}},
+			wantErr:     "failed to parse manifest for 'door'",
+		},
 		{
 			name: "a command with bad reader",
 			message: &slack.MessageEvent{
@@ -255,7 +329,7 @@ func TestSMIB_handleMessage(t *testing.T) {
 				},
 			},
 			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
-				m.On("Run", "command", "<@Xspengler>", "spengler", "general", "y0").Return(badReader{}, nil).Once()
+				m.On("Run", mock.Anything, "command", "<@Xspengler>", "spengler", "general", "public_channel", "y0").Return(badReader{}, nil).Once()
 			},
 			wantMessage: []msgThread{{"Sorry <@Xspengler>, command exploded or something.", "6.6"}},
 			wantErr:     "failed to read output from command: I'm bad",
@@ -272,7 +346,7 @@ func TestSMIB_handleMessage(t *testing.T) {
 			},
 			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
 				cmdReader := c(bytes.NewReader([]byte("computer says yes")))
-				m.On("Run", "command", "<@Xspengler>", "spengler", "general", "y0").Return(cmdReader, nil).Once()
+				m.On("Run", mock.Anything, "command", "<@Xspengler>", "spengler", "general", "public_channel", "y0").Return(cmdReader, nil).Once()
 			},
 			wantMessage: []msgThread{{"computer says yes", "2.2"}},
 			shouldClose: true,
@@ -288,7 +362,64 @@ func TestSMIB_handleMessage(t *testing.T) {
 			},
 			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
 				cmdReader := c(bytes.NewReader([]byte("computer says yes")))
-				m.On("Run", "command", "<@Xspengler>", "spengler", "null", "y0").Return(cmdReader, nil).Once()
+				m.On("Run", mock.Anything, "command", "<@Xspengler>", "spengler", "null", "im", "y0").Return(cmdReader, nil).Once()
+			},
+			wantMessage:  []msgThread{{"computer says yes", ""}},
+			shouldClose:  true,
+			conversation: slack.Channel{GroupConversation: slack.GroupConversation{Conversation: slack.Conversation{IsIM: true}}},
+		},
+		{
+			name: "a command in a private channel",
+			message: &slack.MessageEvent{
+				Msg: slack.Msg{
+					Text:    "?command y0",
+					User:    "Xspengler",
+					Channel: "Xgeneral",
+				},
+			},
+			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
+				cmdReader := c(bytes.NewReader([]byte("computer says yes")))
+				m.On("Run", mock.Anything, "command", "<@Xspengler>", "spengler", "containment", "private_channel", "y0").Return(cmdReader, nil).Once()
+			},
+			wantMessage: []msgThread{{"computer says yes", ""}},
+			shouldClose: true,
+			conversation: slack.Channel{GroupConversation: slack.GroupConversation{
+				Name:         "containment",
+				Conversation: slack.Conversation{IsPrivate: true},
+			}},
+		},
+		{
+			name: "a command in a group dm",
+			message: &slack.MessageEvent{
+				Msg: slack.Msg{
+					Text:    "?command y0",
+					User:    "Xspengler",
+					Channel: "Xgeneral",
+				},
+			},
+			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
+				cmdReader := c(bytes.NewReader([]byte("computer says yes")))
+				m.On("Run", mock.Anything, "command", "<@Xspengler>", "spengler", "mpdm-spengler--egon--ray-1", "mpim", "y0").Return(cmdReader, nil).Once()
+			},
+			wantMessage: []msgThread{{"computer says yes", ""}},
+			shouldClose: true,
+			conversation: slack.Channel{GroupConversation: slack.GroupConversation{
+				Name:         "mpdm-spengler--egon--ray-1",
+				Conversation: slack.Conversation{IsMpIM: true, IsPrivate: true},
+			}},
+		},
+		{
+			name: "a command when conversation info fails",
+			message: &slack.MessageEvent{
+				Msg: slack.Msg{
+					Text:    "?command y0",
+					User:    "Xspengler",
+					Channel: "Xgeneral",
+				},
+			},
+			primeCommand: func(t *testing.T, m *mockCommand, c func(io.Reader) io.ReadCloser) {
+				cmdReader := c(bytes.NewReader([]byte("computer says yes")))
+				m.On("Run", mock.Anything, "command", "<@Xspengler>", "spengler", "Xgeneral", "public_channel", "y0").Return(cmdReader, nil).Once()
 			},
 			wantMessage: []msgThread{{"computer says yes", ""}},
 			shouldClose: true,
@@ -300,16 +431,27 @@ func TestSMIB_handleMessage(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			testServer := slacktest.NewTestServer()
 			testServer.SetBotName("smib")
-			testServer.Handle("/channels.info", func(w http.ResponseWriter, r *http.Request) {
+			testServer.Handle("/conversations.info", func(w http.ResponseWriter, r *http.Request) {
 				assert.NoError(t, r.ParseForm())
 				assert.Equal(t, "Xgeneral", r.Form["channel"][0], "Need to paramaterise this mock")
 				if tt.chanInfoErr {
 					w.WriteHeader(404)
 					return
 				}
-				resp, _ := json.Marshal(struct{ Channel slack.Channel }{slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}}})
+				conversation := tt.conversation
+				if conversation.Name == "" && !conversation.IsIM {
+					conversation = slack.Channel{GroupConversation: slack.GroupConversation{Name: "general"}}
+				}
+				resp, _ := json.Marshal(struct{ Channel slack.Channel }{conversation})
 				w.Write(resp)
 			})
+			var ephemeral []msgThread
+			testServer.Handle("/chat.postEphemeral", func(w http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, r.ParseForm())
+				assert.Equal(t, "Xspengler", r.Form.Get("user"))
+				ephemeral = append(ephemeral, msgThread{r.Form.Get("text"), r.Form.Get("thread_ts")})
+				w.Write([]byte(`{"ok":true,"message_ts":"5.5"}`))
+			})
 			testServer.Start()
 			testRTM := testServer.GetTestRTMInstance()
 			go testRTM.ManageConnection()
@@ -323,16 +465,17 @@ func TestSMIB_handleMessage(t *testing.T) {
 			defer mockCmd.AssertExpectations(t)
 
 			smib := SMIB{
-				slack: testRTM,
+				slack: rtmTransport{testRTM},
 				cmd:   mockCmd,
 			}
 
-			err := smib.handleMessage(tt.message)
+			err := smib.handleMessage(context.Background(), tt.message)
 			if tt.wantErr == "" {
 				assert.NoError(t, err)
 			} else {
 				assert.Contains(t, err.Error(), tt.wantErr)
 			}
+			drain(t, &smib)
 
 			// handleMessage has returned but the testServer needs time to receive its messages
 			time.Sleep(time.Millisecond * 10)
@@ -343,9 +486,10 @@ func TestSMIB_handleMessage(t *testing.T) {
 				sawTypingMessage(t, testServer)
 				sawMessage(t, testServer, msg.text, msg.threadTS)
 			}
-			if len(tt.wantMessage) < 1 {
+			if len(tt.wantMessage) < 1 && len(tt.wantEphemeral) < 1 {
 				assert.Empty(t, testServer.GetSeenInboundMessages())
 			}
+			assert.Equal(t, tt.wantEphemeral, ephemeral)
 			assert.Equal(t, tt.shouldClose, closeCheck.wasClosed)
 		})
 	}
@@ -390,3 +534,114 @@ func sawMessage(t *testing.T, server *slacktest.Server, expected, thread string)
 	}
 	return false
 }
+
+func TestSMIB_run_ircFormatting(t *testing.T) {
+	tests := []struct {
+		name     string
+		global   bool
+		manifest command.Manifest
+		want     []string
+	}{
+		{
+			name: "off",
+			want: []string{"\x02open\x02\n", "/me waves\n"},
+		},
+		{
+			name:   "global",
+			global: true,
+			want:   []string{"*open*\n", "_waves_\n"},
+		},
+		{
+			name:     "manifest",
+			manifest: command.Manifest{IRCFormatting: true},
+			want:     []string{"*open*\n", "_waves_\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCmd := &mockCommand{manifests: map[string]command.Manifest{"door": tt.manifest}}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			mockCmd.On("Run", mock.Anything, "door", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+				Return(output("\x02open\x02\n/me waves\n"), nil).Once()
+			smib := SMIB{
+				slack:  &reactionTransport{},
+				cmd:    mockCmd,
+				Output: config.Output{IRCFormatting: tt.global},
+			}
+
+			var got []string
+			ok, err := smib.run(context.Background(), invocation{cmd: "door", user: "Xspengler", channel: "Xgeneral"}, func(text string, _ bool) {
+				got = append(got, text)
+			})
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSMIB_run_mentions(t *testing.T) {
+	const out = "<!here> <!subteam^SAZ94GDB8|@trustees> <@Xspengler> 1 < 2\n"
+	tests := []struct {
+		name   string
+		output config.Output
+		want   string
+	}{
+		{
+			name: "default",
+			want: "&lt;!here&gt; <!subteam^SAZ94GDB8|@trustees> <@Xspengler> 1 &lt; 2\n",
+		},
+		{
+			name:   "usergroups blocked",
+			output: config.Output{BlockUsergroups: true},
+			want:   "&lt;!here&gt; &lt;!subteam^SAZ94GDB8|@trustees&gt; <@Xspengler> 1 &lt; 2\n",
+		},
+		{
+			name:   "other command allowed",
+			output: config.Output{AllowMentions: []string{"doorbell"}, BlockUsergroups: true},
+			want:   "&lt;!here&gt; &lt;!subteam^SAZ94GDB8|@trustees&gt; <@Xspengler> 1 &lt; 2\n",
+		},
+		{
+			name:   "command allowed",
+			output: config.Output{AllowMentions: []string{"door"}, BlockUsergroups: true},
+			want:   "<!here> <!subteam^SAZ94GDB8|@trustees> <@Xspengler> 1 &lt; 2\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCmd := &mockCommand{}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			mockCmd.On("Run", mock.Anything, "do", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+				Return(output(out), nil).Once()
+			if len(tt.output.AllowMentions) > 0 {
+				mockCmd.On("Resolve", "do").Return("door", nil).Once()
+			}
+			smib := SMIB{slack: &reactionTransport{}, cmd: mockCmd, Output: tt.output}
+
+			var got []string
+			_, err := smib.run(context.Background(), invocation{cmd: "do", user: "Xspengler", channel: "Xgeneral"}, func(text string, _ bool) {
+				got = append(got, text)
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{tt.want}, got)
+		})
+	}
+}
+
+func TestSMIB_run_escapesCommand(t *testing.T) {
+	mockCmd := &mockCommand{}
+	mockCmd.Test(t)
+	defer mockCmd.AssertExpectations(t)
+	mockCmd.On("Run", mock.Anything, "<!channel>", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+		Return(output(""), command.NotFoundError("")).Once()
+	smib := SMIB{slack: &reactionTransport{}, cmd: mockCmd}
+
+	var got []string
+	_, err := smib.run(context.Background(), invocation{cmd: "<!channel>", user: "Xspengler", channel: "Xgeneral"}, func(text string, _ bool) {
+		got = append(got, text)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Sorry <@Xspengler>, I don't have a &lt;!channel&gt; command."}, got)
+}
@@ -0,0 +1,166 @@
+package smib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/metrics"
+)
+
+// ErrInvalidAuth is returned by ListenAndRobot when slack rejects SMIB's token
+var ErrInvalidAuth = errors.New("slack rejected the token (invalid_auth)")
+
+// State is the state of SMIB's connection to slack
+type State string
+
+// Connection states
+const (
+	StateStarting     State = "starting"
+	StateConnecting   State = "connecting"
+	StateConnected    State = "connected"
+	StateDisconnected State = "disconnected"
+	StateInvalidAuth  State = "invalid_auth"
+)
+
+// Status describes SMIB's connection to slack
+type Status struct {
+	State State
+	// Since is when State was entered
+	Since time.Time
+	// DownSince is when SMIB last lost its connection, or started if it has never connected, it is
+	// zero while connected
+	DownSince time.Time
+	// Attempt is the number of the connection attempt in progress while connecting
+	Attempt int
+	// Backoff is how long the transport is waiting before its next connection attempt, after a
+	// connection error
+	Backoff time.Duration
+	// Err is what caused the last disconnect or failed connection attempt
+	Err error
+	// RateLimitedUntil is when the last rate limit from slack ends, messages are held until then
+	RateLimitedUntil time.Time
+}
+
+// Status returns the state of SMIB's connection to slack
+func (s *SMIB) Status() Status {
+	s.mu.Lock()
+	status := s.status
+	out := s.out
+	s.mu.Unlock()
+
+	if status.State == "" {
+		status.State = StateStarting
+	}
+	if out != nil {
+		out.mu.Lock()
+		status.RateLimitedUntil = out.pausedUntil
+		out.mu.Unlock()
+	}
+	return status
+}
+
+// OnStateChange registers hook to be called whenever the connection changes state, such as to pause
+// work while SMIB is disconnected. Hooks are called in order from the event loop, they must not
+// block.
+func (s *SMIB) OnStateChange(hook func(Status)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// updateStatus applies update to the connection status, calling the hooks if the state changed.
+// Messages are held while SMIB is not connected.
+func (s *SMIB) updateStatus(state State, update func(*Status)) {
+	s.mu.Lock()
+	changed := s.status.State != state
+	if changed {
+		now := time.Now()
+		downSince := s.status.DownSince
+		switch {
+		case state == StateConnected:
+			downSince = time.Time{}
+			metrics.Connected.Set(1)
+			metrics.Connects.Inc()
+		case s.status.State == StateConnected:
+			downSince = now
+			metrics.Connected.Set(0)
+			metrics.Disconnects.Inc()
+		}
+		s.status = Status{State: state, Since: now, DownSince: downSince}
+	}
+	if update != nil {
+		update(&s.status)
+	}
+	status := s.status
+	hooks := append([]func(Status){}, s.hooks...)
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	s.getOutbox().hold(state != StateConnected)
+	for _, hook := range hooks {
+		hook(status)
+	}
+}
+
+// handleConnectionEvent handles events about the connection to slack rather than from it. It
+// returns ErrInvalidAuth if slack rejected the token, after which the transport gives up.
+func (s *SMIB) handleConnectionEvent(data interface{}) error {
+	switch data := data.(type) {
+	case *slack.ConnectingEvent:
+		log.Print(fmt.Sprintf("Connecting to slack, attempt %d", data.Attempt))
+		s.updateStatus(StateConnecting, func(status *Status) {
+			status.Attempt = data.Attempt
+		})
+	case *slack.ConnectionErrorEvent:
+		log.Print(fmt.Sprintf("Failed to connect to slack on attempt %d, retrying in %s: %s", data.Attempt, data.Backoff, data.ErrorObj))
+		s.updateStatus(StateConnecting, func(status *Status) {
+			status.Attempt = data.Attempt
+			status.Backoff = data.Backoff
+			status.Err = data.ErrorObj
+		})
+	case *slack.ConnectedEvent:
+		log.Println("SMIB connected")
+		if data.Info != nil && data.Info.User != nil {
+			s.setSelfID(data.Info.User.ID)
+			s.seedSelf(data.Info)
+		}
+		s.updateStatus(StateConnected, nil)
+		if s.ListWorkspace {
+			go s.warmCaches()
+		}
+	case *slack.DisconnectedEvent:
+		if data.Intentional {
+			log.Println("SMIB disconnected")
+		} else {
+			log.Println("SMIB disconnected, reconnecting: ", data.Cause)
+		}
+		s.updateStatus(StateDisconnected, func(status *Status) {
+			status.Err = data.Cause
+		})
+	case *slack.InvalidAuthEvent:
+		s.updateStatus(StateInvalidAuth, func(status *Status) {
+			status.Err = ErrInvalidAuth
+		})
+		return ErrInvalidAuth
+	case *slack.RateLimitEvent:
+		log.Print("Rate limited by slack, holding messages for ", rateLimitBackoff)
+		s.getOutbox().backoff(rateLimitBackoff)
+	case *slack.RTMError:
+		log.Print("Slack reported an error: ", data)
+	case *slack.IncomingEventError:
+		log.Print("Failed to read from slack: ", data.ErrorObj)
+	case *slack.UnmarshallingErrorEvent:
+		log.Print("Failed to decode event from slack: ", data.ErrorObj)
+	case *slack.OutgoingErrorEvent:
+		s.sendFailed(data.Message.ID, data.ErrorObj)
+	case *slack.MessageTooLongEvent:
+		// chat.postMessage takes longer messages, which sendFailed falls back to
+		s.sendFailed(data.Message.ID, fmt.Errorf("message longer than %d characters", data.MaxLength))
+	}
+	return nil
+}
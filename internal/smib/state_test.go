@@ -0,0 +1,191 @@
+package smib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventTransport is a transport whose events are pushed by the test
+type eventTransport struct {
+	fakeTransport
+
+	events chan slack.RTMEvent
+	// lists counts calls to GetUsers
+	lists int32
+}
+
+func newEventTransport() *eventTransport {
+	return &eventTransport{events: make(chan slack.RTMEvent)}
+}
+
+func (e *eventTransport) ManageConnection()             {}
+func (e *eventTransport) Disconnect() error             { return nil }
+func (e *eventTransport) Events() <-chan slack.RTMEvent { return e.events }
+func (e *eventTransport) GetUsers() ([]slack.User, error) {
+	atomic.AddInt32(&e.lists, 1)
+	return nil, errors.New("offline")
+}
+func (e *eventTransport) GetConversations(*slack.GetConversationsParameters) ([]slack.Channel, string, error) {
+	return nil, "", errors.New("offline")
+}
+
+// stateRecorder records the statuses passed to a state change hook
+type stateRecorder struct {
+	mu       sync.Mutex
+	statuses []Status
+}
+
+func (r *stateRecorder) hook(status Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = append(r.statuses, status)
+}
+
+func (r *stateRecorder) states() []State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var states []State
+	for _, status := range r.statuses {
+		states = append(states, status.State)
+	}
+	return states
+}
+
+func TestListenAndRobot_connectionEvents(t *testing.T) {
+	transport := newEventTransport()
+	smib := SMIB{slack: transport}
+	assert.Equal(t, StateStarting, smib.Status().State)
+
+	var recorder stateRecorder
+	smib.OnStateChange(recorder.hook)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- smib.ListenAndRobot(ctx)
+	}()
+
+	connErr := errors.New("dial failed")
+	transport.events <- slack.RTMEvent{Type: "connecting", Data: &slack.ConnectingEvent{Attempt: 1}}
+	transport.events <- slack.RTMEvent{Type: "connection_error", Data: &slack.ConnectionErrorEvent{
+		Attempt:  1,
+		Backoff:  3 * time.Second,
+		ErrorObj: connErr,
+	}}
+	waitUntil(t, func() bool { return smib.Status().Err != nil })
+	status := smib.Status()
+	assert.Equal(t, StateConnecting, status.State)
+	assert.Equal(t, 1, status.Attempt)
+	assert.Equal(t, 3*time.Second, status.Backoff)
+	assert.Equal(t, connErr, status.Err)
+
+	transport.events <- slack.RTMEvent{Type: "connecting", Data: &slack.ConnectingEvent{Attempt: 2}}
+	transport.events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{
+		Info: &slack.Info{User: &slack.UserDetails{ID: "Xsmib"}},
+	}}
+	waitUntil(t, func() bool { return smib.Status().State == StateConnected })
+	assert.Equal(t, "Xsmib", smib.getSelfID())
+	assert.NoError(t, smib.healthy(time.Minute))
+
+	transport.events <- slack.RTMEvent{Type: "disconnected", Data: &slack.DisconnectedEvent{Cause: slack.ErrRTMDisconnected}}
+	waitUntil(t, func() bool { return smib.Status().State == StateDisconnected })
+	assert.Equal(t, slack.ErrRTMDisconnected, smib.Status().Err)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		require.FailNow(t, "ListenAndRobot did not return")
+	}
+
+	assert.Equal(t, []State{StateConnecting, StateConnected, StateDisconnected}, recorder.states(),
+		"hooks are only called when the state changes")
+}
+
+func TestListenAndRobot_listWorkspace(t *testing.T) {
+	for _, list := range []bool{false, true} {
+		t.Run(fmt.Sprint(list), func(t *testing.T) {
+			transport := newEventTransport()
+			smib := SMIB{slack: transport, ListWorkspace: list}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go smib.ListenAndRobot(ctx)
+
+			for i := 0; i < 2; i++ {
+				transport.events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{
+					ConnectionCount: i,
+					Info: &slack.Info{
+						User: &slack.UserDetails{ID: "Xsmib", Name: "smib"},
+						Team: &slack.Team{ID: "Xteam"},
+					},
+				}}
+				transport.events <- slack.RTMEvent{Type: "disconnected", Data: &slack.DisconnectedEvent{}}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if list {
+				assert.Equal(t, int32(1), atomic.LoadInt32(&transport.lists), "listed once, not on reconnecting")
+			} else {
+				assert.Zero(t, atomic.LoadInt32(&transport.lists), "not listed on connecting or reconnecting")
+			}
+
+			// eventTransport can't look users up, so SMIB must come from the cache
+			self, err := smib.getUser("Xsmib")
+			require.NoError(t, err)
+			assert.Equal(t, "smib", self.Name)
+			assert.Equal(t, "Xteam", self.TeamID)
+		})
+	}
+}
+
+func TestListenAndRobot_invalidAuth(t *testing.T) {
+	transport := newEventTransport()
+	smib := SMIB{slack: transport}
+
+	done := make(chan error)
+	go func() {
+		done <- smib.ListenAndRobot(context.Background())
+	}()
+
+	transport.events <- slack.RTMEvent{Type: "connecting", Data: &slack.ConnectingEvent{Attempt: 1}}
+	transport.events <- slack.RTMEvent{Type: "invalid_auth", Data: &slack.InvalidAuthEvent{}}
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, ErrInvalidAuth))
+	case <-time.After(time.Second):
+		require.FailNow(t, "ListenAndRobot did not return")
+	}
+	assert.Equal(t, StateInvalidAuth, smib.Status().State)
+}
+
+func TestSMIB_updateStatus_holdsMessages(t *testing.T) {
+	transport := &fakeTransport{}
+	smib := SMIB{slack: transport}
+
+	smib.updateStatus(StateDisconnected, nil)
+	smib.sendMessage(transport.NewOutgoingMessage("hi", "Xgeneral"))
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, transport.getSent(), "messages are held while disconnected")
+
+	smib.updateStatus(StateConnected, nil)
+	waitUntil(t, func() bool { return len(transport.getSent()) == 1 }, "held message was not sent on reconnect")
+	smib.acked(1, "1630000000.000100")
+}
+
+func TestSMIB_Status_rateLimited(t *testing.T) {
+	smib := SMIB{slack: &fakeTransport{}}
+	smib.updateStatus(StateConnected, nil)
+
+	before := time.Now()
+	require.NoError(t, smib.handleConnectionEvent(&slack.RateLimitEvent{}))
+	assert.WithinDuration(t, before.Add(rateLimitBackoff), smib.Status().RateLimitedUntil, time.Second)
+}
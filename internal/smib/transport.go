@@ -0,0 +1,51 @@
+package smib
+
+import (
+	"io"
+
+	"github.com/nlopes/slack"
+)
+
+// Transport is a connection to slack which delivers events and sends messages. Events are
+// delivered in the form used by the RTM API whatever the underlying transport.
+type Transport interface {
+	// ManageConnection connects to slack and keeps the connection alive until Disconnect
+	ManageConnection()
+	Disconnect() error
+	// Events returns the channel events are delivered on
+	Events() <-chan slack.RTMEvent
+
+	NewOutgoingMessage(text, channelID string, options ...slack.RTMsgOption) *slack.OutgoingMessage
+	NewTypingMessage(channelID string) *slack.OutgoingMessage
+	// SendMessage sends msg, the result is delivered as an ack event
+	SendMessage(msg *slack.OutgoingMessage)
+	PostMessage(channelID string, options ...slack.MsgOption) (string, string, error)
+	PostEphemeral(channelID, userID string, options ...slack.MsgOption) (string, error)
+	UpdateMessage(channelID, timestamp string, options ...slack.MsgOption) (string, string, string, error)
+	DeleteMessage(channelID, timestamp string) (string, string, error)
+	AddReaction(name string, item slack.ItemRef) error
+	RemoveReaction(name string, item slack.ItemRef) error
+	UploadFile(params slack.FileUploadParameters) (*slack.File, error)
+	// GetFile downloads a file shared in slack to writer
+	GetFile(downloadURL string, writer io.Writer) error
+
+	GetUserInfo(user string) (*slack.User, error)
+	GetUsers() ([]slack.User, error)
+	GetConversationInfo(channelID string, includeLocale bool) (*slack.Channel, error)
+	GetConversations(params *slack.GetConversationsParameters) ([]slack.Channel, string, error)
+	OpenConversation(params *slack.OpenConversationParameters) (*slack.Channel, bool, bool, error)
+}
+
+// rtmTransport is a Transport using the RTM API
+type rtmTransport struct {
+	*slack.RTM
+}
+
+// RTM returns a Transport using slack's RTM API, client must be a valid slack.Client.
+func RTM(client *slack.Client) Transport {
+	return rtmTransport{client.NewRTM()}
+}
+
+func (r rtmTransport) Events() <-chan slack.RTMEvent {
+	return r.IncomingEvents
+}
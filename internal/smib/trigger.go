@@ -0,0 +1,117 @@
+package smib
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/somakeit/slacker-smib/internal/config"
+)
+
+// defaultPrefixes are used if no triggers are configured at all
+var defaultPrefixes = []string{"?"}
+
+// parseCommand returns the command and args from text if it is a command invocation according to
+// triggers. isDM reports whether the message was sent directly to SMIB, it is only called when no
+// other trigger matched and DMs need no prefix. selfID is SMIB's user ID, used to recognise
+// mentions. The command and args are the same whichever trigger was used.
+func parseCommand(text string, triggers config.Triggers, isDM func() bool, selfID string) (cmd, args string, ok bool) {
+	rest, ok := cutTrigger(text, triggers, isDM, selfID)
+	if !ok {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(rest, " ", 2)
+	cmd = parts[0]
+	if len(parts) > 1 {
+		args = parts[1]
+	}
+	if len(cmd) < 1 {
+		return "", "", false
+	}
+	return cmd, args, true
+}
+
+// cutTrigger returns text with its trigger removed
+func cutTrigger(text string, triggers config.Triggers, isDM func() bool, selfID string) (string, bool) {
+	prefixes := triggers.Prefixes
+	if len(prefixes) == 0 && !triggers.Mention && !triggers.DMWithoutPrefix {
+		prefixes = defaultPrefixes
+	}
+	for _, prefix := range prefixes {
+		if rest, ok := cutPrefix(text, prefix); ok {
+			// Single character prefixes such as ? must be followed directly by the command, but
+			// wordy ones such as "smib:" read naturally with a space.
+			if utf8.RuneCountInString(prefix) > 1 {
+				rest = strings.TrimLeft(rest, " ")
+			}
+			return rest, true
+		}
+	}
+
+	if triggers.Mention && selfID != "" {
+		if rest, ok := cutMention(text, selfID); ok {
+			rest = strings.TrimLeft(rest, " ")
+			rest = strings.TrimPrefix(rest, ":")
+			rest = strings.TrimLeft(rest, " ")
+			// Allow "@smib ?door" as well as "@smib door"
+			for _, prefix := range prefixes {
+				if withoutPrefix, ok := cutPrefix(rest, prefix); ok {
+					return strings.TrimLeft(withoutPrefix, " "), true
+				}
+			}
+			return rest, true
+		}
+	}
+
+	if triggers.DMWithoutPrefix && isDM() {
+		return strings.TrimLeft(text, " "), true
+	}
+
+	return "", false
+}
+
+// cutPrefix removes prefix from the start of text. Letters are matched case insensitively and
+// full-width characters in text, as typed by some mobile keyboards, match their ASCII equivalents.
+func cutPrefix(text, prefix string) (string, bool) {
+	rest := text
+	for _, want := range prefix {
+		got, size := utf8.DecodeRuneInString(rest)
+		if size == 0 {
+			return "", false
+		}
+		if unicode.ToLower(halfWidth(got)) != unicode.ToLower(want) {
+			return "", false
+		}
+		rest = rest[size:]
+	}
+	return rest, true
+}
+
+// cutMention removes a leading mention of the user with ID id, slack sends these as <@U123> or
+// <@U123|name>.
+func cutMention(text, id string) (string, bool) {
+	rest := strings.TrimPrefix(text, "<@"+id)
+	if rest == text || len(rest) < 1 {
+		return "", false
+	}
+	switch rest[0] {
+	case '>':
+		return rest[1:], true
+	case '|':
+		end := strings.IndexByte(rest, '>')
+		if end < 0 {
+			return "", false
+		}
+		return rest[end+1:], true
+	}
+	return "", false
+}
+
+// halfWidth maps full-width forms of ASCII characters, such as ？, to ASCII
+func halfWidth(r rune) rune {
+	if r >= '！' && r <= '～' {
+		return r - 0xFEE0
+	}
+	return r
+}
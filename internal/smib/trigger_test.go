@@ -0,0 +1,69 @@
+package smib
+
+import (
+	"testing"
+
+	"github.com/somakeit/slacker-smib/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	all := config.Triggers{
+		Prefixes:        []string{"?", "!", "smib:"},
+		Mention:         true,
+		DMWithoutPrefix: true,
+	}
+	tests := []struct {
+		name     string
+		text     string
+		triggers config.Triggers
+		isDM     bool
+		wantCmd  string
+		wantArgs string
+		wantOK   bool
+	}{
+		{name: "default prefix", text: "?door open", wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "default ignores other prefixes", text: "!door open"},
+		{name: "chatter", text: "is the door open?", triggers: all},
+		{name: "empty", text: "", triggers: all},
+		{name: "question mark", text: "?door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "full-width question mark", text: "？door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "bang", text: "!door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "full-width bang", text: "！door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "word prefix", text: "smib: door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "word prefix without space", text: "smib:door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "capitalised word prefix", text: "Smib: door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "full-width colon", text: "smib： door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "space after symbol prefix", text: "? door", triggers: all},
+		{name: "prefix only", text: "?", triggers: all},
+		{name: "mention", text: "<@Usmib> door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "mention with name", text: "<@Usmib|smib> door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "mention with colon", text: "<@Usmib>: door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "mention with prefix", text: "<@Usmib> ?door open", triggers: all, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "mention of someone else", text: "<@Uspengler> door open", triggers: all},
+		{name: "mention of someone else with a similar ID", text: "<@Usmibby> door open", triggers: all},
+		{name: "mention alone", text: "<@Usmib>", triggers: all},
+		{name: "mention disabled", text: "<@Usmib> door open", triggers: config.Triggers{Prefixes: []string{"?"}}},
+		{name: "dm without prefix", text: "door open", triggers: all, isDM: true, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "dm with prefix", text: "?door open", triggers: all, isDM: true, wantCmd: "door", wantArgs: "open", wantOK: true},
+		{name: "channel without prefix", text: "door open", triggers: all},
+		{name: "dm without prefix disabled", text: "door open", isDM: true},
+		{name: "args keep their spacing", text: "?say  hello   world ", wantCmd: "say", wantArgs: " hello   world ", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			looked := false
+			isDM := func() bool {
+				looked = true
+				return tt.isDM
+			}
+			cmd, args, ok := parseCommand(tt.text, tt.triggers, isDM, "Usmib")
+			if !tt.triggers.DMWithoutPrefix {
+				assert.False(t, looked, "DM-ness is only needed when DMs need no prefix")
+			}
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantCmd, cmd)
+			assert.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
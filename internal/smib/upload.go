@@ -0,0 +1,140 @@
+package smib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/format"
+)
+
+// defaultMaxUpload is the largest file uploaded if Files.MaxUploadBytes is unset
+const defaultMaxUpload = 10 << 20
+
+// outputFile is a file sent with a command's output
+type outputFile struct {
+	name           string
+	title, comment string
+	content        []byte
+	// snippet uploads content as a text snippet
+	snippet bool
+}
+
+// maxUpload returns the largest file commands may upload
+func (s *SMIB) maxUpload() int64 {
+	if s.Files.MaxUploadBytes > 0 {
+		return s.Files.MaxUploadBytes
+	}
+	return defaultMaxUpload
+}
+
+// uploadDir uploads the files cmd wrote to dir with upload. Files too big to upload are reported
+// with reply instead.
+func (s *SMIB) uploadDir(dir, cmd, userMention string, d directives, upload func(outputFile, bool), reply func(string, bool)) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Print("Failed to list files written by command: ", err)
+		return
+	}
+	for _, info := range files {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if info.Size() > s.maxUpload() {
+			reply(fmt.Sprintf("Sorry %s, %s made %s which is too big to upload, the limit is %s.",
+				userMention, format.Escape(cmd), format.Escape(info.Name()), formatSize(s.maxUpload())), d.private)
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			log.Print("Failed to read file written by command: ", err)
+			continue
+		}
+		upload(outputFile{
+			name:    info.Name(),
+			title:   d.title,
+			comment: d.comment,
+			content: content,
+		}, d.private)
+	}
+}
+
+// snippet returns lines, the output of cmd, as a text snippet to upload. Output over the upload
+// limit is cut short.
+func (s *SMIB) snippet(cmd string, lines []string, d directives) outputFile {
+	const truncated = "\n[output truncated]\n"
+	content := []byte(strings.Join(lines, ""))
+	if max := s.maxUpload(); int64(len(content)) > max {
+		if max > int64(len(truncated)) {
+			content = append(content[:max-int64(len(truncated))], truncated...)
+		} else {
+			content = content[:max]
+		}
+	}
+	return outputFile{
+		name:    cmd + ".txt",
+		title:   d.title,
+		comment: d.comment,
+		content: content,
+		snippet: true,
+	}
+}
+
+// uploadFile uploads file to channel, in the thread threadTS if it isn't empty. Private files are
+// uploaded to user's direct messages instead, unless channel is one.
+func (s *SMIB) uploadFile(channel, threadTS, user string, file outputFile, private bool) {
+	s.enqueue(channel, func() error {
+		params := slack.FileUploadParameters{
+			Filename:        file.name,
+			Title:           file.title,
+			InitialComment:  file.comment,
+			Channels:        []string{channel},
+			ThreadTimestamp: threadTS,
+		}
+		if file.snippet {
+			params.Content = string(file.content)
+			params.Filetype = "text"
+		} else {
+			params.Reader = bytes.NewReader(file.content)
+		}
+
+		var limited *slack.RateLimitedError
+		if private && !s.isDM(channel) {
+			im, _, _, err := s.slack.OpenConversation(&slack.OpenConversationParameters{Users: []string{user}, ReturnIM: true})
+			if errors.As(err, &limited) {
+				return err
+			}
+			if err != nil {
+				log.Print(fmt.Sprintf("Failed to open DM with %s to upload %s: %s", user, file.name, err))
+				return nil
+			}
+			params.Channels = []string{im.ID}
+			params.ThreadTimestamp = ""
+		}
+
+		_, err := s.slack.UploadFile(params)
+		if err != nil && !errors.As(err, &limited) {
+			log.Print(fmt.Sprintf("Failed to upload %s to %s: %s", file.name, params.Channels[0], err))
+			return nil
+		}
+		return err
+	})
+}
+
+// formatSize formats a number of bytes for people, such as 10MB
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return strconv.FormatFloat(math.Round(float64(size)*10/(1<<20))/10, 'f', -1, 64) + "MB"
+	case size >= 1<<10:
+		return strconv.FormatFloat(math.Round(float64(size)*10/(1<<10))/10, 'f', -1, 64) + "KB"
+	}
+	return strconv.FormatInt(size, 10) + " bytes"
+}
@@ -0,0 +1,148 @@
+package smib
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nlopes/slack"
+	"github.com/somakeit/slacker-smib/internal/command"
+	"github.com/somakeit/slacker-smib/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMIB_handleMessage_uploads(t *testing.T) {
+	tests := []struct {
+		name         string
+		channel      string
+		manifest     command.Manifest
+		stdout       string
+		files        map[string]string
+		output       config.Output
+		maxUpload    int64
+		wantSent     []string
+		wantUploaded []map[string]string
+	}{
+		{
+			name:     "no files",
+			channel:  "Xgeneral",
+			stdout:   "the door is open\n",
+			wantSent: []string{"the door is open\n"},
+		},
+		{
+			name:     "file in a thread",
+			channel:  "Xgeneral",
+			stdout:   "#smib title Webcam\n#smib comment The space right now\nsmile!\n",
+			files:    map[string]string{"webcam.jpg": "JPEG"},
+			wantSent: []string{"smile!\n"},
+			wantUploaded: []map[string]string{{
+				"channels": "Xgeneral", "thread_ts": "99.9", "filename": "webcam.jpg", "filetype": "",
+				"title": "Webcam", "initial_comment": "The space right now", "content": "JPEG",
+			}},
+		},
+		{
+			name:     "private file",
+			channel:  "Xgeneral",
+			manifest: command.Manifest{Private: true},
+			files:    map[string]string{"code.txt": "1234"},
+			wantUploaded: []map[string]string{{
+				"channels": "DXspengler", "thread_ts": "", "filename": "code.txt", "filetype": "",
+				"title": "", "initial_comment": "", "content": "1234",
+			}},
+		},
+		{
+			name:     "private file in a DM",
+			channel:  "Dspengler",
+			manifest: command.Manifest{Private: true},
+			files:    map[string]string{"code.txt": "1234"},
+			wantUploaded: []map[string]string{{
+				"channels": "Dspengler", "thread_ts": "99.9", "filename": "code.txt", "filetype": "",
+				"title": "", "initial_comment": "", "content": "1234",
+			}},
+		},
+		{
+			name:      "file too big",
+			channel:   "Xgeneral",
+			files:     map[string]string{"graph.png": "PNG", "huge.png": strings.Repeat("x", 2048)},
+			maxUpload: 1024,
+			wantSent:  []string{"Sorry <@Xspengler>, door made huge.png which is too big to upload, the limit is 1KB."},
+			wantUploaded: []map[string]string{{
+				"channels": "Xgeneral", "thread_ts": "99.9", "filename": "graph.png", "filetype": "",
+				"title": "", "initial_comment": "", "content": "PNG",
+			}},
+		},
+		{
+			name:     "short output isn't a snippet",
+			channel:  "Xgeneral",
+			stdout:   "one\ntwo\n",
+			output:   config.Output{SnippetLines: 2},
+			wantSent: []string{"one\n", "two\n"},
+		},
+		{
+			name:    "long output is a snippet",
+			channel: "Xgeneral",
+			stdout:  "#smib title Log\none\ntwo\n<three>\n",
+			output:  config.Output{SnippetLines: 2},
+			wantUploaded: []map[string]string{{
+				"channels": "Xgeneral", "thread_ts": "99.9", "filename": "door.txt", "filetype": "text",
+				"title": "Log", "initial_comment": "", "content": "one\ntwo\n<three>\n",
+			}},
+		},
+		{
+			name:      "long snippet is truncated",
+			channel:   "Xgeneral",
+			stdout:    strings.Repeat("0123456789\n", 10),
+			output:    config.Output{SnippetLines: 2},
+			maxUpload: 50,
+			wantUploaded: []map[string]string{{
+				"channels": "Xgeneral", "thread_ts": "99.9", "filename": "door.txt", "filetype": "text",
+				"title": "", "initial_comment": "", "content": "0123456789\n0123456789\n01234567\n[output truncated]\n",
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &reactionTransport{}
+			mockCmd := &mockCommand{manifests: map[string]command.Manifest{"door": tt.manifest}, files: tt.files}
+			mockCmd.Test(t)
+			defer mockCmd.AssertExpectations(t)
+			mockCmd.On("Run", mock.Anything, "door", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "").
+				Return(output(tt.stdout), nil).Once()
+			smib := SMIB{
+				slack:    transport,
+				cmd:      mockCmd,
+				Feedback: config.Feedback{Style: config.FeedbackNone},
+				Output:   tt.output,
+				Files:    config.Files{MaxUploadBytes: tt.maxUpload},
+			}
+
+			message := &slack.MessageEvent{Msg: slack.Msg{Text: "?door", Channel: tt.channel, User: "Xspengler", ThreadTimestamp: "99.9"}}
+			require.NoError(t, smib.handleMessage(context.Background(), message))
+			drain(t, &smib)
+
+			var sent []string
+			for _, msg := range transport.getSent() {
+				sent = append(sent, msg.Text)
+			}
+			assert.Equal(t, tt.wantSent, sent)
+			if tt.wantUploaded == nil {
+				assert.Empty(t, transport.getUploaded())
+			} else {
+				assert.Equal(t, tt.wantUploaded, transport.getUploaded())
+			}
+
+			require.Len(t, mockCmd.tempDirs, 1)
+			_, err := os.Stat(mockCmd.tempDirs[0])
+			assert.True(t, os.IsNotExist(err), "temp dir is removed")
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 bytes", formatSize(512))
+	assert.Equal(t, "1.5KB", formatSize(1536))
+	assert.Equal(t, "10MB", formatSize(10<<20))
+}
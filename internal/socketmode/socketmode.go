@@ -0,0 +1,460 @@
+// Package socketmode connects to slack using Socket Mode. It delivers events in the same form as
+// slack.RTM so the bot can use either, and sends messages using the web API.
+package socketmode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nlopes/slack"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+	// defaultPingInterval is how often the connection is pinged, it is dropped if nothing is heard
+	// from slack for twice as long.
+	defaultPingInterval = 30 * time.Second
+)
+
+// Client is a Socket Mode connection to slack. Web API methods are provided by the embedded
+// slack.Client, which must be authenticated with the bot token.
+type Client struct {
+	*slack.Client
+
+	// IncomingEvents receives the same events as slack.RTM's IncomingEvents
+	IncomingEvents chan slack.RTMEvent
+
+	appToken     string
+	apiURL       string
+	httpClient   *http.Client
+	dialer       *websocket.Dialer
+	idGen        slack.IDGenerator
+	pingInterval time.Duration
+
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	info     *slack.Info
+	kill     chan struct{}
+	killOnce sync.Once
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// OptionAPIURL sets the slack API URL used to open connections, only useful for testing.
+func OptionAPIURL(u string) Option {
+	return func(c *Client) { c.apiURL = u }
+}
+
+// OptionPingInterval sets how often the connection is pinged, it is dropped and reconnected if
+// nothing is heard from slack for twice as long. The default is 30 seconds.
+func OptionPingInterval(d time.Duration) Option {
+	return func(c *Client) { c.pingInterval = d }
+}
+
+// New returns a Client which connects with appToken, an app-level token with the
+// connections:write scope. Client is used for every other API call.
+func New(appToken string, client *slack.Client, options ...Option) *Client {
+	c := &Client{
+		Client:         client,
+		IncomingEvents: make(chan slack.RTMEvent, 50),
+		appToken:       appToken,
+		apiURL:         slack.APIURL,
+		httpClient:     &http.Client{Timeout: 30 * time.Second},
+		dialer:         websocket.DefaultDialer,
+		idGen:          slack.NewSafeID(1),
+		pingInterval:   defaultPingInterval,
+		kill:           make(chan struct{}),
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// ManageConnection connects to slack and delivers events to IncomingEvents, reconnecting with
+// backoff whenever the connection is lost, until Disconnect is called or authentication fails.
+func (c *Client) ManageConnection() {
+	backoff := minBackoff
+	for connectionCount, attempt := 0, 1; ; attempt++ {
+		if !c.emit("connecting", &slack.ConnectingEvent{Attempt: attempt, ConnectionCount: connectionCount}) {
+			return
+		}
+
+		conn, err := c.connect()
+		if err != nil {
+			if isAuthError(err) {
+				c.emit("invalid_auth", &slack.InvalidAuthEvent{})
+				return
+			}
+			c.emit("connection_error", &slack.ConnectionErrorEvent{Attempt: attempt, Backoff: backoff, ErrorObj: err})
+			select {
+			case <-time.After(backoff):
+			case <-c.kill:
+				return
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff, attempt = minBackoff, 0
+
+		c.emit("connected", &slack.ConnectedEvent{ConnectionCount: connectionCount, Info: c.GetInfo()})
+		connectionCount++
+
+		err = c.receive(conn)
+		conn.Close()
+
+		select {
+		case <-c.kill:
+			c.emit("disconnected", &slack.DisconnectedEvent{Intentional: true, Cause: slack.ErrRTMDisconnected})
+			return
+		default:
+			c.emit("disconnected", &slack.DisconnectedEvent{Cause: err})
+		}
+	}
+}
+
+// Disconnect closes the connection and stops ManageConnection from reconnecting.
+func (c *Client) Disconnect() error {
+	already := true
+	c.killOnce.Do(func() {
+		already = false
+		close(c.kill)
+	})
+	if already {
+		return slack.ErrAlreadyDisconnected
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// GetInfo returns the bot's identity, it is nil until auth.test has succeeded.
+func (c *Client) GetInfo() *slack.Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// Events returns IncomingEvents
+func (c *Client) Events() <-chan slack.RTMEvent {
+	return c.IncomingEvents
+}
+
+// NewOutgoingMessage prepares a message for SendMessage, see slack.RTM.NewOutgoingMessage.
+func (c *Client) NewOutgoingMessage(text string, channelID string, options ...slack.RTMsgOption) *slack.OutgoingMessage {
+	msg := slack.OutgoingMessage{
+		ID:      c.idGen.Next(),
+		Type:    "message",
+		Channel: channelID,
+		Text:    text,
+	}
+	for _, option := range options {
+		option(&msg)
+	}
+	return &msg
+}
+
+// NewTypingMessage prepares a typing indicator, Socket Mode apps cannot send these so SendMessage
+// drops them.
+func (c *Client) NewTypingMessage(channelID string) *slack.OutgoingMessage {
+	return &slack.OutgoingMessage{
+		ID:      c.idGen.Next(),
+		Type:    "typing",
+		Channel: channelID,
+	}
+}
+
+// SendMessage posts msg with chat.postMessage. Like the RTM API, the result is delivered to
+// IncomingEvents as an AckMessage or AckErrorEvent.
+func (c *Client) SendMessage(msg *slack.OutgoingMessage) {
+	if msg == nil || msg.Type != "message" {
+		return
+	}
+
+	options := []slack.MsgOption{slack.MsgOptionText(msg.Text, false)}
+	if msg.ThreadTimestamp != "" {
+		options = append(options, slack.MsgOptionTS(msg.ThreadTimestamp))
+	}
+	if msg.ThreadBroadcast {
+		options = append(options, slack.MsgOptionBroadcast())
+	}
+
+	_, ts, err := c.PostMessage(msg.Channel, options...)
+	if err != nil {
+		c.emit("ack_error", &slack.AckErrorEvent{ErrorObj: &SendError{ID: msg.ID, Err: err}})
+		return
+	}
+	c.emit("ack", &slack.AckMessage{
+		ReplyTo:     msg.ID,
+		Timestamp:   ts,
+		Text:        msg.Text,
+		RTMResponse: slack.RTMResponse{Ok: true},
+	})
+}
+
+// emit delivers an event, giving up if the client is disconnected
+func (c *Client) emit(eventType string, data interface{}) bool {
+	select {
+	case c.IncomingEvents <- slack.RTMEvent{Type: eventType, Data: data}:
+		return true
+	case <-c.kill:
+		return false
+	}
+}
+
+// connect opens a new socket mode websocket, having looked up the bot's identity if it isn't known
+// yet so that every connected event carries it
+func (c *Client) connect() (*websocket.Conn, error) {
+	if err := c.lookupInfo(); err != nil {
+		return nil, err
+	}
+
+	url, err := c.openConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := c.dialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial socket mode websocket: %s", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.kill:
+		conn.Close()
+		return nil, slack.ErrRTMDisconnected
+	default:
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// openConnection calls apps.connections.open to get a websocket URL
+func (c *Client) openConnection() (string, error) {
+	req, err := http.NewRequest(http.MethodPost, c.apiURL+"apps.connections.open", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.appToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("apps.connections.open failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("apps.connections.open failed: %s", resp.Status)
+	}
+
+	var body struct {
+		slack.SlackResponse
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode apps.connections.open response: %s", err)
+	}
+	if !body.Ok {
+		return "", apiError{method: "apps.connections.open", code: body.Error}
+	}
+	return body.URL, nil
+}
+
+// lookupInfo calls auth.test to find the bot's identity, unless it is already known
+func (c *Client) lookupInfo() error {
+	if c.GetInfo() != nil {
+		return nil
+	}
+
+	auth, err := c.AuthTest()
+	if err != nil {
+		if auth != nil {
+			// slack answered, the error is its error code
+			return apiError{method: "auth.test", code: err.Error()}
+		}
+		return fmt.Errorf("auth.test failed: %s", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info = &slack.Info{
+		URL:  auth.URL,
+		User: &slack.UserDetails{ID: auth.UserID, Name: auth.User},
+		Team: &slack.Team{ID: auth.TeamID, Name: auth.Team},
+	}
+	return nil
+}
+
+// envelope is a socket mode message from slack
+type envelope struct {
+	Type       string          `json:"type"`
+	EnvelopeID string          `json:"envelope_id"`
+	Reason     string          `json:"reason"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// eventsAPIPayload is the payload of an events_api envelope
+type eventsAPIPayload struct {
+	Type  string          `json:"type"`
+	Event json.RawMessage `json:"event"`
+}
+
+// receive acknowledges and delivers envelopes from conn until the connection fails or slack asks
+// us to reconnect. The connection is pinged while it is open and fails if nothing, including the
+// pongs, is heard from slack for two ping intervals, so a half-open connection is noticed.
+func (c *Client) receive(conn *websocket.Conn) error {
+	alive := func() error {
+		return conn.SetReadDeadline(time.Now().Add(2 * c.pingInterval))
+	}
+	conn.SetPongHandler(func(string) error { return alive() })
+	conn.SetPingHandler(func(data string) error {
+		if err := alive(); err != nil {
+			return err
+		}
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.pingInterval))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	if err := alive(); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.pingInterval)); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		var env envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			var timeout net.Error
+			if errors.As(err, &timeout) && timeout.Timeout() {
+				return fmt.Errorf("nothing heard from slack for %s", 2*c.pingInterval)
+			}
+			return err
+		}
+		if err := alive(); err != nil {
+			return err
+		}
+
+		if env.EnvelopeID != "" {
+			if err := conn.WriteJSON(struct {
+				EnvelopeID string `json:"envelope_id"`
+			}{env.EnvelopeID}); err != nil {
+				return fmt.Errorf("failed to acknowledge envelope: %s", err)
+			}
+		}
+
+		switch env.Type {
+		case "hello":
+			c.emit("hello", &slack.HelloEvent{})
+		case "disconnect":
+			return fmt.Errorf("slack requested disconnect: %s", env.Reason)
+		case "events_api":
+			c.handleEventsAPI(env.Payload)
+		default:
+			c.Debugf("Ignoring socket mode envelope of type %s", env.Type)
+		}
+	}
+}
+
+// handleEventsAPI delivers the event in an events_api payload as the matching RTM event type
+func (c *Client) handleEventsAPI(raw json.RawMessage) {
+	var payload eventsAPIPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		c.emit("unmarshalling_error", &slack.UnmarshallingErrorEvent{ErrorObj: err})
+		return
+	}
+	if payload.Type != "event_callback" {
+		return
+	}
+
+	var event slack.Event
+	if err := json.Unmarshal(payload.Event, &event); err != nil {
+		c.emit("unmarshalling_error", &slack.UnmarshallingErrorEvent{ErrorObj: err})
+		return
+	}
+
+	v, ok := slack.EventMapping[event.Type]
+	if !ok {
+		c.emit("unmarshalling_error", &slack.UnmarshallingErrorEvent{
+			ErrorObj: fmt.Errorf("socket mode: received unmapped event %q", event.Type),
+		})
+		return
+	}
+	data := reflect.New(reflect.TypeOf(v)).Interface()
+	if err := json.Unmarshal(payload.Event, data); err != nil {
+		c.emit("unmarshalling_error", &slack.UnmarshallingErrorEvent{
+			ErrorObj: fmt.Errorf("socket mode: could not unmarshal event %q: %s", event.Type, err),
+		})
+		return
+	}
+	c.emit(event.Type, data)
+}
+
+// SendError is the error in the AckErrorEvent for a message which could not be sent
+type SendError struct {
+	// ID is the ID of the OutgoingMessage
+	ID  int
+	Err error
+}
+
+func (e *SendError) Error() string { return fmt.Sprintf("message %d: %s", e.ID, e.Err) }
+
+// Unwrap returns the error from chat.postMessage
+func (e *SendError) Unwrap() error { return e.Err }
+
+// MessageID returns the ID of the message which failed
+func (e *SendError) MessageID() int { return e.ID }
+
+// apiError is an error code returned by a slack API method while connecting
+type apiError struct {
+	method string
+	code   string
+}
+
+func (a apiError) Error() string { return a.method + ": " + a.code }
+
+// isAuthError reports whether err means the app or bot token will never work
+func isAuthError(err error) bool {
+	var a apiError
+	if !errors.As(err, &a) {
+		return false
+	}
+	switch a.code {
+	case "invalid_auth", "not_authed", "account_inactive", "not_allowed_token_type":
+		return true
+	}
+	return false
+}
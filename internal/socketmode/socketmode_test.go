@@ -0,0 +1,335 @@
+package socketmode
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// standIn is a local stand-in for slack's socket mode and web API which plays back recorded
+// envelopes, one recording per connection.
+type standIn struct {
+	*httptest.Server
+	recordings [][]json.RawMessage
+	// silent stops the stand-in answering pings, like a half-open connection
+	silent bool
+	// authFailures is how many auth.test calls fail before it works again
+	authFailures int
+
+	mu          sync.Mutex
+	connections int
+	acks        []string
+	posted      []map[string]string
+}
+
+func newStandIn(t *testing.T) *standIn {
+	raw, err := ioutil.ReadFile("testdata/envelopes.json")
+	require.NoError(t, err)
+	s := &standIn{}
+	require.NoError(t, json.Unmarshal(raw, &s.recordings))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apps.connections.open", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xapp-test" {
+			w.Write([]byte(`{"ok":false,"error":"invalid_auth"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"url":"ws` + strings.TrimPrefix(s.URL, "http") + `/link"}`))
+	})
+	mux.HandleFunc("/auth.test", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		if r.Form.Get("token") != "xoxb-test" {
+			w.Write([]byte(`{"ok":false,"error":"invalid_auth"}`))
+			return
+		}
+		s.mu.Lock()
+		failing := s.authFailures > 0
+		s.authFailures--
+		s.mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"ok":true,"user_id":"Usmib","user":"smib","team_id":"T0SMIB","team":"So Make It"}`))
+	})
+	mux.HandleFunc("/chat.postMessage", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		if r.Form.Get("channel") == "Xbroken" {
+			w.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+			return
+		}
+		s.mu.Lock()
+		s.posted = append(s.posted, map[string]string{
+			"channel":   r.Form.Get("channel"),
+			"text":      r.Form.Get("text"),
+			"thread_ts": r.Form.Get("thread_ts"),
+		})
+		s.mu.Unlock()
+		w.Write([]byte(`{"ok":true,"channel":"` + r.Form.Get("channel") + `","ts":"1630000009.000900"}`))
+	})
+	mux.HandleFunc("/link", s.link(t))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *standIn) link(t *testing.T) http.HandlerFunc {
+	upgrader := websocket.Upgrader{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		s.mu.Lock()
+		recording := s.recordings[s.connections%len(s.recordings)]
+		s.connections++
+		if s.silent {
+			conn.SetPingHandler(func(string) error { return nil })
+		}
+		s.mu.Unlock()
+
+		go func() {
+			for {
+				var ack struct {
+					EnvelopeID string `json:"envelope_id"`
+				}
+				if err := conn.ReadJSON(&ack); err != nil {
+					return
+				}
+				s.mu.Lock()
+				s.acks = append(s.acks, ack.EnvelopeID)
+				s.mu.Unlock()
+			}
+		}()
+
+		for _, env := range recording {
+			if err := conn.WriteMessage(websocket.TextMessage, env); err != nil {
+				return
+			}
+		}
+		// Hold the connection open until the client goes away
+		<-r.Context().Done()
+	}
+}
+
+func (s *standIn) getAcks() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.acks...)
+}
+
+func nextEvent(t *testing.T, c *Client) slack.RTMEvent {
+	select {
+	case event := <-c.IncomingEvents:
+		return event
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "timed out waiting for event")
+	}
+	return slack.RTMEvent{}
+}
+
+func TestClient_ManageConnection(t *testing.T) {
+	server := newStandIn(t)
+	defer server.Close()
+
+	client := slack.New("xoxb-test", slack.OptionAPIURL(server.URL+"/"))
+	c := New("xapp-test", client, OptionAPIURL(server.URL+"/"))
+
+	done := make(chan struct{})
+	go func() {
+		c.ManageConnection()
+		close(done)
+	}()
+
+	var events []slack.RTMEvent
+	for len(events) < 10 {
+		events = append(events, nextEvent(t, c))
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{
+		"connecting", "connected", "hello", "message", "user_change", "disconnected",
+		"connecting", "connected", "hello", "message",
+	}, types)
+
+	connected := events[1].Data.(*slack.ConnectedEvent)
+	assert.Equal(t, 0, connected.ConnectionCount)
+	assert.Equal(t, "Usmib", connected.Info.User.ID)
+	assert.Equal(t, "smib", connected.Info.User.Name)
+	assert.Equal(t, 1, events[7].Data.(*slack.ConnectedEvent).ConnectionCount)
+
+	message := events[3].Data.(*slack.MessageEvent)
+	assert.Equal(t, "?door", message.Text)
+	assert.Equal(t, "Xspengler", message.User)
+	assert.Equal(t, "Xgeneral", message.Channel)
+	assert.Equal(t, "", message.ThreadTimestamp)
+
+	userChange := events[4].Data.(*slack.UserChangeEvent)
+	assert.Equal(t, "egon", userChange.User.Name)
+
+	disconnected := events[5].Data.(*slack.DisconnectedEvent)
+	assert.False(t, disconnected.Intentional)
+	assert.EqualError(t, disconnected.Cause, "slack requested disconnect: refresh_requested")
+
+	threaded := events[9].Data.(*slack.MessageEvent)
+	assert.Equal(t, "?countdown", threaded.Text)
+	assert.Equal(t, "1630000000.000100", threaded.ThreadTimestamp)
+
+	assert.Eventually(t, func() bool {
+		return len(server.getAcks()) == 4
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"a1b2c3d4-0001", "a1b2c3d4-0002", "a1b2c3d4-0003", "a1b2c3d4-0004"}, server.getAcks())
+
+	assert.NoError(t, c.Disconnect())
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "ManageConnection did not return after Disconnect")
+	}
+	assert.Equal(t, slack.ErrAlreadyDisconnected, c.Disconnect())
+}
+
+func TestClient_ManageConnection_invalidAuth(t *testing.T) {
+	server := newStandIn(t)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		appToken string
+		botToken string
+	}{
+		{name: "app token revoked", appToken: "xapp-revoked", botToken: "xoxb-test"},
+		{name: "bot token revoked", appToken: "xapp-test", botToken: "xoxb-revoked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := slack.New(tt.botToken, slack.OptionAPIURL(server.URL+"/"))
+			c := New(tt.appToken, client, OptionAPIURL(server.URL+"/"))
+
+			done := make(chan struct{})
+			go func() {
+				c.ManageConnection()
+				close(done)
+			}()
+
+			assert.Equal(t, "connecting", nextEvent(t, c).Type)
+			assert.IsType(t, &slack.InvalidAuthEvent{}, nextEvent(t, c).Data)
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				require.FailNow(t, "ManageConnection did not give up on invalid auth")
+			}
+		})
+	}
+}
+
+func TestClient_ManageConnection_authTestFails(t *testing.T) {
+	server := newStandIn(t)
+	defer server.Close()
+	server.authFailures = 1
+
+	client := slack.New("xoxb-test", slack.OptionAPIURL(server.URL+"/"))
+	c := New("xapp-test", client, OptionAPIURL(server.URL+"/"))
+	go c.ManageConnection()
+	defer c.Disconnect()
+
+	assert.Equal(t, "connecting", nextEvent(t, c).Type)
+	event := nextEvent(t, c)
+	require.IsType(t, &slack.ConnectionErrorEvent{}, event.Data)
+	assert.Contains(t, event.Data.(*slack.ConnectionErrorEvent).Error(), "auth.test failed")
+	assert.Nil(t, c.GetInfo())
+
+	assert.Equal(t, "connecting", nextEvent(t, c).Type)
+	event = nextEvent(t, c)
+	require.IsType(t, &slack.ConnectedEvent{}, event.Data)
+	info := event.Data.(*slack.ConnectedEvent).Info
+	require.NotNil(t, info)
+	assert.Equal(t, "Usmib", info.User.ID)
+}
+
+func TestClient_SendMessage(t *testing.T) {
+	server := newStandIn(t)
+	defer server.Close()
+
+	client := slack.New("xoxb-test", slack.OptionAPIURL(server.URL+"/"))
+	c := New("xapp-test", client, OptionAPIURL(server.URL+"/"))
+
+	c.SendMessage(c.NewTypingMessage("Xgeneral"))
+	select {
+	case event := <-c.IncomingEvents:
+		assert.Fail(t, "typing messages should be dropped", event.Type)
+	default:
+	}
+
+	msg := c.NewOutgoingMessage("computer says yes", "Xgeneral", slack.RTMsgOptionTS("2.2"))
+	go c.SendMessage(msg)
+	ack := nextEvent(t, c)
+	require.IsType(t, &slack.AckMessage{}, ack.Data)
+	assert.Equal(t, msg.ID, ack.Data.(*slack.AckMessage).ReplyTo)
+	assert.Equal(t, "1630000009.000900", ack.Data.(*slack.AckMessage).Timestamp)
+	assert.Equal(t, []map[string]string{{"channel": "Xgeneral", "text": "computer says yes", "thread_ts": "2.2"}}, server.posted)
+
+	broken := c.NewOutgoingMessage("hello?", "Xbroken")
+	go c.SendMessage(broken)
+	ackErr := nextEvent(t, c)
+	require.IsType(t, &slack.AckErrorEvent{}, ackErr.Data)
+	assert.Contains(t, ackErr.Data.(*slack.AckErrorEvent).Error(), "channel_not_found")
+	var sendErr *SendError
+	require.True(t, errors.As(ackErr.Data.(*slack.AckErrorEvent).ErrorObj, &sendErr))
+	assert.Equal(t, broken.ID, sendErr.MessageID())
+}
+
+func TestClient_ManageConnection_halfOpen(t *testing.T) {
+	server := newStandIn(t)
+	defer server.Close()
+	// Every connection says hello then stays open
+	server.recordings = [][]json.RawMessage{server.recordings[0][:1]}
+
+	tests := []struct {
+		name           string
+		silent         bool
+		wantDisconnect bool
+	}{
+		{name: "answers pings"},
+		{name: "silent", silent: true, wantDisconnect: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.mu.Lock()
+			server.silent = tt.silent
+			server.mu.Unlock()
+
+			client := slack.New("xoxb-test", slack.OptionAPIURL(server.URL+"/"))
+			c := New("xapp-test", client, OptionAPIURL(server.URL+"/"), OptionPingInterval(20*time.Millisecond))
+			go c.ManageConnection()
+			defer c.Disconnect()
+
+			assert.Equal(t, "connecting", nextEvent(t, c).Type)
+			assert.Equal(t, "connected", nextEvent(t, c).Type)
+			assert.Equal(t, "hello", nextEvent(t, c).Type)
+
+			select {
+			case event := <-c.IncomingEvents:
+				require.True(t, tt.wantDisconnect, "unexpected %s event", event.Type)
+				require.IsType(t, &slack.DisconnectedEvent{}, event.Data)
+				assert.EqualError(t, event.Data.(*slack.DisconnectedEvent).Cause, "nothing heard from slack for 40ms")
+				assert.Equal(t, "connecting", nextEvent(t, c).Type, "it should reconnect")
+			case <-time.After(200 * time.Millisecond):
+				assert.False(t, tt.wantDisconnect, "the half-open connection was never dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+// Package store is a persistent key-value store for commands, each command has its own
+// namespace of keys.
+package store
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Errors returned by the Store
+var (
+	ErrNotInteger = errors.New("value is not an integer")
+	ErrEmptyKey   = errors.New("key must not be empty")
+)
+
+// Store holds values by command and key
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the store in the file at path, creating it if it doesn't exist. Only one process may
+// have the store open at once.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store '%s': %s", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the store
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the value of key in namespace, and whether it was set
+func (s *Store) Get(namespace, key string) (string, bool, error) {
+	var (
+		value string
+		ok    bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(namespace)); b != nil {
+			if v := b.Get([]byte(key)); v != nil {
+				value, ok = string(v), true
+			}
+		}
+		return nil
+	})
+	return value, ok, err
+}
+
+// Set sets key in namespace to value
+func (s *Store) Set(namespace, key, value string) error {
+	return s.update(namespace, key, func(b *bolt.Bucket) error {
+		return b.Put([]byte(key), []byte(value))
+	})
+}
+
+// Incr atomically adds by to the integer value of key in namespace, which is 0 if it isn't set,
+// and returns the new value.
+func (s *Store) Incr(namespace, key string, by int64) (int64, error) {
+	var n int64
+	err := s.update(namespace, key, func(b *bolt.Bucket) error {
+		if v := b.Get([]byte(key)); v != nil {
+			var err error
+			if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+				return ErrNotInteger
+			}
+		}
+		n += by
+		return b.Put([]byte(key), []byte(strconv.FormatInt(n, 10)))
+	})
+	return n, err
+}
+
+// CompareAndSwap atomically sets key in namespace to value if it is currently old, or if it
+// isn't set and old is empty. It returns whether the value was set.
+func (s *Store) CompareAndSwap(namespace, key, old, value string) (bool, error) {
+	swapped := false
+	err := s.update(namespace, key, func(b *bolt.Bucket) error {
+		if string(b.Get([]byte(key))) != old {
+			return nil
+		}
+		swapped = true
+		return b.Put([]byte(key), []byte(value))
+	})
+	return swapped, err
+}
+
+// Delete removes key from namespace
+func (s *Store) Delete(namespace, key string) error {
+	return s.update(namespace, key, func(b *bolt.Bucket) error {
+		return b.Delete([]byte(key))
+	})
+}
+
+// List returns the keys and values in namespace which start with prefix
+func (s *Store) List(namespace, prefix string) (map[string]string, error) {
+	values := map[string]string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(namespace))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			values[string(k)] = string(v)
+		}
+		return nil
+	})
+	return values, err
+}
+
+// update runs fn in a writable transaction with namespace's bucket, creating it if necessary
+func (s *Store) update(namespace, key string, fn func(*bolt.Bucket) error) error {
+	if namespace == "" || key == "" {
+		return ErrEmptyKey
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// Export writes every namespace's keys and values to w as a JSON object of objects
+func (s *Store) Export(w io.Writer) error {
+	all := map[string]map[string]string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			values := map[string]string{}
+			all[string(name)] = values
+			return b.ForEach(func(k, v []byte) error {
+				values[string(k)] = string(v)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(all)
+}
+
+// BackupHandler serves a consistent copy of the store's database file, which can be opened with
+// Open to restore it. With ?format=json it serves the Export instead. Requests must have token as
+// a bearer token, as backups hold every command's keys.
+func (s *Store) BackupHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := s.Export(w); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		err := s.db.View(func(tx *bolt.Tx) error {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="smib.db"`)
+			w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+			_, err := tx.WriteTo(w)
+			return err
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T) *Store {
+	s, err := Open(filepath.Join(t.TempDir(), "smib.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStore_SetGetDelete(t *testing.T) {
+	s := openStore(t)
+
+	_, ok, err := s.Get("karma", "egon")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, s.Set("karma", "egon", "3"))
+	value, ok, err := s.Get("karma", "egon")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "3", value)
+
+	_, ok, err = s.Get("quotes", "egon")
+	require.NoError(t, err)
+	assert.False(t, ok, "namespaces are separate")
+
+	require.NoError(t, s.Delete("karma", "egon"))
+	_, ok, err = s.Get("karma", "egon")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.Equal(t, ErrEmptyKey, s.Set("karma", "", "1"))
+	assert.Equal(t, ErrEmptyKey, s.Set("", "egon", "1"))
+}
+
+func TestStore_Incr(t *testing.T) {
+	s := openStore(t)
+
+	n, err := s.Incr("karma", "egon", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	n, err = s.Incr("karma", "egon", -3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-2), n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Incr("karma", "ray", 1)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	value, _, err := s.Get("karma", "ray")
+	require.NoError(t, err)
+	assert.Equal(t, "20", value)
+
+	require.NoError(t, s.Set("karma", "slimer", "lots"))
+	_, err = s.Incr("karma", "slimer", 1)
+	assert.Equal(t, ErrNotInteger, err)
+}
+
+func TestStore_CompareAndSwap(t *testing.T) {
+	s := openStore(t)
+
+	swapped, err := s.CompareAndSwap("door", "holder", "", "egon")
+	require.NoError(t, err)
+	assert.True(t, swapped, "unset")
+	swapped, err = s.CompareAndSwap("door", "holder", "", "ray")
+	require.NoError(t, err)
+	assert.False(t, swapped, "already set")
+	swapped, err = s.CompareAndSwap("door", "holder", "egon", "ray")
+	require.NoError(t, err)
+	assert.True(t, swapped)
+
+	value, _, err := s.Get("door", "holder")
+	require.NoError(t, err)
+	assert.Equal(t, "ray", value)
+}
+
+func TestStore_List(t *testing.T) {
+	s := openStore(t)
+	require.NoError(t, s.Set("seen", "user:egon", "1"))
+	require.NoError(t, s.Set("seen", "user:ray", "2"))
+	require.NoError(t, s.Set("seen", "channel:general", "3"))
+	require.NoError(t, s.Set("karma", "user:egon", "4"))
+
+	values, err := s.List("seen", "user:")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"user:egon": "1", "user:ray": "2"}, values)
+
+	values, err = s.List("seen", "")
+	require.NoError(t, err)
+	assert.Len(t, values, 3)
+
+	values, err = s.List("quotes", "")
+	require.NoError(t, err)
+	assert.Empty(t, values)
+}
+
+func TestStore_Export(t *testing.T) {
+	s := openStore(t)
+	require.NoError(t, s.Set("karma", "egon", "4"))
+	require.NoError(t, s.Set("seen", "ray", "yesterday"))
+
+	var b bytes.Buffer
+	require.NoError(t, s.Export(&b))
+	assert.JSONEq(t, `{"karma": {"egon": "4"}, "seen": {"ray": "yesterday"}}`, b.String())
+}
+
+func TestStore_BackupHandler(t *testing.T) {
+	s := openStore(t)
+	require.NoError(t, s.Set("karma", "egon", "4"))
+	server := httptest.NewServer(s.BackupHandler("backup-token"))
+	defer server.Close()
+	get := func(url, token string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return http.DefaultClient.Do(req)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		resp, err := get(server.URL, token)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp, err := get(server.URL, "backup-token")
+	require.NoError(t, err)
+	backup, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	path := filepath.Join(t.TempDir(), "restored.db")
+	require.NoError(t, ioutil.WriteFile(path, backup, 0600))
+	restored, err := Open(path)
+	require.NoError(t, err)
+	defer restored.Close()
+	value, ok, err := restored.Get("karma", "egon")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "4", value)
+
+	resp, err = get(server.URL+"?format=json", "backup-token")
+	require.NoError(t, err)
+	export, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"karma": {"egon": "4"}}`, string(export))
+}